@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/unit"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// HeartbeatInterval defines how often the server pings the websocket
+	// connections of the players.
+	HeartbeatInterval = 15 * time.Second
+	// HeartbeatTimeout defines how long a connection may stay silent,
+	// neither answering pings nor sending events, before the player is
+	// considered disconnected. This has to be well above HeartbeatInterval.
+	HeartbeatTimeout = 45 * time.Second
+)
+
+var heartbeatRTT = outboundMeter.NewInt64ValueRecorder("websocket.rtt",
+	metric.WithDescription("Round trip time of the pings sent to the websockets of players."),
+	metric.WithUnit(unit.Milliseconds))
+
+// startHeartbeat pings the websocket connection of the player until the
+// returned function is called. Every pong extends the read deadline of the
+// connection and updates the RTT of the player. Connections that stay
+// silent for longer than HeartbeatTimeout run into the read deadline, which
+// ends wsListen. This way, half-open connections don't keep players marked
+// as connected forever.
+func startHeartbeat(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) func() {
+	extendReadDeadline(socket)
+	socket.SetPongHandler(func(appData string) error {
+		extendReadDeadline(socket)
+
+		//The pings carry the time they have been sent at, so there's no need
+		//to keep track of them.
+		sent, err := strconv.ParseInt(appData, 10, 64)
+		if err != nil {
+			return nil
+		}
+		rtt := time.Since(time.Unix(0, sent))
+		heartbeatRTT.Record(context.Background(), rtt.Milliseconds())
+		lobby.Synchronized(func() {
+			//The player might have reconnected in the meantime.
+			if player.GetWebsocket() == socket {
+				player.RTT = rtt.Milliseconds()
+			}
+		})
+		return nil
+	})
+
+	stop := make(chan struct{})
+	ticker := time.NewTicker(HeartbeatInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				//Control messages may be written concurrently to the
+				//outbound queue, so there's no need to queue the ping.
+				ping := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+				if err := socket.WriteControl(websocket.PingMessage, ping, time.Now().Add(OutboundWriteTimeout)); err != nil {
+					//The read deadline takes care of the broken connection.
+					return
+				}
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// extendReadDeadline gives the connection another HeartbeatTimeout to show
+// signs of life.
+func extendReadDeadline(socket *websocket.Conn) {
+	socket.SetReadDeadline(time.Now().Add(HeartbeatTimeout))
+}
+
+// isTimeout tells whether the error has been caused by running into the
+// read deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// listenWithHeartbeat connects a new player via the given server socket and
+// returns a channel that is closed once wsListen has returned.
+func listenWithHeartbeat(t *testing.T, interval, timeout time.Duration) (*game.Lobby, *game.Player, chan struct{}) {
+	previousInterval, previousTimeout := HeartbeatInterval, HeartbeatTimeout
+	t.Cleanup(func() { HeartbeatInterval, HeartbeatTimeout = previousInterval, previousTimeout })
+	HeartbeatInterval, HeartbeatTimeout = interval, timeout
+
+	serverSocket, clientSocket := createTestSockets(t)
+	lobby := &game.Lobby{}
+	t.Cleanup(lobby.Stop)
+	player := lobby.JoinPlayer("Kevin")
+	player.SetWebsocket(serverSocket)
+	player.Connected = true
+
+	//Reading makes the client answer the pings.
+	go func() {
+		for {
+			if _, _, err := clientSocket.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	stopHeartbeat := startHeartbeat(lobby, player, serverSocket)
+	t.Cleanup(stopHeartbeat)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wsListen(lobby, player, serverSocket)
+	}()
+	//The settings mustn't be restored while still listening.
+	t.Cleanup(func() {
+		serverSocket.Close()
+		<-done
+	})
+	return lobby, player, done
+}
+
+func Test_heartbeatKeepAlive(t *testing.T) {
+	_, _, done := listenWithHeartbeat(t, 10*time.Millisecond, 100*time.Millisecond)
+
+	select {
+	case <-done:
+		t.Error("expected the connection to be kept alive by the pongs")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func Test_heartbeatRTT(t *testing.T) {
+	lobby, player, _ := listenWithHeartbeat(t, time.Hour, time.Hour)
+
+	//Locally, the RTT is usually below a millisecond, so a ping that has
+	//been sent a while ago is faked.
+	sent := time.Now().Add(-50 * time.Millisecond).UnixNano()
+	if err := player.GetWebsocket().PongHandler()(strconv.FormatInt(sent, 10)); err != nil {
+		t.Fatal(err)
+	}
+	lobby.Synchronized(func() {
+		if player.RTT < 50 || player.RTT > 1000 {
+			t.Errorf("expected an RTT of about 50ms, but got %dms", player.RTT)
+		}
+	})
+}
+
+func Test_heartbeatTimeout(t *testing.T) {
+	//Pings that are never sent, can't be answered.
+	lobby, player, done := listenWithHeartbeat(t, time.Hour, 50*time.Millisecond)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the silent connection to time out")
+	}
+	lobby.Synchronized(func() {
+		if player.Connected || player.GetWebsocket() != nil {
+			t.Error("expected the player to be disconnected")
+		}
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"os"
 	"strings"
+
+	"github.com/guillaumerosinosky/scribble.rs/state"
 )
 
 // RootPath is the path directly after the domain and before the
@@ -20,18 +22,27 @@ func init() {
 	if rootPathAvailable && rootPath != "" {
 		RootPath = rootPath
 	}
+
+	//Lobbies are loaded before the routes are set up, so the handlers have
+	//to be in place by then, otherwise reclaimed lobbies would subscribe to
+	//their input with the dummy handler.
+	state.LobbyInputHandler = pubSubIn
+	state.LobbyOutputHandler = pubSubOut
+	state.LobbyResyncHandler = requestResync
+	state.LobbyWriters = installWriters
 }
 
 // SetupRoutes registers the /v1/ endpoints with the http package.
 func SetupRoutes() {
 	http.HandleFunc(RootPath+"/v1/stats", stats)
+	http.HandleFunc(RootPath+"/v1/cluster", cluster)
 	//The websocket is shared between the public API and the official client
-	http.HandleFunc(RootPath+"/v1/ws", wsEndpoint)
+	http.HandleFunc(RootPath+"/v1/ws", RouteToOwner(wsEndpoint))
 
 	//These exist only for the public API. We version them in order to ensure
 	//backwards compatibility as far as possible.
 	http.HandleFunc(RootPath+"/v1/lobby", lobbyEndpoint)
-	http.HandleFunc(RootPath+"/v1/lobby/player", enterLobby)
+	http.HandleFunc(RootPath+"/v1/lobby/player", RouteToOwner(enterLobby))
 }
 
 // remoteAddressToSimpleIP removes unnecessary clutter from the input,
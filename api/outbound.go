@@ -0,0 +1,428 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+	"github.com/guillaumerosinosky/scribble.rs/state"
+)
+
+// Available policies for full outbound queues, see OutboundPolicy.
+const (
+	// OutboundCoalesce replaces the queued drawing events with a single
+	// event containing the complete drawing. Players whose queue is full of
+	// other events are disconnected.
+	OutboundCoalesce = "coalesce"
+	// OutboundDrop drops events the game can do without, such as drawing
+	// and chat events. Players whose queue is full of other events are
+	// disconnected.
+	OutboundDrop = "drop"
+	// OutboundDisconnect disconnects players as soon as their queue is full.
+	OutboundDisconnect = "disconnect"
+)
+
+var (
+	// OutboundQueueSize defines how many events can be queued for a single
+	// player before the OutboundPolicy is applied.
+	OutboundQueueSize = 256
+	// OutboundWriteTimeout defines how long writing a single event to a
+	// player may take before the player is disconnected.
+	OutboundWriteTimeout = 10 * time.Second
+	// OutboundPolicy defines what happens to events for players that can't
+	// keep up, see SetOutboundPolicy.
+	OutboundPolicy = OutboundCoalesce
+)
+
+// SetOutboundPolicy sets the OutboundPolicy, as long as the given policy is
+// known.
+func SetOutboundPolicy(policy string) error {
+	switch policy {
+	case OutboundCoalesce, OutboundDrop, OutboundDisconnect:
+		OutboundPolicy = policy
+		return nil
+	}
+
+	return fmt.Errorf("unknown outbound policy '%s'", policy)
+}
+
+var (
+	outboundMeter  = metric.Must(global.Meter("github.com/guillaumerosinosky/scribble.rs/api"))
+	outboundQueued = outboundMeter.NewInt64UpDownCounter("websocket.outbound.queued",
+		metric.WithDescription("Events waiting to be written to the websockets of players."))
+	outboundDropped = outboundMeter.NewInt64Counter("websocket.outbound.dropped",
+		metric.WithDescription("Events that have been dropped or coalesced, as players couldn't keep up."))
+	outboundDisconnected = outboundMeter.NewInt64Counter("websocket.outbound.disconnected",
+		metric.WithDescription("Players that have been disconnected, as they couldn't keep up."))
+)
+
+var (
+	outboundQueues      = make(map[*websocket.Conn]*outboundQueue)
+	outboundQueuesMutex = &sync.Mutex{}
+)
+
+// errOutboundQueueClosed signals that events can't be sent to the player
+// anymore.
+var errOutboundQueueClosed = errors.New("player not connected")
+
+// outboundMessage is an event that has already been encoded. Events sent to
+// several players are prepared, so that they are framed only once.
+type outboundMessage struct {
+	eventType string
+	data      []byte
+	prepared  *websocket.PreparedMessage
+	// drawing marks the replacement for coalesced drawing events. The
+	// drawing is only looked up once the message is written, so that it
+	// includes everything that happened in the meantime.
+	drawing bool
+}
+
+// outboundQueue holds the events for a single websocket connection, which
+// are written by a goroutine of its own. This way, a slow connection can't
+// hold up the lobby.
+type outboundQueue struct {
+	player *game.Player
+	socket *websocket.Conn
+	// currentDrawing returns the drawing to send instead of coalesced
+	// drawing events. If this replica doesn't know the current drawing,
+	// false is returned, as the drawing has been requested from the
+	// reference replica of the lobby instead.
+	currentDrawing func() (interface{}, bool)
+
+	mutex    *sync.Mutex
+	messages []*outboundMessage
+	closed   bool
+	// wakeup signals the writer that there are new messages or that the
+	// queue has been closed.
+	wakeup chan struct{}
+}
+
+func newOutboundQueue(player *game.Player, socket *websocket.Conn, currentDrawing func() (interface{}, bool)) *outboundQueue {
+	return &outboundQueue{
+		player:         player,
+		socket:         socket,
+		currentDrawing: currentDrawing,
+		mutex:          &sync.Mutex{},
+		wakeup:         make(chan struct{}, 1),
+	}
+}
+
+// startOutboundQueue creates the queue for the given websocket connection of
+// the player and starts writing to it.
+func startOutboundQueue(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) {
+	queue := newOutboundQueue(player, socket, func() (interface{}, bool) {
+		var drawing []*game.DrawingOperation
+		var known bool
+		lobby.Synchronized(func() {
+			//Other replicas only forward the drawing events, so their copy
+			//of the drawing is outdated.
+			known = !state.PubSub || lobby.IsReferenceReplica()
+			if known {
+				drawing = lobby.GetCurrentDrawing()
+			}
+		})
+		if !known {
+			requestDrawing(lobby.LobbyID, player.ID)
+		}
+		return drawing, known
+	})
+
+	outboundQueuesMutex.Lock()
+	outboundQueues[socket] = queue
+	outboundQueuesMutex.Unlock()
+
+	go queue.run()
+}
+
+// stopOutboundQueue discards the queue of the given websocket connection,
+// which has to be done once the connection has been closed.
+func stopOutboundQueue(socket *websocket.Conn) {
+	outboundQueuesMutex.Lock()
+	queue := outboundQueues[socket]
+	delete(outboundQueues, socket)
+	outboundQueuesMutex.Unlock()
+
+	if queue != nil {
+		queue.close()
+	}
+}
+
+func getOutboundQueue(socket *websocket.Conn) *outboundQueue {
+	outboundQueuesMutex.Lock()
+	defer outboundQueuesMutex.Unlock()
+	return outboundQueues[socket]
+}
+
+// enqueue encodes the event and queues it for writing, applying the
+// OutboundPolicy if the queue is full.
+func (queue *outboundQueue) enqueue(object interface{}) error {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return queue.push(&outboundMessage{eventType: eventTypeOf(object), data: data})
+}
+
+// push queues the encoded event, applying the OutboundPolicy if the queue is
+// full.
+func (queue *outboundQueue) push(message *outboundMessage) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return errOutboundQueueClosed
+	}
+	if len(queue.messages) >= OutboundQueueSize && !queue.makeRoomUnsynchronized(message) {
+		if queue.closed {
+			return errOutboundQueueClosed
+		}
+		return nil
+	}
+
+	queue.messages = append(queue.messages, message)
+	outboundQueued.Add(context.Background(), 1)
+	queue.signal()
+	return nil
+}
+
+// makeRoomUnsynchronized applies the OutboundPolicy to the full queue and
+// tells whether the message still has to be queued. If there's no way to
+// make room, the connection is closed.
+func (queue *outboundQueue) makeRoomUnsynchronized(message *outboundMessage) bool {
+	switch OutboundPolicy {
+	case OutboundCoalesce:
+		if queue.coalesceUnsynchronized() {
+			//The complete drawing is sent instead, so the event isn't
+			//needed anymore.
+			if isDrawingEvent(message.eventType) {
+				recordDrop(message, "coalesced")
+				return false
+			}
+			if len(queue.messages) < OutboundQueueSize {
+				return true
+			}
+		}
+	case OutboundDrop:
+		if !isCriticalEvent(message.eventType) {
+			recordDrop(message, "dropped")
+			return false
+		}
+		if queue.dropOldestUnsynchronized() {
+			return true
+		}
+	}
+
+	outboundDisconnected.Add(context.Background(), 1, label.String("policy", OutboundPolicy))
+	log.Printf("Disconnecting player %s(%s), as they can't keep up with the events of the lobby.\n", queue.player.Name, queue.player.ID)
+	queue.closeUnsynchronized()
+	return false
+}
+
+// coalesceUnsynchronized replaces all queued drawing events with a single
+// message containing the complete drawing at the end of the queue. It tells
+// whether there was anything to replace.
+func (queue *outboundQueue) coalesceUnsynchronized() bool {
+	remaining := make([]*outboundMessage, 0, len(queue.messages))
+	for _, queued := range queue.messages {
+		if queued.drawing || isDrawingEvent(queued.eventType) {
+			recordDrop(queued, "coalesced")
+		} else {
+			remaining = append(remaining, queued)
+		}
+	}
+
+	removed := len(queue.messages) - len(remaining)
+	if removed == 0 {
+		return false
+	}
+
+	queue.messages = append(remaining, &outboundMessage{eventType: "drawing", drawing: true})
+	outboundQueued.Add(context.Background(), int64(1-removed))
+	return true
+}
+
+// dropOldestUnsynchronized removes the oldest event the game can do without
+// and tells whether there was one.
+func (queue *outboundQueue) dropOldestUnsynchronized() bool {
+	for index, queued := range queue.messages {
+		if !isCriticalEvent(queued.eventType) {
+			recordDrop(queued, "dropped")
+			queue.messages = append(queue.messages[:index], queue.messages[index+1:]...)
+			outboundQueued.Add(context.Background(), -1)
+			return true
+		}
+	}
+	return false
+}
+
+// close discards all queued events, ends the writer and closes the
+// connection.
+func (queue *outboundQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.closeUnsynchronized()
+}
+
+func (queue *outboundQueue) closeUnsynchronized() {
+	if queue.closed {
+		return
+	}
+
+	queue.closed = true
+	outboundQueued.Add(context.Background(), int64(-len(queue.messages)))
+	queue.messages = nil
+	queue.signal()
+	//Closing the connection ends the read loop, which takes care of
+	//disconnecting the player.
+	if queue.socket != nil {
+		queue.socket.Close()
+	}
+}
+
+func (queue *outboundQueue) signal() {
+	select {
+	case queue.wakeup <- struct{}{}:
+	default:
+		//The writer will see the messages anyway.
+	}
+}
+
+// run writes the queued events until the queue is closed.
+func (queue *outboundQueue) run() {
+	for {
+		message := queue.next()
+		if message == nil {
+			return
+		}
+
+		if err := queue.write(message); err != nil {
+			log.Printf("Error writing to socket of player %s(%s): %s\n", queue.player.Name, queue.player.ID, err)
+			queue.close()
+			return
+		}
+	}
+}
+
+// next waits for the next event, returning nil once the queue is closed.
+func (queue *outboundQueue) next() *outboundMessage {
+	for {
+		queue.mutex.Lock()
+		if queue.closed {
+			queue.mutex.Unlock()
+			return nil
+		}
+		if len(queue.messages) > 0 {
+			message := queue.messages[0]
+			queue.messages[0] = nil
+			queue.messages = queue.messages[1:]
+			queue.mutex.Unlock()
+			outboundQueued.Add(context.Background(), -1)
+			return message
+		}
+		queue.mutex.Unlock()
+
+		<-queue.wakeup
+	}
+}
+
+func (queue *outboundQueue) write(message *outboundMessage) error {
+	data := message.data
+	if message.drawing {
+		drawing, known := queue.currentDrawing()
+		if !known {
+			//The reference replica sends the drawing instead.
+			return nil
+		}
+		var err error
+		data, err = json.Marshal(game.GameEvent{Type: "drawing", Data: drawing})
+		if err != nil {
+			return err
+		}
+	}
+
+	queue.player.GetWebsocketMutex().Lock()
+	defer queue.player.GetWebsocketMutex().Unlock()
+
+	if err := queue.socket.SetWriteDeadline(time.Now().Add(OutboundWriteTimeout)); err != nil {
+		return err
+	}
+	if message.prepared != nil {
+		return queue.socket.WritePreparedMessage(message.prepared)
+	}
+	return queue.socket.WriteMessage(websocket.TextMessage, data)
+}
+
+// requestDrawing asks the reference replica of the lobby to send the current
+// drawing to the player, the same way the client does after reconnecting.
+func requestDrawing(lobbyID, playerID string) {
+	request, _ := json.Marshal(game.GameEvent{Type: "request-drawing"})
+	realData, err := json.Marshal(state.PersistedEvent{
+		LobbyId:  lobbyID,
+		PlayerId: playerID,
+		Data:     request,
+	})
+	if err != nil {
+		log.Printf("requestDrawing: error while marshalling %s", err)
+		return
+	}
+	if err := state.PublishLobbyInput(lobbyID, realData); err != nil {
+		log.Printf("requestDrawing: error while publishing %s", err)
+	}
+}
+
+func recordDrop(message *outboundMessage, reason string) {
+	outboundDropped.Add(context.Background(), 1,
+		label.String("type", message.eventType),
+		label.String("reason", reason))
+}
+
+// eventTypeOf returns the type of the given event, or an empty string if it
+// isn't an event.
+func eventTypeOf(object interface{}) string {
+	switch event := object.(type) {
+	case game.GameEvent:
+		return event.Type
+	case *game.GameEvent:
+		return event.Type
+	case game.LineEvent:
+		return event.Type
+	case *game.LineEvent:
+		return event.Type
+	case game.FillEvent:
+		return event.Type
+	case *game.FillEvent:
+		return event.Type
+	}
+	return ""
+}
+
+// isDrawingEvent tells whether the event changes the drawing, which makes it
+// replaceable by the complete drawing.
+func isDrawingEvent(eventType string) bool {
+	switch eventType {
+	case "line", "fill", "clear-drawing-board", "drawing":
+		return true
+	}
+	return false
+}
+
+// isCriticalEvent tells whether the game state of the player gets out of
+// sync if the event is lost. Losing drawing or chat events is annoying, but
+// the game can go on nonetheless.
+func isCriticalEvent(eventType string) bool {
+	switch eventType {
+	case "line", "fill", "message", "non-guessing-player-message", "system-message", "close-guess":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+	"github.com/guillaumerosinosky/scribble.rs/state"
+)
+
+func Test_SetOutboundPolicy(t *testing.T) {
+	previousPolicy := OutboundPolicy
+	defer func() { OutboundPolicy = previousPolicy }()
+
+	if err := SetOutboundPolicy(OutboundDrop); err != nil || OutboundPolicy != OutboundDrop {
+		t.Errorf("expected the policy to be set, but got %s (%v)", OutboundPolicy, err)
+	}
+	if err := SetOutboundPolicy("block"); err == nil || OutboundPolicy != OutboundDrop {
+		t.Error("expected unknown policies to be rejected")
+	}
+}
+
+func Test_outboundQueuePolicies(t *testing.T) {
+	previousPolicy, previousSize := OutboundPolicy, OutboundQueueSize
+	defer func() { OutboundPolicy, OutboundQueueSize = previousPolicy, previousSize }()
+	OutboundQueueSize = 3
+
+	queuedTypes := func(queue *outboundQueue) []string {
+		types := []string{}
+		for _, message := range queue.messages {
+			types = append(types, message.eventType)
+		}
+		return types
+	}
+	enqueue := func(t *testing.T, queue *outboundQueue, eventTypes ...string) {
+		for _, eventType := range eventTypes {
+			if err := queue.enqueue(&game.GameEvent{Type: eventType}); err != nil {
+				t.Fatalf("expected %s to be queued, but got %s", eventType, err)
+			}
+		}
+	}
+
+	t.Run("coalesce", func(t *testing.T) {
+		OutboundPolicy = OutboundCoalesce
+		queue := newOutboundQueue(&game.Player{}, nil, nil)
+		enqueue(t, queue, "line", "message", "fill", "line")
+
+		expected := []string{"message", "drawing"}
+		if types := queuedTypes(queue); !reflect.DeepEqual(types, expected) {
+			t.Fatalf("expected %v, but got %v", expected, types)
+		}
+		if !queue.messages[1].drawing {
+			t.Error("expected the drawing to be looked up when writing")
+		}
+
+		enqueue(t, queue, "next-turn", "line")
+		expected = []string{"message", "next-turn", "drawing"}
+		if types := queuedTypes(queue); !reflect.DeepEqual(types, expected) {
+			t.Fatalf("expected %v, but got %v", expected, types)
+		}
+
+		//Only a single drawing event can be coalesced, which doesn't make room.
+		if err := queue.enqueue(&game.GameEvent{Type: "update-players"}); err == nil || !queue.closed {
+			t.Error("expected the player to be disconnected")
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		OutboundPolicy = OutboundDrop
+		queue := newOutboundQueue(&game.Player{}, nil, nil)
+		enqueue(t, queue, "update-players", "line", "message", "fill", "next-turn")
+
+		expected := []string{"update-players", "message", "next-turn"}
+		if types := queuedTypes(queue); !reflect.DeepEqual(types, expected) {
+			t.Fatalf("expected %v, but got %v", expected, types)
+		}
+
+		enqueue(t, queue, "update-wordhint")
+		if err := queue.enqueue(&game.GameEvent{Type: "update-players"}); err == nil || !queue.closed {
+			t.Error("expected the player to be disconnected")
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		OutboundPolicy = OutboundDisconnect
+		queue := newOutboundQueue(&game.Player{}, nil, nil)
+		enqueue(t, queue, "line", "line", "line")
+
+		if err := queue.enqueue(&game.GameEvent{Type: "line"}); err == nil || !queue.closed {
+			t.Error("expected the player to be disconnected")
+		}
+		if len(queue.messages) != 0 {
+			t.Error("expected the queued events to be discarded")
+		}
+	})
+}
+
+func Test_outboundQueueWriter(t *testing.T) {
+	serverSocket, clientSocket := createTestSockets(t)
+	player := (&game.Lobby{}).JoinPlayer("Kevin")
+	drawing := []*game.DrawingOperation{game.NewFillOperation(&game.Fill{X: 1, Y: 2})}
+	queue := newOutboundQueue(player, serverSocket, func() (interface{}, bool) {
+		return drawing, true
+	})
+	go queue.run()
+
+	queue.enqueue(game.GameEvent{Type: "message", Data: "hello"})
+	queue.mutex.Lock()
+	queue.messages = append(queue.messages, &outboundMessage{eventType: "drawing", drawing: true})
+	queue.signal()
+	queue.mutex.Unlock()
+
+	received := &game.GameEvent{}
+	if err := clientSocket.ReadJSON(received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Type != "message" || received.Data != "hello" {
+		t.Errorf("expected the message first, but got %+v", received)
+	}
+
+	_, data, err := clientSocket.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := json.Marshal(game.GameEvent{Type: "drawing", Data: drawing})
+	if string(data) != string(expected) {
+		t.Errorf("expected the current drawing %s, but got %s", expected, data)
+	}
+
+	//Closing the queue closes the connection.
+	queue.close()
+	clientSocket.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := clientSocket.ReadMessage(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if err := queue.enqueue(game.GameEvent{Type: "message"}); err == nil {
+		t.Error("expected enqueuing to fail after closing")
+	}
+}
+
+func Test_sendJSONtoSocket(t *testing.T) {
+	serverSocket, clientSocket := createTestSockets(t)
+	lobby := &game.Lobby{}
+	defer lobby.Stop()
+	player := lobby.JoinPlayer("Kevin")
+
+	if err := sendJSONtoSocket(player, game.GameEvent{Type: "message"}); err != nil {
+		t.Errorf("expected players without connection to be skipped, but got %s", err)
+	}
+
+	startOutboundQueue(lobby, player, serverSocket)
+	player.SetWebsocket(serverSocket)
+	player.Connected = true
+	if err := sendJSONtoSocket(player, game.GameEvent{Type: "message", Data: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	received := &game.GameEvent{}
+	if err := clientSocket.ReadJSON(received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Data != "hello" {
+		t.Errorf("expected the message to be written, but got %+v", received)
+	}
+
+	stopOutboundQueue(serverSocket)
+	if err := sendJSONtoSocket(player, game.GameEvent{Type: "message"}); err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected the player to be disconnected, but got %v", err)
+	}
+}
+
+func Test_outboundQueueRequestsDrawing(t *testing.T) {
+	previousPubSub, previousBus, previousReplica := state.PubSub, state.MessageBus, game.ReplicaID
+	defer func() { state.PubSub, state.MessageBus, game.ReplicaID = previousPubSub, previousBus, previousReplica }()
+	state.PubSub = true
+	state.MessageBus = state.NewInProcessBus()
+	game.ReplicaID = "local"
+
+	serverSocket, clientSocket := createTestSockets(t)
+	lobby := &game.Lobby{LobbyID: "forwarded", ReferenceReplicaID: "reference"}
+	defer lobby.Stop()
+	player := lobby.JoinPlayer("Kevin")
+	player.SetWebsocket(serverSocket)
+	player.Connected = true
+	startOutboundQueue(lobby, player, serverSocket)
+	defer stopOutboundQueue(serverSocket)
+
+	requests := make(chan []byte, 10)
+	unsubscribe, err := state.MessageBus.Subscribe(state.LobbyInputChannel("forwarded"), func(data []byte) error {
+		requests <- data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	//This replica only forwards the strokes, so its drawing is outdated.
+	queue := getOutboundQueue(serverSocket)
+	queue.mutex.Lock()
+	queue.messages = append(queue.messages, &outboundMessage{eventType: "drawing", drawing: true})
+	queue.signal()
+	queue.mutex.Unlock()
+
+	select {
+	case data := <-requests:
+		var event state.PersistedEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		var request game.GameEvent
+		if err := json.Unmarshal(event.Data, &request); err != nil || event.PlayerId != player.ID || request.Type != "request-drawing" {
+			t.Errorf("expected the drawing to be requested for the player, but got %s", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the drawing to be requested from the reference replica")
+	}
+	clientSocket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := clientSocket.ReadMessage(); err == nil {
+		t.Errorf("expected the outdated drawing not to be written, but got %s", data)
+	}
+}
+
+// createTestSockets connects a client to a websocket server and returns
+// both ends of the connection.
+func createTestSockets(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	serverSockets := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverSockets <- socket
+	}))
+	t.Cleanup(server.Close)
+
+	clientSocket, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientSocket.Close() })
+
+	serverSocket := <-serverSockets
+	t.Cleanup(func() { serverSocket.Close() })
+	return serverSocket, clientSocket
+}
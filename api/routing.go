@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+	"github.com/guillaumerosinosky/scribble.rs/state"
+)
+
+// Available routing modes, see RouteToOwner.
+const (
+	// RoutingNone serves all requests locally.
+	RoutingNone = "none"
+	// RoutingRedirect redirects requests to the replica owning the lobby.
+	RoutingRedirect = "redirect"
+	// RoutingHeader serves requests locally, but tells the load balancer
+	// which replica owns the lobby via response headers.
+	RoutingHeader = "header"
+)
+
+// Headers set on responses to requests concerning a lobby owned by another
+// replica, unless routing is disabled.
+const (
+	ReplicaHeader        = "X-Scribblers-Replica"
+	ReplicaAddressHeader = "X-Scribblers-Replica-Address"
+)
+
+// routedParameter marks requests that have been redirected already. These
+// are always served locally, so that outdated ownership can't cause
+// redirect loops.
+const routedParameter = "routed"
+
+// RoutingMode defines how requests concerning lobbies owned by other
+// replicas are handled, see SetRoutingMode.
+var RoutingMode = RoutingNone
+
+// SetRoutingMode sets the RoutingMode, as long as the given mode is known.
+func SetRoutingMode(mode string) error {
+	switch mode {
+	case RoutingNone, RoutingRedirect, RoutingHeader:
+		RoutingMode = mode
+		return nil
+	}
+
+	return fmt.Errorf("unknown routing mode '%s'", mode)
+}
+
+// RouteToOwner wraps the handler of an endpoint concerning a single lobby, so
+// that clients end up at the replica owning the lobby, which is the only one
+// that is guaranteed to have an up to date copy of it. Depending on the
+// RoutingMode, the request is either redirected to the owner or served
+// locally, telling the load balancer about the owner via ReplicaHeader and
+// ReplicaAddressHeader. As browsers don't follow redirects for websockets,
+// those are never redirected.
+func RouteToOwner(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lobbyID := r.URL.Query().Get("lobby_id")
+		if RoutingMode == RoutingNone || lobbyID == "" {
+			handler(w, r)
+			return
+		}
+
+		owner := state.LobbyOwner(lobbyID)
+		if owner == nil || owner.ID == game.ReplicaID || owner.Address == "" {
+			handler(w, r)
+			return
+		}
+
+		if RoutingMode == RoutingRedirect && r.URL.Query().Get(routedParameter) == "" && !websocket.IsWebSocketUpgrade(r) {
+			query := r.URL.Query()
+			query.Set(routedParameter, owner.ID)
+			http.Redirect(w, r, owner.Address+r.URL.Path+"?"+query.Encode(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		w.Header().Set(ReplicaHeader, owner.ID)
+		w.Header().Set(ReplicaAddressHeader, owner.Address)
+		handler(w, r)
+	}
+}
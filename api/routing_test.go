@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+	"github.com/guillaumerosinosky/scribble.rs/state"
+)
+
+func Test_RouteToOwner(t *testing.T) {
+	useTestStore(t)
+	previousReplicas, previousMode := state.Replicas, RoutingMode
+	defer func() { state.Replicas, RoutingMode = previousReplicas, previousMode }()
+	state.Replicas = state.NewMemoryReplicaRegistry()
+	game.ReplicaID = "local"
+
+	if _, err := state.Store.AcquireLease("remote-lobby", "remote", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Replicas.SaveReplica(&state.Replica{ID: "remote", Address: "http://remote:8080"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.Store.AcquireLease("local-lobby", "local", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	route := func(target string, header http.Header) *httptest.ResponseRecorder {
+		handler := RouteToOwner(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		RoutingMode = RoutingNone
+		if response := route("/v1/lobby/player?lobby_id=remote-lobby", nil); response.Code != http.StatusNoContent {
+			t.Errorf("expected the request to be served locally, but got %d", response.Code)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		RoutingMode = RoutingRedirect
+		response := route("/v1/lobby/player?lobby_id=remote-lobby", nil)
+		if response.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected a redirect, but got %d", response.Code)
+		}
+		expected := "http://remote:8080/v1/lobby/player?lobby_id=remote-lobby&routed=remote"
+		if location := response.Header().Get("Location"); location != expected {
+			t.Errorf("expected redirect to %s, but got %s", expected, location)
+		}
+
+		//Redirected requests and lobbies owned by this replica are served.
+		if response := route(expected, nil); response.Code != http.StatusNoContent {
+			t.Errorf("expected redirected request to be served, but got %d", response.Code)
+		}
+		if response := route("/v1/lobby/player?lobby_id=local-lobby", nil); response.Code != http.StatusNoContent {
+			t.Errorf("expected local lobby to be served, but got %d", response.Code)
+		}
+		if response := route("/v1/lobby/player?lobby_id=unowned", nil); response.Code != http.StatusNoContent {
+			t.Errorf("expected unowned lobby to be served, but got %d", response.Code)
+		}
+
+		//Websockets can't be redirected.
+		upgrade := http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {"websocket"},
+		}
+		response = route("/v1/ws?lobby_id=remote-lobby", upgrade)
+		if response.Code != http.StatusNoContent || response.Header().Get(ReplicaHeader) != "remote" {
+			t.Errorf("expected websocket to be served with routing header, but got %d", response.Code)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		RoutingMode = RoutingHeader
+		response := route("/ssrEnterLobby?lobby_id=remote-lobby", nil)
+		if response.Code != http.StatusNoContent {
+			t.Errorf("expected the request to be served locally, but got %d", response.Code)
+		}
+		if response.Header().Get(ReplicaHeader) != "remote" ||
+			response.Header().Get(ReplicaAddressHeader) != "http://remote:8080" {
+			t.Errorf("expected routing headers, but got %v", response.Header())
+		}
+	})
+}
+
+func Test_SetRoutingMode(t *testing.T) {
+	previousMode := RoutingMode
+	defer func() { RoutingMode = previousMode }()
+
+	if err := SetRoutingMode(RoutingHeader); err != nil || RoutingMode != RoutingHeader {
+		t.Errorf("expected routing mode to be set, but got %s (%v)", RoutingMode, err)
+	}
+	if err := SetRoutingMode("unknown"); err == nil {
+		t.Error("expected unknown routing mode to be rejected")
+	}
+}
@@ -33,10 +33,26 @@ type LobbyEntry struct {
 	Wordpack        string `json:"wordpack"`
 }
 
+// publicLobbies lists the public lobbies. The lobbies can be filtered by
+// wordpack and by whether they have a free player slot, using the query
+// parameters "wordpack" and "free_slots".
 func publicLobbies(w http.ResponseWriter, r *http.Request) {
-	// force refresh to get from persistence
-	state.LoadLobbies()
-	lobbies := state.GetPublicLobbies()
+	freeSlots, freeSlotsInvalid := ParseBoolean("free slots", r.URL.Query().Get("free_slots"))
+	if freeSlotsInvalid != nil {
+		http.Error(w, freeSlotsInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := state.LobbyFilter{FreeSlots: freeSlots}
+	if wordpack := r.URL.Query().Get("wordpack"); wordpack != "" {
+		language, languageInvalid := ParseLanguage(wordpack)
+		if languageInvalid != nil {
+			http.Error(w, languageInvalid.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Wordpack = language
+	}
+
+	lobbies := state.FindPublicLobbies(filter)
 	lobbyEntries := make([]*LobbyEntry, 0, len(lobbies))
 	for _, lobby := range lobbies {
 		//While one would expect locking the lobby here, it's not very
@@ -125,7 +141,7 @@ func createLobby(w http.ResponseWriter, r *http.Request) {
 		lobby.LobbyID = customLobbyId
 	}
 
-	lobby.WriteJSON = WriteJSON
+	installWriters(lobby)
 	player.SetLastKnownAddress(GetIPAddressFromRequest(r))
 
 	// Use the players generated usersession and pass it as a cookie.
@@ -136,15 +152,18 @@ func createLobby(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteStrictMode,
 	})
 
+	//We only add the lobby if everything else was successful.
+	if addError := state.AddLobby(lobby); addError != nil {
+		http.Error(w, addError.Error(), http.StatusConflict)
+		return
+	}
+
 	lobbyData := CreateLobbyData(lobby)
 
 	encodingError := json.NewEncoder(w).Encode(lobbyData)
 	if encodingError != nil {
 		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
 	}
-
-	//We only add the lobby if everything else was successful.
-	state.AddLobby(lobby)
 }
 
 func enterLobby(w http.ResponseWriter, r *http.Request) {
@@ -156,7 +175,7 @@ func enterLobby(w http.ResponseWriter, r *http.Request) {
 	var lobbyData *LobbyData
 
 	lobby.Synchronized(func() {
-		player := GetPlayer(lobby, r)
+		player := state.ResolvePlayerUnsynchronized(lobby, GetUserSession(r))
 
 		if player == nil {
 			if !lobby.HasFreePlayerSlot() {
@@ -178,6 +197,7 @@ func enterLobby(w http.ResponseWriter, r *http.Request) {
 
 			newPlayer := lobby.JoinPlayer(GetPlayername(r))
 			newPlayer.SetLastKnownAddress(GetIPAddressFromRequest(r))
+			state.RegisterJoinedPlayerUnsynchronized(lobby, newPlayer)
 
 			// Use the players generated usersession and pass it as a cookie.
 			http.SetCookie(w, &http.Cookie{
@@ -330,9 +350,27 @@ func lobbyEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// stats returns the stats of this replica, or of the whole cluster if the
+// aggregate parameter is set.
 func stats(w http.ResponseWriter, r *http.Request) {
+	aggregate, err := ParseBoolean("aggregate", r.URL.Query().Get("aggregate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if aggregate {
+		json.NewEncoder(w).Encode(state.ClusterStats())
+	} else {
+		json.NewEncoder(w).Encode(state.Stats())
+	}
+}
+
+// cluster returns the live replicas of the cluster and their stats.
+func cluster(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(state.Stats())
+	json.NewEncoder(w).Encode(state.ClusterStatus())
 }
 
 // GetLobby extracts the lobby_id field from an HTTP request and searches
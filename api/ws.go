@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strings"
-	"time"
 
 	"github.com/gorilla/websocket"
 	"go.opentelemetry.io/otel/trace"
@@ -18,19 +17,12 @@ import (
 	"github.com/guillaumerosinosky/scribble.rs/state"
 )
 
-var persist = func(lobby *game.Lobby) {
-
-}
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-var channelIn chan []byte
-var channelOut chan []byte
-
 func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 	sessionCookie := GetUserSession(r)
 	if sessionCookie == "" {
@@ -48,8 +40,9 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	lobby.Synchronized(func() {
-		lobby.WriteJSON = WriteJSON
-		player := lobby.GetPlayer(sessionCookie)
+		installWriters(lobby)
+		//The player might have joined through another replica.
+		player := state.ResolvePlayerUnsynchronized(lobby, sessionCookie)
 		if player == nil {
 			http.Error(w, "you don't have access to this lobby;usersession unknown", http.StatusUnauthorized)
 			return
@@ -63,29 +56,38 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("%s(%s) has connected\n", player.Name, player.ID)
 
+		startOutboundQueue(lobby, player, ws)
 		player.SetWebsocket(ws)
 
 		if state.PubSub {
-			// create channels in and out
-			channelIn = make(chan []byte)
-			channelOut = make(chan []byte)
-			if lobby.IsReferenceReplica() {
-				go state.SubscribeRedis(lobby.LobbyID+"-in", channelIn)
-			}
-			go state.SubscribeRedis(lobby.LobbyID+"-out", channelOut)
-			go pubSubIn()
-			go pubSubOut()
+			state.SubscribeLobbyOutput(lobby.LobbyID)
 		}
 
-		// wait a bit for goroutines to initialize properly TODO: find better way
-		time.Sleep(500 * time.Millisecond)
 		lobby.OnPlayerConnectUnsynchronized(context.TODO(), player)
 
 		ws.SetCloseHandler(func(code int, text string) error {
-			lobby.OnPlayerDisconnect(context.TODO(), player)
+			disconnectPlayer(lobby, player)
 			return nil
 		})
-		go wsListen(lobby, player, ws)
+		stopHeartbeat := startHeartbeat(lobby, player, ws)
+		go func() {
+			wsListen(lobby, player, ws)
+			stopHeartbeat()
+			stopOutboundQueue(ws)
+			if state.PubSub {
+				state.UnsubscribeLobbyOutput(lobby.LobbyID)
+			}
+		}()
+	})
+}
+
+// disconnectPlayer marks the player as disconnected, see
+// Lobby.OnPlayerDisconnect, and updates the indexes of the lobby, as its
+// free slots might have changed.
+func disconnectPlayer(lobby *game.Lobby, player *game.Player) {
+	lobby.Synchronized(func() {
+		lobby.OnPlayerDisconnectUnsynchronized(context.TODO(), player)
+		state.IndexLobbyUnsynchronized(lobby)
 	})
 }
 
@@ -96,27 +98,25 @@ func wsListen(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) {
 		err := recover()
 		if err != nil {
 			log.Printf("Error occurred in wsListen.\n\tError: %s\n\tPlayer: %s(%s)\nStack %s\n", err, player.Name, player.ID, string(debug.Stack()))
-			lobby.OnPlayerDisconnect(context.TODO(), player)
+			disconnectPlayer(lobby, player)
 		}
 	}()
 
-	switch state.PersistenceMode {
-	case "NONE":
-		persist = state.NoSaveLobby
-	case "BASIC":
-		persist = state.SaveLobby
-	case "EVENTS":
-		//TODO: implement
-	}
-
 	for {
 		messageType, data, err := socket.ReadMessage()
 		if err != nil {
+			if isTimeout(err) {
+				//Neither pongs nor events have arrived in time, so the
+				//connection is most likely dead without having been closed.
+				log.Printf("Connection of player %s(%s) has timed out.\n", player.Name, player.ID)
+				disconnectPlayer(lobby, player)
+				return
+			}
 			if websocket.IsCloseError(err) || websocket.IsUnexpectedCloseError(err) ||
 				//This happens when the server closes the connection. It will cause 1000 retries followed by a panic.
 				strings.Contains(err.Error(), "use of closed network connection") {
 				//Make sure that the sockethandler is called
-				lobby.OnPlayerDisconnect(context.TODO(), player)
+				disconnectPlayer(lobby, player)
 				//If the error is fatal, we stop listening for more messages.
 				return
 			}
@@ -125,6 +125,7 @@ func wsListen(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) {
 			//If the error doesn't seem fatal we attempt listening for more messages.
 			continue
 		}
+		extendReadDeadline(socket)
 
 		if messageType == websocket.TextMessage {
 			if state.PubSub {
@@ -137,7 +138,9 @@ func wsListen(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) {
 				realData, err := json.Marshal(event)
 				if err == nil {
 					// publish on redis
-					state.PublishRedis(lobby.LobbyID+"-in", realData)
+					if err := state.PublishLobbyInput(lobby.LobbyID, realData); err != nil {
+						log.Printf("wsListen: error while publishing %s", err)
+					}
 
 					//channelIn <- realData
 				} else {
@@ -152,36 +155,62 @@ func wsListen(lobby *game.Lobby, player *game.Player, socket *websocket.Conn) {
 	}
 }
 
-func pubSubIn() {
-	for {
-		//var data []byte
-		var event state.PersistedEvent
-		data := <-channelIn
-		err := json.Unmarshal(data, &event)
-		if err != nil {
-			log.Fatalf("pubSubIn: Error while unmarshal in %s", err)
-		}
-		log.Printf("pubSubIn: received %s", event)
-		// find lobby
-		var player *game.Player
-
-		lobby := state.GetLobby(event.LobbyId)
-		for _, p := range lobby.GetPlayers() {
-			if p.ID == event.PlayerId {
-				player = p
-			}
-		}
-		if player == nil {
-			log.Printf("pubSubIn: player %s not found", event.PlayerId)
+// errNotReferenceReplica signals that an event has been received by a replica
+// that isn't the reference replica of the lobby anymore.
+var errNotReferenceReplica = errors.New("not the reference replica of the lobby")
 
-			player = lobby.JoinPlayer("")
-			player.ID = event.PlayerId
-			// TODO: initialize player from player µs
-			lobby.OnPlayerConnectUnsynchronized(context.TODO(), player)
+// pubSubIn handles the events published to the input channel of a lobby this
+// replica is the reference replica for.
+func pubSubIn(data []byte) error {
+	var event state.PersistedEvent
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		return fmt.Errorf("pubSubIn: error while unmarshal in %w", err)
+	}
+	log.Printf("pubSubIn: received %v", event)
+	lobby := state.GetLobby(event.LobbyId)
+	if lobby == nil {
+		return nil
+	}
+	//If another replica has taken over the lobby, it is in charge of
+	//handling the events now.
+	if !lobby.View().IsReferenceReplica() {
+		return errNotReferenceReplica
+	}
 
+	//Players connected to other replicas might have joined there, in which
+	//case they are only known to the player registry.
+	var player *game.Player
+	lobby.Synchronized(func() {
+		player = lobby.GetPlayerByID(event.PlayerId)
+		if player == nil {
+			player = state.ResolvePlayerByIDUnsynchronized(lobby, event.PlayerId)
+			if player != nil {
+				lobby.OnPlayerConnectUnsynchronized(context.TODO(), player)
+			}
 		}
-		HandleEvent(lobby, player, event.Data)
+	})
+	if player == nil {
+		//The event can't ever be handled, so there's no point in having
+		//it delivered again.
+		log.Printf("pubSubIn: player %s not found", event.PlayerId)
+		return nil
+	}
+
+	if err := HandleEvent(lobby, player, event.Data); err != nil {
+		return err
 	}
+	if isPlayerChange(event.Data) {
+		state.RegisterPlayer(lobby, player)
+	}
+	return nil
+}
+
+// isPlayerChange determines whether the event changes the player in a way
+// that has to be reflected in the player registry.
+func isPlayerChange(data []byte) bool {
+	var received game.GameEvent
+	return json.Unmarshal(data, &received) == nil && received.Type == "name-change"
 }
 
 func HandleEvent(lobby *game.Lobby, player *game.Player, data []byte) error {
@@ -195,7 +224,7 @@ func HandleEvent(lobby *game.Lobby, player *game.Player, data []byte) error {
 		}
 		return sendError
 	}
-	handleError := lobby.HandleEvent(data, received, player, persist)
+	handleError := lobby.HandleEvent(data, received, player, persistFunc(player, data, received))
 	if handleError != nil {
 		log.Printf("Error handling event: %s\n", handleError)
 		return handleError
@@ -203,9 +232,110 @@ func HandleEvent(lobby *game.Lobby, player *game.Player, data []byte) error {
 	return nil
 }
 
+// persistFunc returns the function used by the lobby to persist its state
+// after it has handled the given event of the given player.
+func persistFunc(player *game.Player, data []byte, received *game.GameEvent) func(lobby *game.Lobby) {
+	switch state.PersistenceMode {
+	case "BASIC":
+		//Drawing operations are persisted incrementally by the lobby itself,
+		//there's no need to rewrite the whole lobby for each stroke.
+		if received.Type == "line" || received.Type == "fill" || received.Type == "clear-drawing-board" {
+			return state.NoSaveLobby
+		}
+		return func(lobby *game.Lobby) {
+			//Conflicts are resolved by SaveLobby, the event has been handled
+			//either way.
+			state.SaveLobby(lobby)
+		}
+	case "EVENTS":
+		return func(lobby *game.Lobby) {
+			state.AppendLobbyEvent(lobby, player.ID, data)
+		}
+	default:
+		return state.NoSaveLobby
+	}
+}
+
+// installWriters makes the lobby send its events via WriteJSON and
+// BroadcastJSON.
+func installWriters(lobby *game.Lobby) {
+	lobby.WriteJSON = WriteJSON
+	lobby.BroadcastJSON = BroadcastJSON
+}
+
 // WriteJSON marshals the given input into a JSON string and sends it to the
 // player using the currently established websocket connection.
 func WriteJSON(ctx context.Context, lobby *game.Lobby, player *game.Player, object interface{}) error {
+	object = withTrace(ctx, object)
+
+	if state.PubSub && lobby.IsReferenceReplica() {
+		var event state.PersistedEvent
+		event.LobbyId = lobby.LobbyID
+		event.PlayerId = player.ID
+		event.Data, _ = json.Marshal(object)
+		state.StampLobbyEvent(&event)
+
+		realData, err := json.Marshal(event)
+		if err == nil {
+			if err := state.PublishLobbyOutput(lobby.LobbyID, realData); err != nil {
+				log.Printf("error while publishing writejson %s", err)
+			}
+
+			//channelOut <- realData
+		} else {
+			log.Printf("error while marshalling writejson %s", err)
+		}
+
+		return nil
+	} else {
+		return sendJSONtoSocket(player, object)
+	}
+}
+
+// BroadcastJSON works like WriteJSON, but sends the same object to all of
+// the given players. The object is only marshalled once and, when using
+// pub/sub, published once for all of the players.
+func BroadcastJSON(ctx context.Context, lobby *game.Lobby, players []*game.Player, object interface{}) error {
+	object = withTrace(ctx, object)
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	if state.PubSub && lobby.IsReferenceReplica() {
+		var event state.PersistedEvent
+		event.LobbyId = lobby.LobbyID
+		event.Data = data
+		for _, player := range players {
+			event.Recipients = append(event.Recipients, player.ID)
+		}
+		state.StampLobbyEvent(&event)
+
+		realData, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("error while marshalling broadcast %s", err)
+			return nil
+		}
+		if err := state.PublishLobbyOutput(lobby.LobbyID, realData); err != nil {
+			log.Printf("error while publishing broadcast %s", err)
+		}
+		return nil
+	}
+
+	views := make([]game.PlayerView, 0, len(players))
+	for _, player := range players {
+		views = append(views, game.PlayerView{
+			ID:        player.ID,
+			Connected: player.Connected,
+			Websocket: player.GetWebsocket(),
+		})
+	}
+	return broadcastToSockets(views, eventTypeOf(object), data)
+}
+
+// withTrace adds the trace and span of the context to the event, so that
+// clients can relate their subsequent requests.
+func withTrace(ctx context.Context, object interface{}) interface{} {
 	span := trace.SpanFromContext(ctx)
 	traceId := span.SpanContext().TraceID.String()
 	spanId := span.SpanContext().SpanID.String()
@@ -228,74 +358,135 @@ func WriteJSON(ctx context.Context, lobby *game.Lobby, player *game.Player, obje
 		object = event
 	default:
 	}
+	return object
+}
 
-	if state.PubSub && lobby.IsReferenceReplica() {
-		var event state.PersistedEvent
-		event.LobbyId = lobby.LobbyID
-		event.PlayerId = player.ID
-		event.Data, _ = json.Marshal(object)
+// pubSubOut sends the events published to the output channel of a lobby to
+// the players connected to this replica.
+func pubSubOut(event *state.PersistedEvent) error {
+	var gameEvent game.GameEvent
+	err := json.Unmarshal(event.Data, &gameEvent)
+	if err != nil {
+		return fmt.Errorf("pubsubOut: unable to unmarshal event %w", err)
+	}
 
-		realData, err := json.Marshal(event)
-		if err == nil {
-			state.PublishRedis(lobby.LobbyID+"-out", realData)
+	lobby := state.GetLobby(event.LobbyId)
+	if lobby == nil {
+		return nil
+	}
 
-			//channelOut <- realData
-		} else {
-			log.Printf("error while marshalling writejson %s", err)
+	//This doesn't run on the event loop of the lobby, so the players can
+	//only be accessed via the view.
+	view := lobby.View()
+	if len(event.Recipients) > 0 {
+		//Most of the recipients are usually connected to other replicas.
+		recipients := make(map[string]bool, len(event.Recipients))
+		for _, id := range event.Recipients {
+			recipients[id] = true
+		}
+		var players []game.PlayerView
+		for _, p := range view.Players {
+			if recipients[p.ID] {
+				players = append(players, p)
+			}
 		}
+		return broadcastToSockets(players, gameEvent.Type, event.Data)
+	}
+
+	var player *game.PlayerView
+	for index := range view.Players {
+		if view.Players[index].ID == event.PlayerId {
+			player = &view.Players[index]
+		}
+	}
+	if player == nil {
+		// don't send event: player is probably on another server
+		log.Printf("pubsubOut: player %s not found", event.PlayerId)
 
-		return nil
 	} else {
-		return sendJSONtoSocket(player, object)
+		// send event only if player found
+		//HandleEvent(lobby, player, data)
+		return sendJSON(player.Websocket, player.Connected, gameEvent)
 	}
+	return nil
 }
 
-func pubSubOut() {
-	for {
-		var event state.PersistedEvent
-		data := <-channelOut
+// requestResync asks the reference replica of the lobby to send the complete
+// state to the players connected to this replica again, as events sent to
+// them have been lost.
+func requestResync(lobbyID string) {
+	lobby := state.GetLobby(lobbyID)
+	if lobby == nil {
+		return
+	}
 
-		err := json.Unmarshal(data, &event)
-		if err != nil {
-			log.Fatalf("pubsubOut: unable to unmarshal %s", err)
-		}
-		var gameEvent game.GameEvent
-		err = json.Unmarshal(event.Data, &gameEvent)
-		if err != nil {
-			log.Fatalf("pubsubOut: unable to unmarshal event %s", err)
+	resync, _ := json.Marshal(game.GameEvent{Type: "resync"})
+	for _, player := range lobby.View().Players {
+		if player.Websocket == nil {
+			continue
 		}
 
-		var player *game.Player
-		lobby := state.GetLobby(event.LobbyId)
-		for _, p := range lobby.GetPlayers() {
-			if p.ID == event.PlayerId {
-				player = p
-			}
+		event := state.PersistedEvent{
+			LobbyId:  lobbyID,
+			PlayerId: player.ID,
+			Data:     resync,
 		}
-		if player == nil {
-			// don't send event: player is probably on another server
-			log.Printf("pubsubOut: player %s not found", event.PlayerId)
-
-		} else {
-			// send event only if player found
-			//HandleEvent(lobby, player, data)
-			sendJSONtoSocket(player, gameEvent)
+		realData, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("requestResync: error while marshalling %s", err)
+			continue
+		}
+		if err := state.PublishLobbyInput(lobbyID, realData); err != nil {
+			log.Printf("requestResync: error while publishing %s", err)
 		}
-
 	}
 }
 
+// sendJSONtoSocket queues the given object for the players websocket
+// connection, see outboundQueue. This has to be called on the event loop of
+// the lobby.
 func sendJSONtoSocket(player *game.Player, object interface{}) error {
-	player.GetWebsocketMutex().Lock()
-	defer player.GetWebsocketMutex().Unlock()
+	return sendJSON(player.GetWebsocket(), player.Connected, object)
+}
 
-	socket := player.GetWebsocket()
+// sendJSON queues the given object for the websocket connection of a player
+// that is either connected or not.
+func sendJSON(socket *websocket.Conn, connected bool, object interface{}) error {
 	if socket == nil {
 		return nil
 	}
-	if socket == nil || !player.Connected {
+	queue := getOutboundQueue(socket)
+	if queue == nil || !connected {
 		return errors.New("player not connected")
 	}
 
-	return socket.WriteJSON(object)
+	return queue.enqueue(object)
+}
+
+// broadcastToSockets queues the already marshalled event for the websocket
+// connections of all given players. The websocket frame is only prepared
+// once for all of them.
+func broadcastToSockets(players []game.PlayerView, eventType string, data []byte) error {
+	var prepared *websocket.PreparedMessage
+	for _, player := range players {
+		socket := player.Websocket
+		if socket == nil || !player.Connected {
+			continue
+		}
+		queue := getOutboundQueue(socket)
+		if queue == nil {
+			continue
+		}
+
+		if prepared == nil {
+			var err error
+			prepared, err = websocket.NewPreparedMessage(websocket.TextMessage, data)
+			if err != nil {
+				return err
+			}
+		}
+		//Players that are being disconnected don't need the event anymore.
+		queue.push(&outboundMessage{eventType: eventType, prepared: prepared})
+	}
+	return nil
 }
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+	"github.com/guillaumerosinosky/scribble.rs/state"
+)
+
+// createBroadcastTestLobby creates a lobby of three players, the first two
+// of which are connected via the returned client sockets.
+func createBroadcastTestLobby(t *testing.T) (*game.Lobby, []*websocket.Conn) {
+	player, lobby, err := game.CreateLobby("owner", "english", true, 120, 4, 12, 0, 1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobby.LobbyID = "broadcast"
+	t.Cleanup(lobby.Stop)
+	lobby.JoinPlayer("second")
+	lobby.JoinPlayer("third")
+
+	var clientSockets []*websocket.Conn
+	for _, player := range lobby.GetPlayers()[:2] {
+		serverSocket, clientSocket := createTestSockets(t)
+		startOutboundQueue(lobby, player, serverSocket)
+		t.Cleanup(func() { stopOutboundQueue(serverSocket) })
+		player.SetWebsocket(serverSocket)
+		player.Connected = true
+		clientSockets = append(clientSockets, clientSocket)
+	}
+	if lobby.GetPlayers()[0] != player {
+		t.Fatal("expected the owner to be the first player")
+	}
+	return lobby, clientSockets
+}
+
+func Test_BroadcastJSON(t *testing.T) {
+	lobby, clientSockets := createBroadcastTestLobby(t)
+
+	event := &game.GameEvent{Type: "message", Data: "hello"}
+	if err := BroadcastJSON(context.Background(), lobby, lobby.GetPlayers(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := json.Marshal(event)
+	for _, clientSocket := range clientSockets {
+		clientSocket.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := clientSocket.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(expected) {
+			t.Errorf("expected %s, but got %s", expected, data)
+		}
+	}
+}
+
+// useTestStore makes the state package use a fresh memory store for the
+// duration of the test. The replica ID is restored afterwards as well, so
+// that the test is free to change it.
+func useTestStore(t *testing.T) {
+	previousStore, previousReplica := state.Store, game.ReplicaID
+	t.Cleanup(func() { state.Store, game.ReplicaID = previousStore, previousReplica })
+	state.Store = state.NewMemoryLobbyStore()
+}
+
+func Test_BroadcastJSONPubSub(t *testing.T) {
+	useTestStore(t)
+	previousPubSub, previousBus := state.PubSub, state.MessageBus
+	defer func() { state.PubSub, state.MessageBus = previousPubSub, previousBus }()
+	state.PubSub = true
+	state.MessageBus = state.NewInProcessBus()
+	game.ReplicaID = "local"
+
+	lobby, clientSockets := createBroadcastTestLobby(t)
+	lobby.SetReferenceReplica()
+	if err := state.AddLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	defer state.RemoveLobby(lobby.LobbyID)
+
+	published := make(chan []byte, 10)
+	unsubscribe, err := state.MessageBus.Subscribe(state.LobbyOutputChannel(lobby.LobbyID), func(data []byte) error {
+		published <- data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	//The sender doesn't receive its own stroke.
+	stroke := &game.GameEvent{Type: "line", Data: "stroke"}
+	if err := BroadcastJSON(context.Background(), lobby, lobby.GetPlayers()[1:], stroke); err != nil {
+		t.Fatal(err)
+	}
+
+	var event state.PersistedEvent
+	select {
+	case data := <-published:
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the broadcast to be published")
+	}
+	select {
+	case <-published:
+		t.Error("expected a single publish for all players")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if event.PlayerId != "" || len(event.Recipients) != 2 || event.Sequence == 0 {
+		t.Fatalf("expected a stamped event for two recipients, but got %+v", event)
+	}
+
+	//Only the recipients connected to this replica receive the event.
+	if err := pubSubOut(&event); err != nil {
+		t.Fatal(err)
+	}
+	clientSockets[1].SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := clientSockets[1].ReadMessage(); err != nil || string(data) != string(event.Data) {
+		t.Errorf("expected the stroke to be written, but got %s (%v)", data, err)
+	}
+	clientSockets[0].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := clientSockets[0].ReadMessage(); err == nil {
+		t.Errorf("expected the sender not to receive the stroke, but got %s", data)
+	}
+}
+
+func Test_LoadLobbyInstallsWriters(t *testing.T) {
+	useTestStore(t)
+	previousPubSub, previousBus := state.PubSub, state.MessageBus
+	defer func() { state.PubSub, state.MessageBus = previousPubSub, previousBus }()
+	state.PubSub = true
+	state.MessageBus = state.NewInProcessBus()
+	game.ReplicaID = "local"
+
+	_, stored, err := game.CreateLobby("owner", "english", true, 120, 4, 12, 0, 1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.LobbyID = "loaded"
+	stored.ReferenceReplicaID = "gone"
+	if err := state.Store.SaveLobby(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan []byte, 10)
+	unsubscribe, err := state.MessageBus.Subscribe(state.LobbyOutputChannel("loaded"), func(data []byte) error {
+		published <- data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	//Taking over the loaded lobby has to reach the players connected to
+	//other replicas.
+	lobby := state.LoadLobby("loaded")
+	if lobby == nil {
+		t.Fatal("expected the lobby to be loaded")
+	}
+	defer lobby.Stop()
+	lobby.Synchronized(func() {
+		lobby.TakeOverUnsynchronized(context.Background())
+	})
+
+	select {
+	case data := <-published:
+		var event state.PersistedEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		var gameEvent game.GameEvent
+		if err := json.Unmarshal(event.Data, &gameEvent); err != nil || gameEvent.Type != "system-message" {
+			t.Errorf("expected the takeover to be announced, but got %s", event.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the takeover to be published")
+	}
+}
+
+func Test_LoadLobbiesBeforeSetupRoutes(t *testing.T) {
+	useTestStore(t)
+	previousPubSub, previousBus := state.PubSub, state.MessageBus
+	defer func() { state.PubSub, state.MessageBus = previousPubSub, previousBus }()
+	state.PubSub = true
+	state.MessageBus = state.NewInProcessBus()
+	game.ReplicaID = "restarted"
+
+	//This replica has created the lobby before it has been restarted.
+	_, stored, err := game.CreateLobby("owner", "english", true, 120, 4, 12, 0, 1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.LobbyID = "reclaimed"
+	stored.ReferenceReplicaID = "restarted"
+	if err := state.Store.SaveLobby(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan []byte, 10)
+	unsubscribe, err := state.MessageBus.Subscribe(state.LobbyOutputChannel("reclaimed"), func(data []byte) error {
+		published <- data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	//main loads the lobbies before calling SetupRoutes.
+	state.LoadLobbies()
+	defer state.RemoveLobby("reclaimed")
+
+	input, err := json.Marshal(state.PersistedEvent{
+		LobbyId:  "reclaimed",
+		PlayerId: stored.GetPlayers()[0].ID,
+		Data:     []byte(`{"type":"message","data":"hello"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.MessageBus.Publish(state.LobbyInputChannel("reclaimed"), input); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-published:
+			var event state.PersistedEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			var gameEvent game.GameEvent
+			if err := json.Unmarshal(event.Data, &gameEvent); err == nil && gameEvent.Type == "message" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("expected the input of the reclaimed lobby to be handled")
+		}
+	}
+}
@@ -149,6 +149,7 @@ func ssrCreateLobby(w http.ResponseWriter, r *http.Request) {
 	}
 
 	lobby.WriteJSON = api.WriteJSON
+	lobby.BroadcastJSON = api.BroadcastJSON
 	player.SetLastKnownAddress(api.GetIPAddressFromRequest(r))
 
 	// Use the players generated usersession and pass it as a cookie.
@@ -160,7 +161,15 @@ func ssrCreateLobby(w http.ResponseWriter, r *http.Request) {
 	})
 
 	//We only add the lobby if we could do all necessary pre-steps successfully.
-	state.AddLobby(lobby)
+	if addError := state.AddLobby(lobby); addError != nil {
+		pageData.Errors = append(pageData.Errors, addError.Error())
+		templateError := pageTemplates.ExecuteTemplate(w, "lobby-create-page", pageData)
+		if templateError != nil {
+			userFacingError(w, templateError.Error())
+		}
+
+		return
+	}
 
 	http.Redirect(w, r, currentBasePageConfig.RootPath+"/ssrEnterLobby?lobby_id="+lobby.LobbyID, http.StatusFound)
 }
@@ -26,7 +26,10 @@ type robotPageData struct {
 
 // ssrEnterLobby opens a lobby, either opening it directly or asking for a lobby.
 func ssrEnterLobby(w http.ResponseWriter, r *http.Request) {
-	state.LoadLobbies()
+	//The lobby might have been created by another replica.
+	if lobbyID := r.URL.Query().Get("lobby_id"); lobbyID != "" {
+		state.SynchronizeLobby(lobbyID)
+	}
 	lobby, err := api.GetLobby(r)
 	if err != nil {
 		userFacingError(w, err.Error())
@@ -51,7 +54,8 @@ func ssrEnterLobby(w http.ResponseWriter, r *http.Request) {
 	var pageData *lobbyPageData
 	lobby.Synchronized(func() {
 		lobby.WriteJSON = api.WriteJSON
-		player := api.GetPlayer(lobby, r)
+		lobby.BroadcastJSON = api.BroadcastJSON
+		player := state.ResolvePlayerUnsynchronized(lobby, api.GetUserSession(r))
 
 		if player == nil {
 			if !lobby.HasFreePlayerSlot() {
@@ -71,6 +75,7 @@ func ssrEnterLobby(w http.ResponseWriter, r *http.Request) {
 			}
 
 			newPlayer := lobby.JoinPlayer(api.GetPlayername(r))
+			state.RegisterJoinedPlayerUnsynchronized(lobby, newPlayer)
 
 			// Use the players generated usersession and pass it as a cookie.
 			http.SetCookie(w, &http.Cookie{
@@ -4,6 +4,7 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	discordemojimap "github.com/Bios-Marcel/discordemojimap/v2"
@@ -67,14 +68,20 @@ type Lobby struct {
 	// RoundEndTime represents the time at which the current round will end.
 	// This is a UTC unix-timestamp in milliseconds.
 	RoundEndTime int64
+	// Turn counts the turns that have been started in this Lobby. It is used
+	// to tell apart the drawings of different turns.
+	Turn int
+	// eventTime is the time the event that is currently being handled has
+	// been received at. Scores depend on it, which is why it is restored
+	// when replaying the event, see GetEventTime.
+	eventTime time.Time
 
 	timeLeftTicker        *time.Ticker
 	scoreEarnedByGuessers int
-	// currentDrawing represents the state of the current canvas. The elements
-	// consist of LineEvent and FillEvent. Please do not modify the contents
-	// of this array an only move AppendLine and AppendFill on the respective
-	// lobby object.
-	currentDrawing []interface{}
+	// currentDrawing represents the state of the current canvas. Please do
+	// not modify the contents of this array an only move AppendLine and
+	// AppendFill on the respective lobby object.
+	currentDrawing []*DrawingOperation
 
 	lowercaser cases.Caser
 
@@ -82,12 +89,36 @@ type Lobby struct {
 	//it is empty.
 	LastPlayerDisconnectTime *time.Time
 
-	mutex *sync.Mutex
+	// loopMutex guards the event loop itself, see Synchronized. Everything
+	// else is owned by the event loop.
+	loopMutex sync.Mutex
+	commands  chan func()
+	stopLoop  chan struct{}
+	loopDone  chan struct{}
+	// view holds the latest *LobbyView, see View.
+	view atomic.Value
+	// turnContext is the context the turn timer has been started with.
+	turnContext context.Context
 
 	// Lobby current reference replica UUID
 	ReferenceReplicaID string
+	// Version is the version of the Lobby as last saved or loaded. Saving
+	// only succeeds if the persisted version is still the same, which
+	// prevents replicas from overwriting each others changes.
+	Version int64
 
 	WriteJSON func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error
+	// BroadcastJSON sends the same event to all of the given players, which
+	// allows encoding it only once. If it isn't set, WriteJSON is called for
+	// each of the players instead.
+	BroadcastJSON func(ctx context.Context, lobby *Lobby, players []*Player, object interface{}) error
+
+	// OnDrawingAppended is called after a drawing operation has been added
+	// to the current drawing. This allows persisting the drawing
+	// incrementally instead of rewriting the whole Lobby on each stroke.
+	OnDrawingAppended func(lobby *Lobby, operation *DrawingOperation)
+	// OnDrawingCleared is called after the current drawing has been cleared.
+	OnDrawingCleared func(lobby *Lobby)
 }
 
 // EditableLobbySettings represents all lobby settings that are editable by
@@ -196,6 +227,10 @@ type Player struct {
 	LastScore int         `json:"lastScore"`
 	Rank      int         `json:"rank"`
 	State     PlayerState `json:"state"`
+	// RTT is the round trip time of the players websocket connection in
+	// milliseconds, as measured by the latest ping. It is 0 as long as
+	// nothing has been measured.
+	RTT int64 `json:"rtt"`
 }
 
 // GetLastKnownAddress returns the last known IP-Address used for an HTTP request.
@@ -254,22 +289,47 @@ func (lobby *Lobby) GetPlayer(userSession string) *Player {
 	return nil
 }
 
+// GetPlayerByID searches for a player, identifying them by ID.
+func (lobby *Lobby) GetPlayerByID(id string) *Player {
+	for _, player := range lobby.players {
+		if player.ID == id {
+			return player
+		}
+	}
+
+	return nil
+}
+
+// GetCurrentDrawing returns the operations making up the current drawing.
+// The result mustn't be modified, but may be read after leaving the event
+// loop, as operations are only ever appended or the drawing is replaced.
+func (lobby *Lobby) GetCurrentDrawing() []*DrawingOperation {
+	return lobby.currentDrawing
+}
+
+// ClearDrawing removes all drawing operations from the current drawing.
 func (lobby *Lobby) ClearDrawing() {
-	lobby.currentDrawing = make([]interface{}, 0)
+	lobby.currentDrawing = make([]*DrawingOperation, 0)
+	if lobby.OnDrawingCleared != nil {
+		lobby.OnDrawingCleared(lobby)
+	}
 }
 
-// AppendLine adds a line direction to the current drawing. This exists in order
-// to prevent adding arbitrary elements to the drawing, as the backing array is
-// an empty interface type.
+// AppendLine adds a line direction to the current drawing.
 func (lobby *Lobby) AppendLine(line *LineEvent) {
-	lobby.currentDrawing = append(lobby.currentDrawing, line)
+	lobby.appendDrawingOperation(NewLineOperation(line.Data))
 }
 
-// AppendFill adds a fill direction to the current drawing. This exists in order
-// to prevent adding arbitrary elements to the drawing, as the backing array is
-// an empty interface type.
+// AppendFill adds a fill direction to the current drawing.
 func (lobby *Lobby) AppendFill(fill *FillEvent) {
-	lobby.currentDrawing = append(lobby.currentDrawing, fill)
+	lobby.appendDrawingOperation(NewFillOperation(fill.Data))
+}
+
+func (lobby *Lobby) appendDrawingOperation(operation *DrawingOperation) {
+	lobby.currentDrawing = append(lobby.currentDrawing, operation)
+	if lobby.OnDrawingAppended != nil {
+		lobby.OnDrawingAppended(lobby, operation)
+	}
 }
 
 func createPlayer(name string) *Player {
@@ -328,10 +388,11 @@ func (lobby *Lobby) GetConnectedPlayerCount() int {
 }
 
 func (lobby *Lobby) HasConnectedPlayers() bool {
-	lobby.mutex.Lock()
-	defer lobby.mutex.Unlock()
-
-	return lobby.hasConnectedPlayersInternal()
+	var connected bool
+	lobby.Synchronized(func() {
+		connected = lobby.hasConnectedPlayersInternal()
+	})
+	return connected
 }
 
 func (lobby *Lobby) hasConnectedPlayersInternal() bool {
@@ -348,6 +409,17 @@ func (lobby *Lobby) IsPublic() bool {
 	return lobby.Public
 }
 
+// GetEventTime returns the time the event that is currently being handled has
+// been received at.
+func (lobby *Lobby) GetEventTime() time.Time {
+	return lobby.eventTime
+}
+
+// GetHintsLeft returns the amount of hints that haven't been revealed yet.
+func (lobby *Lobby) GetHintsLeft() int {
+	return lobby.hintsLeft
+}
+
 func (lobby *Lobby) GetPlayers() []*Player {
 	return lobby.players
 }
@@ -361,23 +433,21 @@ func (lobby *Lobby) GetOccupiedPlayerSlots() int {
 	var occupiedPlayerSlots int
 	now := time.Now()
 	for _, player := range lobby.players {
-		if player.Connected {
+		if occupiesSlot(player.Connected, player.disconnectTime, now) {
 			occupiedPlayerSlots++
-		} else {
-			disconnectTime := player.disconnectTime
-
-			//If a player hasn't been disconnected for a certain
-			//timeframe, we will reserve the slot. This avoids frustration
-			//in situations where a player has to restart their PC or so.
-			if disconnectTime == nil || now.Sub(*disconnectTime) < slotReservationTime {
-				occupiedPlayerSlots++
-			}
 		}
 	}
 
 	return occupiedPlayerSlots
 }
 
+func occupiesSlot(connected bool, disconnectTime *time.Time, now time.Time) bool {
+	//If a player hasn't been disconnected for a certain
+	//timeframe, we will reserve the slot. This avoids frustration
+	//in situations where a player has to restart their PC or so.
+	return connected || disconnectTime == nil || now.Sub(*disconnectTime) < slotReservationTime
+}
+
 // HasFreePlayerSlot determines whether the lobby still has a slot for at
 // least one more player. If a player has disconnected recently, the slot
 // will be preserved for 5 minutes. This function should be used over
@@ -390,16 +460,6 @@ func (lobby *Lobby) HasFreePlayerSlot() bool {
 	return lobby.GetOccupiedPlayerSlots() < lobby.MaxPlayers
 }
 
-// Synchronized allows running a function while keeping the lobby locked via
-// it's own mutex. This is useful in order to avoid having to relock a lobby
-// multiple times, which might cause unexpected inconsistencies.
-func (lobby *Lobby) Synchronized(logic func()) {
-	lobby.mutex.Lock()
-	defer lobby.mutex.Unlock()
-
-	logic()
-}
-
 // Is this lobby the current reference replica?
 func (lobby *Lobby) IsReferenceReplica() bool {
 	return lobby.ReferenceReplicaID == ReplicaID
@@ -409,3 +469,14 @@ func (lobby *Lobby) IsReferenceReplica() bool {
 func (lobby *Lobby) SetReferenceReplica() {
 	lobby.ReferenceReplicaID = ReplicaID
 }
+
+// TakeOverUnsynchronized makes the current replica the reference replica of
+// the lobby, for example because the previous one has stopped responding.
+// The turn timer is resumed, see RestartTimeTicker. All players are informed
+// about the change.
+func (lobby *Lobby) TakeOverUnsynchronized(ctx context.Context) {
+	lobby.SetReferenceReplica()
+	lobby.resumeTurnTimer(ctx)
+
+	lobby.TriggerUpdateEvent(ctx, "system-message", "The server hosting this lobby has changed.")
+}
@@ -1,15 +1,12 @@
 package game
 
 import (
-	"sync"
 	"testing"
 	"time"
 )
 
 func TestOccupiedPlayerCount(t *testing.T) {
-	lobby := &Lobby{
-		mutex: &sync.Mutex{},
-	}
+	lobby := &Lobby{}
 	if lobby.GetOccupiedPlayerSlots() != 0 {
 		t.Errorf("Occupied player count expected to be 0, but was %d", lobby.GetOccupiedPlayerSlots())
 	}
@@ -0,0 +1,108 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DrawingOperationVersion is the version of the encoding written by
+// DrawingOperation.MarshalJSON. Operations without a version have been
+// written before the encoding was versioned and are treated as version 1.
+const DrawingOperationVersion = 1
+
+// Available types of drawing operations.
+const (
+	DrawingOperationLine = "line"
+	DrawingOperationFill = "fill"
+)
+
+// DrawingOperation is a single operation of a drawing, either a line or the
+// usage of the fill bucket. Depending on Type, exactly one of Line and Fill
+// is set. It is encoded the same way the line and fill events sent by the
+// players are, so that clients can apply it the same way.
+type DrawingOperation struct {
+	Type string
+	Line *Line
+	Fill *Fill
+}
+
+// NewLineOperation creates a DrawingOperation for the given line.
+func NewLineOperation(line *Line) *DrawingOperation {
+	return &DrawingOperation{Type: DrawingOperationLine, Line: line}
+}
+
+// NewFillOperation creates a DrawingOperation for the given fill.
+func NewFillOperation(fill *Fill) *DrawingOperation {
+	return &DrawingOperation{Type: DrawingOperationFill, Fill: fill}
+}
+
+type encodedDrawingOperation struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// MarshalJSON encodes the operation as an object holding the type and the
+// data of the operation.
+func (operation DrawingOperation) MarshalJSON() ([]byte, error) {
+	var data interface{}
+	switch operation.Type {
+	case DrawingOperationLine:
+		if operation.Line == nil {
+			return nil, errors.New("line operation without line")
+		}
+		data = operation.Line
+	case DrawingOperationFill:
+		if operation.Fill == nil {
+			return nil, errors.New("fill operation without fill")
+		}
+		data = operation.Fill
+	default:
+		return nil, fmt.Errorf("unknown drawing operation '%s'", operation.Type)
+	}
+
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encodedDrawingOperation{
+		Type:    operation.Type,
+		Version: DrawingOperationVersion,
+		Data:    encodedData,
+	})
+}
+
+// UnmarshalJSON decodes operations written by MarshalJSON, as well as the
+// line and fill events persisted before the encoding was versioned.
+func (operation *DrawingOperation) UnmarshalJSON(data []byte) error {
+	var encoded encodedDrawingOperation
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	if encoded.Version > DrawingOperationVersion {
+		return fmt.Errorf("unknown drawing operation version %d", encoded.Version)
+	}
+	if len(encoded.Data) == 0 || string(encoded.Data) == "null" {
+		return fmt.Errorf("drawing operation '%s' without data", encoded.Type)
+	}
+
+	decoded := DrawingOperation{Type: encoded.Type}
+	switch encoded.Type {
+	case DrawingOperationLine:
+		decoded.Line = &Line{}
+		if err := json.Unmarshal(encoded.Data, decoded.Line); err != nil {
+			return err
+		}
+	case DrawingOperationFill:
+		decoded.Fill = &Fill{}
+		if err := json.Unmarshal(encoded.Data, decoded.Fill); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown drawing operation '%s'", encoded.Type)
+	}
+
+	*operation = decoded
+	return nil
+}
@@ -0,0 +1,66 @@
+package game
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_DrawingOperationRoundTrip(t *testing.T) {
+	operations := []*DrawingOperation{
+		NewLineOperation(&Line{FromX: 1, FromY: 2, ToX: 3, ToY: 4, Color: RGBColor{R: 255, G: 127}, LineWidth: 8}),
+		NewFillOperation(&Fill{X: 5, Y: 6, Color: RGBColor{B: 255}}),
+	}
+
+	encoded, err := json.Marshal(operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*DrawingOperation
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 2 {
+		t.Fatalf("expected 2 operations, but got %d", len(decoded))
+	}
+	if decoded[0].Type != DrawingOperationLine || *decoded[0].Line != *operations[0].Line || decoded[0].Fill != nil {
+		t.Errorf("line didn't survive the round trip: %+v", decoded[0])
+	}
+	if decoded[1].Type != DrawingOperationFill || *decoded[1].Fill != *operations[1].Fill || decoded[1].Line != nil {
+		t.Errorf("fill didn't survive the round trip: %+v", decoded[1])
+	}
+}
+
+func Test_DrawingOperationUnversioned(t *testing.T) {
+	//Drawings used to be persisted as the line and fill events themselves.
+	legacy := `[{"type":"line","data":{"fromX":1,"fromY":2,"toX":3,"toY":4,"color":{"r":1,"g":2,"b":3},"lineWidth":5},"traceId":"","spanId":""},{"type":"fill","data":{"x":1,"y":2,"color":{"r":1,"g":2,"b":3}},"traceId":"","spanId":""}]`
+
+	var decoded []*DrawingOperation
+	if err := json.Unmarshal([]byte(legacy), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].Line == nil || decoded[0].Line.LineWidth != 5 || decoded[1].Fill == nil || decoded[1].Fill.Y != 2 {
+		t.Errorf("unexpected operations %+v", decoded)
+	}
+}
+
+func Test_DrawingOperationInvalid(t *testing.T) {
+	for name, encoded := range map[string]string{
+		"unknown type":    `{"type":"circle","data":{}}`,
+		"unknown version": `{"type":"line","version":99,"data":{}}`,
+		"missing data":    `{"type":"line","version":1}`,
+		"invalid data":    `{"type":"fill","data":{"x":"left"}}`,
+	} {
+		encoded := encoded
+		t.Run(name, func(t *testing.T) {
+			var operation DrawingOperation
+			if err := json.Unmarshal([]byte(encoded), &operation); err == nil {
+				t.Errorf("expected an error, but got %+v", operation)
+			}
+		})
+	}
+
+	if _, err := json.Marshal(&DrawingOperation{Type: DrawingOperationLine}); err == nil {
+		t.Error("expected an error encoding a line operation without line")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"math/rand"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -118,9 +117,29 @@ func (lobby *Lobby) HandleEvent(raw []byte, received *GameEvent, player *Player,
 	}
 	defer span.End()
 
-	lobby.mutex.Lock()
-	defer lobby.mutex.Unlock()
+	var err error
+	lobby.Synchronized(func() {
+		lobby.eventTime = time.Now()
+		err = lobby.handleEventUnsynchronized(ctx, raw, received, player, persist)
+	})
+	return err
+}
+
+// ReplayEvent handles an event again that has been handled before, for
+// example when restoring the lobby from its event log. The time the event
+// has originally been received at is restored, so that the outcome, such as
+// the score of a guess, stays the same. Unlike HandleEvent,
+// the event is handled right away instead of on the event loop, so that
+// restoring a lobby doesn't start an event loop nobody ever stops. This
+// mustn't be used anymore once the lobby is shared. The turn timer is left
+// to RestartTimeTicker.
+func (lobby *Lobby) ReplayEvent(raw []byte, received *GameEvent, player *Player, eventTime time.Time) error {
+	defer lobby.stopTurnTimer()
+	lobby.eventTime = eventTime
+	return lobby.handleEventUnsynchronized(context.Background(), raw, received, player, func(*Lobby) {})
+}
 
+func (lobby *Lobby) handleEventUnsynchronized(ctx context.Context, raw []byte, received *GameEvent, player *Player, persist func(lobby *Lobby)) error {
 	if received.Type == "message" {
 		dataAsString, isString := (received.Data).(string)
 		if !isString {
@@ -128,6 +147,7 @@ func (lobby *Lobby) HandleEvent(raw []byte, received *GameEvent, player *Player,
 		}
 
 		handleMessage(ctx, dataAsString, player, lobby)
+		persist(lobby)
 	} else if received.Type == "line" {
 		if lobby.canDraw(player) {
 			line := &LineEvent{}
@@ -244,10 +264,15 @@ func (lobby *Lobby) HandleEvent(raw []byte, received *GameEvent, player *Player,
 		persist(lobby)
 
 		lobby.WriteJSON(ctx, lobby, player, GameEvent{Type: "drawing", Data: lobby.currentDrawing})
+	} else if received.Type == "resync" {
+		//Events sent to the player might have been lost, so we send the
+		//complete state again, just like on connecting.
+		lobby.WriteJSON(ctx, lobby, player, GameEvent{Type: "ready", Data: generateReadyData(lobby, player)})
 	}
 	/* else if received.Type == "keep-alive" {
-		This is a known dummy event in order to avoid accidental websocket
-		connection closure. However, no action is required on the server.
+		This is a known dummy event sent by older clients in order to avoid
+		accidental websocket connection closure. The server pings the
+		clients by itself now, so no action is required.
 	}*/
 
 	return nil
@@ -274,7 +299,7 @@ func handleMessage(ctx context.Context, message string, sender *Player, lobby *L
 		normSearched := simplifyText(currentWord)
 
 		if normSearched == normInput {
-			secondsLeft := int(lobby.RoundEndTime/1000 - time.Now().UTC().UnixNano()/1000000000)
+			secondsLeft := int(lobby.RoundEndTime/1000 - lobby.eventTime.UTC().UnixNano()/1000000000)
 
 			sender.LastScore = calculateGuesserScore(lobby.hintCount, lobby.hintsLeft, secondsLeft, lobby.DrawingTime)
 			sender.Score += sender.LastScore
@@ -339,9 +364,7 @@ func sendMessageToAll(ctx context.Context, message string, sender *Player, lobby
 		AuthorID: sender.ID,
 		Content:  discordemojimap.Replace(message),
 	}}
-	for _, target := range lobby.players {
-		lobby.WriteJSON(ctx, lobby, target, messageEvent)
-	}
+	lobby.broadcast(ctx, lobby.players, messageEvent)
 }
 
 func (lobby *Lobby) sendMessageToAllNonGuessing(ctx context.Context, message string, sender *Player) {
@@ -350,11 +373,13 @@ func (lobby *Lobby) sendMessageToAllNonGuessing(ctx context.Context, message str
 		AuthorID: sender.ID,
 		Content:  discordemojimap.Replace(message),
 	}}
+	targets := make([]*Player, 0, len(lobby.players))
 	for _, target := range lobby.players {
 		if target.State != Guessing {
-			lobby.WriteJSON(ctx, lobby, target, messageEvent)
+			targets = append(targets, target)
 		}
 	}
+	lobby.broadcast(ctx, targets, messageEvent)
 }
 
 func handleKickVoteEvent(ctx context.Context, lobby *Lobby, player *Player, toKickID string) {
@@ -404,9 +429,7 @@ func handleKickVoteEvent(ctx context.Context, lobby *Lobby, player *Player, toKi
 	}
 
 	//We send the kick event to all players, since it was a valid vote.
-	for _, otherPlayer := range lobby.players {
-		lobby.WriteJSON(ctx, lobby, otherPlayer, kickEvent)
-	}
+	lobby.broadcast(ctx, lobby.players, kickEvent)
 
 	//If the valid vote also happens to be the last vote needed, we kick the player.
 	//Since we send the events to all players beforehand, the target player is automatically
@@ -530,10 +553,7 @@ func handleNameChangeEvent(ctx context.Context, caller *Player, lobby *Lobby, na
 
 // advanceLobby will either start the game or jump over to the next turn.
 func advanceLobby(ctx context.Context, lobby *Lobby) {
-	if lobby.timeLeftTicker != nil {
-		lobby.timeLeftTicker.Stop()
-		lobby.timeLeftTicker = nil
-	}
+	lobby.stopTurnTimer()
 
 	//The drawer can potentially be null if he's kicked, in that case we proceed with the round if anyone has already
 	drawer := lobby.drawer
@@ -589,6 +609,7 @@ func advanceLobby(ctx context.Context, lobby *Lobby) {
 	firstTurn := lobby.State != Ongoing
 
 	lobby.ClearDrawing()
+	lobby.Turn++
 	lobby.drawer = newDrawer
 	lobby.drawer.State = Drawing
 	lobby.State = Ongoing
@@ -598,8 +619,7 @@ func advanceLobby(ctx context.Context, lobby *Lobby) {
 
 	//We use milliseconds for higher accuracy
 	lobby.RoundEndTime = time.Now().UTC().UnixNano()/1000000 + int64(lobby.DrawingTime)*1000
-	lobby.timeLeftTicker = time.NewTicker(1 * time.Second)
-	go startTurnTimeTicker(ctx, lobby)
+	lobby.startTurnTimer(ctx)
 
 	nextTurnEvent := &NextTurn{
 		Round:        lobby.Round,
@@ -671,61 +691,72 @@ func selectNextDrawer(lobby *Lobby) (*Player, bool) {
 	return lobby.players[0], true
 }
 
-// startTurnTimeTicker executes a loop that listens to the lobbies
-// timeLeftTicker and executes a tickLogic on each tick. This method
-// blocks until the turn ends.
-func startTurnTimeTicker(ctx context.Context, lobby *Lobby) {
-	for {
-		ticker := lobby.timeLeftTicker
-		if ticker == nil {
-			return
-		}
-		<-ticker.C
+// tickLogic checks whether the lobby needs to proceed to the next round and
+// updates the available word hints if required. It is called by the event
+// loop on each tick of the turn timer. The return value indicates whether
+// additional ticks are necessary or not.
+func (lobby *Lobby) tickLogic(ctx context.Context) bool {
+	currentTime := getTimeAsMillis()
+	if currentTime >= lobby.RoundEndTime {
+		//Advancing either starts a new turn timer or ends the game.
+		advanceLobby(ctx, lobby)
+		return false
+	}
 
-		if !lobby.tickLogic(ctx) {
-			break
+	lobby.revealDueHint(ctx, currentTime)
+	return true
+}
+
+// revealDueHint reveals the next word hint, if it is due at the given time.
+// The return value indicates whether a hint has been revealed.
+func (lobby *Lobby) revealDueHint(ctx context.Context, currentTime int64) bool {
+	if lobby.hintsLeft <= 0 || lobby.wordHints == nil {
+		return false
+	}
+
+	revealHintEveryXMilliseconds := int64(lobby.DrawingTime * 1000 / (lobby.hintCount + 1))
+	//If you have a drawingtime of 120 seconds and three hints, you
+	//want to reveal a hint every 40 seconds, so that the two hints
+	//are visible for at least a third of the time. //If the word
+	//was chosen at 60 seconds, we'll still reveal one hint
+	//instantly, as the time is already lower than 80.
+	revealHintAtXOrLower := revealHintEveryXMilliseconds * int64(lobby.hintsLeft)
+	timeLeft := lobby.RoundEndTime - currentTime
+	if timeLeft > revealHintAtXOrLower {
+		return false
+	}
+
+	lobby.hintsLeft--
+	for {
+		randomIndex := rand.Int() % len(lobby.wordHints)
+		if lobby.wordHints[randomIndex].Character == 0 {
+			lobby.wordHints[randomIndex].Character = []rune(lobby.CurrentWord)[randomIndex]
+			lobby.triggerWordHintUpdate(ctx)
+			return true
 		}
 	}
 }
 
-// tickLogic checks whether the lobby needs to proceed to the next round and
-// updates the available word hints if required. The return value indicates
-// whether additional ticks are necessary or not.
-func (lobby *Lobby) tickLogic(ctx context.Context) bool {
-	lobby.mutex.Lock()
-	defer lobby.mutex.Unlock()
+// resumeTurnTimer restores the turn timer from RoundEndTime, for example
+// after the lobby has been loaded from persistence. Hints that should have
+// been revealed in the meantime are revealed right away and a turn that
+// should have ended already is ended immediately. Only the reference
+// replica runs the timer.
+func (lobby *Lobby) resumeTurnTimer(ctx context.Context) {
+	lobby.stopTurnTimer()
+	if lobby.State != Ongoing || !lobby.IsReferenceReplica() {
+		return
+	}
 
 	currentTime := getTimeAsMillis()
 	if currentTime >= lobby.RoundEndTime {
 		advanceLobby(ctx, lobby)
-		//Kill outer goroutine and therefore avoid executing hint logic.
-		return false
+		return
 	}
-
-	if lobby.hintsLeft > 0 && lobby.wordHints != nil {
-		revealHintEveryXMilliseconds := int64(lobby.DrawingTime * 1000 / (lobby.hintCount + 1))
-		//If you have a drawingtime of 120 seconds and three hints, you
-		//want to reveal a hint every 40 seconds, so that the two hints
-		//are visible for at least a third of the time. //If the word
-		//was chosen at 60 seconds, we'll still reveal one hint
-		//instantly, as the time is already lower than 80.
-		revealHintAtXOrLower := revealHintEveryXMilliseconds * int64(lobby.hintsLeft)
-		timeLeft := lobby.RoundEndTime - currentTime
-		if timeLeft <= revealHintAtXOrLower {
-			lobby.hintsLeft--
-
-			for {
-				randomIndex := rand.Int() % len(lobby.wordHints)
-				if lobby.wordHints[randomIndex].Character == 0 {
-					lobby.wordHints[randomIndex].Character = []rune(lobby.CurrentWord)[randomIndex]
-					lobby.triggerWordHintUpdate(ctx)
-					break
-				}
-			}
-		}
+	for lobby.revealDueHint(ctx, currentTime) {
 	}
 
-	return true
+	lobby.startTurnTimer(ctx)
 }
 
 func getTimeAsMillis() int64 {
@@ -801,17 +832,29 @@ func createWordHintFor(word string, showAll bool) []*WordHint {
 }
 
 func (lobby *Lobby) sendDataToEveryoneExceptSender(ctx context.Context, sender *Player, data interface{}) {
+	otherPlayers := make([]*Player, 0, len(lobby.players))
 	for _, otherPlayer := range lobby.GetPlayers() {
 		if otherPlayer != sender {
-			lobby.WriteJSON(ctx, lobby, otherPlayer, data)
+			otherPlayers = append(otherPlayers, otherPlayer)
 		}
 	}
+	lobby.broadcast(ctx, otherPlayers, data)
 }
 
 func (lobby *Lobby) TriggerUpdateEvent(ctx context.Context, eventType string, data interface{}) {
-	event := &GameEvent{Type: eventType, Data: data}
-	for _, otherPlayer := range lobby.GetPlayers() {
-		lobby.WriteJSON(ctx, lobby, otherPlayer, event)
+	lobby.broadcast(ctx, lobby.GetPlayers(), &GameEvent{Type: eventType, Data: data})
+}
+
+// broadcast sends the same event to all of the given players, see
+// BroadcastJSON.
+func (lobby *Lobby) broadcast(ctx context.Context, players []*Player, object interface{}) {
+	if lobby.BroadcastJSON != nil {
+		lobby.BroadcastJSON(ctx, lobby, players, object)
+		return
+	}
+
+	for _, player := range players {
+		lobby.WriteJSON(ctx, lobby, player, object)
 	}
 }
 
@@ -850,9 +893,8 @@ func CreateLobby(playerName, chosenLanguage string, publicLobby bool, drawingTim
 			Public:            publicLobby,
 		},
 		CustomWords:    customWords,
-		currentDrawing: make([]interface{}, 0),
+		currentDrawing: make([]*DrawingOperation, 0),
 		State:          Unstarted,
-		mutex:          &sync.Mutex{},
 	}
 
 	if len(customWords) > 1 {
@@ -920,15 +962,15 @@ type Ready struct {
 	PlayerName   string `json:"playerName"`
 	AllowDrawing bool   `json:"allowDrawing"`
 
-	VotekickEnabled bool          `json:"votekickEnabled"`
-	GameState       gameState     `json:"gameState"`
-	OwnerID         string        `json:"ownerId"`
-	Round           int           `json:"round"`
-	Rounds          int           `json:"rounds"`
-	RoundEndTime    int           `json:"roundEndTime"`
-	WordHints       []*WordHint   `json:"wordHints"`
-	Players         []*Player     `json:"players"`
-	CurrentDrawing  []interface{} `json:"currentDrawing"`
+	VotekickEnabled bool                `json:"votekickEnabled"`
+	GameState       gameState           `json:"gameState"`
+	OwnerID         string              `json:"ownerId"`
+	Round           int                 `json:"round"`
+	Rounds          int                 `json:"rounds"`
+	RoundEndTime    int                 `json:"roundEndTime"`
+	WordHints       []*WordHint         `json:"wordHints"`
+	Players         []*Player           `json:"players"`
+	CurrentDrawing  []*DrawingOperation `json:"currentDrawing"`
 }
 
 func generateReadyData(lobby *Lobby, player *Player) *Ready {
@@ -975,24 +1017,27 @@ func (lobby *Lobby) OnPlayerConnectUnsynchronized(ctx context.Context, player *P
 	lobby.triggerPlayersUpdate(ctx)
 }
 
+// OnPlayerDisconnect marks the player as disconnected and informs the
+// other players. Calling it more than once per connection has no effect.
 func (lobby *Lobby) OnPlayerDisconnect(ctx context.Context, player *Player) {
+	lobby.Synchronized(func() {
+		lobby.OnPlayerDisconnectUnsynchronized(ctx, player)
+	})
+}
+
+// OnPlayerDisconnectUnsynchronized works like OnPlayerDisconnect, but has to
+// be run by the event loop.
+func (lobby *Lobby) OnPlayerDisconnectUnsynchronized(ctx context.Context, player *Player) {
 	//We want to avoid calling the handler twice.
-	if player.ws == nil {
+	if player.GetWebsocket() == nil {
 		return
 	}
 
 	disconnectTime := time.Now()
-
-	//It is important to properly disconnect the player before aqcuiring the mutex
-	//in order to avoid false assumptions about the players connection state
-	//and avoid attempting to send events.
 	log.Printf("Player %s(%s) disconnected.\n", player.Name, player.ID)
 	player.Connected = false
-	player.ws = nil
-
-	lobby.mutex.Lock()
-	defer lobby.mutex.Unlock()
-
+	player.SetWebsocket(nil)
+	player.RTT = 0
 	player.disconnectTime = &disconnectTime
 	lobby.LastPlayerDisconnectTime = &disconnectTime
 
@@ -1026,6 +1071,21 @@ func (lobby *Lobby) JoinPlayer(playerName string) *Player {
 	return player
 }
 
+// AddPlayerUnsynchronized adds a player that has joined the lobby elsewhere,
+// for example through another replica. If a player with the same ID is
+// already part of the lobby, that player is returned instead.
+func (lobby *Lobby) AddPlayerUnsynchronized(player *Player) *Player {
+	if existing := lobby.GetPlayerByID(player.ID); existing != nil {
+		return existing
+	}
+
+	if player.votedForKick == nil {
+		player.votedForKick = make(map[string]bool)
+	}
+	lobby.players = append(lobby.players, player)
+	return player
+}
+
 func (lobby *Lobby) canDraw(player *Player) bool {
 	return lobby.drawer.ID == player.ID && lobby.CurrentWord != ""
 }
@@ -1039,6 +1099,10 @@ func simplifyText(s string) string {
 		Replace(sanitize.Accents(s))
 }
 
+// RestartTimeTicker resumes the turn timer of a lobby that has been loaded
+// from persistence, see resumeTurnTimer.
 func (lobby *Lobby) RestartTimeTicker(ctx context.Context) {
-	go startTurnTimeTicker(ctx, lobby)
+	lobby.Synchronized(func() {
+		lobby.resumeTurnTimer(ctx)
+	})
 }
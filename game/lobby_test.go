@@ -2,7 +2,6 @@ package game
 
 import (
 	"context"
-	"sync"
 	"testing"
 )
 
@@ -11,7 +10,6 @@ func createLobbyWithDemoPlayers(playercount int) *Lobby {
 	lobby := &Lobby{
 		Owner:   owner,
 		creator: owner,
-		mutex:   &sync.Mutex{},
 	}
 	for i := 0; i < playercount; i++ {
 		lobby.players = append(lobby.players, &Player{
@@ -114,9 +112,7 @@ func Test_simplifyText(t *testing.T) {
 }
 
 func Test_recalculateRanks(t *testing.T) {
-	lobby := &Lobby{
-		mutex: &sync.Mutex{},
-	}
+	lobby := &Lobby{}
 	lobby.players = append(lobby.players, &Player{
 		ID:        "a",
 		Score:     1,
@@ -193,3 +189,113 @@ func Test_handleNameChangeEvent(t *testing.T) {
 		t.Errorf("playername didn't change; Expected %s, but was %s", expectedName, player.Name)
 	}
 }
+
+func createOngoingLobby(roundEndTime int64) *Lobby {
+	lobby := createLobbyWithDemoPlayers(2)
+	lobby.WriteJSON = func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error {
+		//Dummy to pass test.
+		return nil
+	}
+	lobby.EditableLobbySettings = &EditableLobbySettings{Rounds: 3, DrawingTime: 90}
+	lobby.CustomWordsChance = 100
+	lobby.CustomWords = []string{"a", "b", "c", "d", "e", "f"}
+	lobby.State = Ongoing
+	lobby.Round = 1
+	lobby.Turn = 1
+	lobby.drawer = lobby.players[0]
+	lobby.drawer.State = Drawing
+	lobby.CurrentWord = "abcdefghij"
+	lobby.wordHints = createWordHintFor(lobby.CurrentWord, false)
+	lobby.hintCount = 2
+	lobby.hintsLeft = 2
+	lobby.RoundEndTime = roundEndTime
+	lobby.SetReferenceReplica()
+	return lobby
+}
+
+// recordEventTypes makes the lobby record the types of the events it sends
+// instead of sending them.
+func recordEventTypes(lobby *Lobby) map[string]int {
+	sent := make(map[string]int)
+	lobby.WriteJSON = func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error {
+		sent[object.(*GameEvent).Type]++
+		return nil
+	}
+	return sent
+}
+
+func Test_RestartTimeTicker(t *testing.T) {
+	t.Run("turn already ended", func(t *testing.T) {
+		lobby := createOngoingLobby(getTimeAsMillis() - 1000)
+		sent := recordEventTypes(lobby)
+		lobby.RestartTimeTicker(context.Background())
+		defer lobby.Stop()
+
+		if lobby.Turn != 2 {
+			t.Errorf("expected the turn to advance to 2, but was %d", lobby.Turn)
+		}
+		if lobby.drawer != lobby.players[1] {
+			t.Error("expected the next player to draw")
+		}
+		if sent["next-turn"] != len(lobby.players) || sent["your-turn"] != 1 {
+			t.Errorf("expected the players to be told about the next turn, but sent %v", sent)
+		}
+	})
+
+	t.Run("hints due", func(t *testing.T) {
+		//With 90 seconds and two hints, a hint is due every 30 seconds.
+		lobby := createOngoingLobby(getTimeAsMillis() + 10000)
+		sent := recordEventTypes(lobby)
+		lobby.RestartTimeTicker(context.Background())
+		defer lobby.Stop()
+
+		if lobby.Turn != 1 {
+			t.Errorf("expected the turn to continue, but was %d", lobby.Turn)
+		}
+		if lobby.hintsLeft != 0 {
+			t.Errorf("expected all hints to be revealed, but %d were left", lobby.hintsLeft)
+		}
+		if lobby.timeLeftTicker == nil {
+			t.Error("expected the turn timer to run")
+		}
+		if sent["update-wordhint"] != 2*len(lobby.players) {
+			t.Errorf("expected each revealed hint to be sent to the players, but sent %v", sent)
+		}
+	})
+
+	t.Run("not the reference replica", func(t *testing.T) {
+		lobby := createOngoingLobby(getTimeAsMillis() - 1000)
+		lobby.ReferenceReplicaID = "other"
+		lobby.RestartTimeTicker(context.Background())
+
+		if lobby.Turn != 1 || lobby.timeLeftTicker != nil {
+			t.Error("expected the turn timer to be left to the reference replica")
+		}
+	})
+}
+
+func Test_broadcast(t *testing.T) {
+	lobby := createOngoingLobby(getTimeAsMillis() + 60000)
+	var broadcasts [][]*Player
+	lobby.BroadcastJSON = func(ctx context.Context, lobby *Lobby, players []*Player, object interface{}) error {
+		broadcasts = append(broadcasts, players)
+		return nil
+	}
+	lobby.WriteJSON = func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error {
+		t.Errorf("expected %v to be broadcast", object)
+		return nil
+	}
+
+	lobby.sendDataToEveryoneExceptSender(context.Background(), lobby.players[0], &GameEvent{Type: "line"})
+	lobby.triggerPlayersUpdate(context.Background())
+
+	if len(broadcasts) != 2 {
+		t.Fatalf("expected two broadcasts, but got %d", len(broadcasts))
+	}
+	if len(broadcasts[0]) != 1 || broadcasts[0][0] != lobby.players[1] {
+		t.Error("expected the sender to be left out")
+	}
+	if len(broadcasts[1]) != len(lobby.players) {
+		t.Error("expected the update to be sent to all players")
+	}
+}
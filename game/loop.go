@@ -0,0 +1,138 @@
+package game
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// All state of a Lobby is owned by its event loop, a goroutine that runs
+// the commands submitted to the lobby one after another and handles the
+// ticks of the turn timer. Events sent by players, connection changes and
+// any other access from the outside go through Lobby.Synchronized, so that
+// there's never more than one goroutine touching the lobby. Reads that
+// mustn't wait for the event loop use the view it publishes instead, see
+// Lobby.View.
+//
+// The event loop is started on demand and ended via Lobby.Stop. Functions
+// with the suffix "Unsynchronized" and all unexported logic expect to be
+// run by the event loop.
+
+// Synchronized runs the given function on the event loop of the lobby and
+// waits for it to finish. The function mustn't call Synchronized itself, as
+// the event loop only runs one command at a time.
+func (lobby *Lobby) Synchronized(logic func()) {
+	done := make(chan struct{})
+	lobby.submit(func() {
+		defer close(done)
+		logic()
+	})
+	<-done
+}
+
+// submit hands the command to the event loop, starting the loop if it isn't
+// running.
+func (lobby *Lobby) submit(command func()) {
+	for {
+		commands, stop := lobby.eventLoop()
+		select {
+		case commands <- command:
+			return
+		case <-stop:
+			//The loop has been stopped in the meantime, so a new one has to
+			//be started.
+		}
+	}
+}
+
+func (lobby *Lobby) eventLoop() (chan<- func(), <-chan struct{}) {
+	lobby.loopMutex.Lock()
+	defer lobby.loopMutex.Unlock()
+
+	if lobby.commands == nil {
+		commands := make(chan func())
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go lobby.runEventLoop(commands, stop, lobby.loopDone, done)
+		lobby.commands, lobby.stopLoop, lobby.loopDone = commands, stop, done
+	}
+	return lobby.commands, lobby.stopLoop
+}
+
+// Stop ends the event loop of the lobby, including the turn timer. This
+// has to be called once the lobby is dropped. Using the lobby afterwards
+// starts a new event loop, but the turn timer has to be resumed explicitly,
+// see RestartTimeTicker.
+func (lobby *Lobby) Stop() {
+	lobby.loopMutex.Lock()
+	defer lobby.loopMutex.Unlock()
+
+	if lobby.commands != nil {
+		close(lobby.stopLoop)
+		lobby.commands, lobby.stopLoop = nil, nil
+	}
+}
+
+// runEventLoop runs the commands and handles the turn timer until stopped.
+// A loop only starts once the previous loop of the lobby has ended, so
+// that a command that is still running when stopping can't interfere.
+func (lobby *Lobby) runEventLoop(commands <-chan func(), stop <-chan struct{}, previous <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if previous != nil {
+		<-previous
+	}
+
+	for {
+		//The ticker is replaced on each turn, so it has to be looked up
+		//again after each command.
+		var ticks <-chan time.Time
+		if lobby.timeLeftTicker != nil {
+			ticks = lobby.timeLeftTicker.C
+		}
+
+		select {
+		case command := <-commands:
+			lobby.runCommand(command)
+			lobby.publishView()
+		case <-ticks:
+			lobby.runCommand(func() {
+				lobby.tickLogic(lobby.turnContext)
+			})
+			lobby.publishView()
+		case <-stop:
+			lobby.stopTurnTimer()
+			return
+		}
+	}
+}
+
+// runCommand keeps the event loop alive, even if a command panics, as the
+// lobby would be stuck otherwise.
+func (lobby *Lobby) runCommand(command func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Error occurred in event loop of lobby %s.\n\tError: %s\nStack %s\n", lobby.LobbyID, err, string(debug.Stack()))
+		}
+	}()
+
+	command()
+}
+
+// startTurnTimer replaces the turn timer, so that the event loop calls
+// tickLogic every second.
+func (lobby *Lobby) startTurnTimer(ctx context.Context) {
+	if lobby.timeLeftTicker != nil {
+		lobby.timeLeftTicker.Stop()
+	}
+	lobby.timeLeftTicker = time.NewTicker(1 * time.Second)
+	lobby.turnContext = ctx
+}
+
+// stopTurnTimer ends the turn timer, if there is one.
+func (lobby *Lobby) stopTurnTimer() {
+	if lobby.timeLeftTicker != nil {
+		lobby.timeLeftTicker.Stop()
+		lobby.timeLeftTicker = nil
+	}
+}
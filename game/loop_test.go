@@ -0,0 +1,116 @@
+package game
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_Synchronized(t *testing.T) {
+	lobby := &Lobby{}
+	defer lobby.Stop()
+
+	//Without the event loop running one command at a time, the race
+	//detector would complain and increments would get lost.
+	var counter int
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			lobby.Synchronized(func() {
+				counter++
+			})
+		}()
+	}
+	waitGroup.Wait()
+
+	if counter != 100 {
+		t.Errorf("expected 100 increments, but got %d", counter)
+	}
+}
+
+func Test_SynchronizedAfterPanic(t *testing.T) {
+	lobby := &Lobby{}
+	defer lobby.Stop()
+
+	lobby.Synchronized(func() {
+		panic("broken command")
+	})
+
+	ran := false
+	lobby.Synchronized(func() {
+		ran = true
+	})
+	if !ran {
+		t.Error("expected the event loop to survive a panicking command")
+	}
+}
+
+func Test_Stop(t *testing.T) {
+	lobby := createOngoingLobby(getTimeAsMillis() + 60000)
+	lobby.RestartTimeTicker(context.Background())
+
+	lobby.Stop()
+	lobby.Stop()
+
+	var ticker *time.Ticker
+	lobby.Synchronized(func() {
+		ticker = lobby.timeLeftTicker
+	})
+	defer lobby.Stop()
+	if ticker != nil {
+		t.Error("expected stopping to end the turn timer")
+	}
+}
+
+func Test_turnTimer(t *testing.T) {
+	lobby := createOngoingLobby(getTimeAsMillis() + 60000)
+	lobby.RestartTimeTicker(context.Background())
+	defer lobby.Stop()
+
+	//The event loop ends the turn on the next tick.
+	lobby.Synchronized(func() {
+		lobby.RoundEndTime = getTimeAsMillis()
+	})
+	time.Sleep(1500 * time.Millisecond)
+
+	var turn int
+	lobby.Synchronized(func() {
+		turn = lobby.Turn
+	})
+	if turn != 2 {
+		t.Errorf("expected the turn to advance to 2, but was %d", turn)
+	}
+}
+
+func Test_OnPlayerDisconnect(t *testing.T) {
+	lobby := createOngoingLobby(getTimeAsMillis() + 60000)
+	defer lobby.Stop()
+	var updates int
+	lobby.WriteJSON = func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error {
+		if event, isEvent := object.(*GameEvent); isEvent && event.Type == "update-players" {
+			updates++
+		}
+		return nil
+	}
+
+	player := lobby.players[1]
+	player.SetWebsocket(&websocket.Conn{})
+	lobby.OnPlayerDisconnect(context.Background(), player)
+	lobby.OnPlayerDisconnect(context.Background(), player)
+
+	lobby.Synchronized(func() {
+		if player.Connected || player.GetWebsocket() != nil || player.disconnectTime == nil {
+			t.Error("expected the player to be disconnected")
+		}
+	})
+	//A single update is written to both players, the second call mustn't
+	//trigger another one.
+	if updates != 2 {
+		t.Errorf("expected a single players update, but got %d writes", updates)
+	}
+}
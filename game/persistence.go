@@ -28,7 +28,13 @@ type EventEntity struct {
 	Data interface{}
 }
 
+// LobbySchemaVersion is the version of the LobbyEntity layout. It has to be
+// incremented with each change that older documents can't be decoded with,
+// along with adding a migration for the older documents.
+const LobbySchemaVersion = 2
+
 type LobbyEntity struct {
+	SchemaVersion            int
 	LobbyID                  string
 	EditableLobbySettings    *EditableLobbySettings
 	DrawingTimeNew           int
@@ -48,12 +54,12 @@ type LobbyEntity struct {
 	WordChoice               []string
 	Wordpack                 string
 	RoundEndTime             int64
-	TimeLeftTicker           *time.Ticker
+	Turn                     int
 	ScoreEarnedByGuessers    int
-	CurrentDrawing           []interface{}
-	Lowercaser               cases.Caser
+	CurrentDrawing           []*DrawingOperation
 	LastPlayerDisconnectTime *time.Time
 	ReferenceReplicaID       string
+	Version                  int64
 }
 
 func MarshallPlayer(player *Player) *PlayerEntity {
@@ -122,32 +128,32 @@ func UnmarshallPlayers(playersMap []PlayerEntity) []*Player {
 
 func MarshallLobby(lobby *Lobby) LobbyEntity {
 	m := LobbyEntity{
-		LobbyID:               lobby.LobbyID,
-		EditableLobbySettings: lobby.EditableLobbySettings,
-		DrawingTimeNew:        lobby.DrawingTimeNew,
-		CustomWords:           lobby.CustomWords,
-		Words:                 lobby.words,
-		Players:               MarshallPlayers(lobby.players),
-		State:                 lobby.State,
-		Drawer:                MarshallPlayer(lobby.drawer),
-		Owner:                 MarshallPlayer(lobby.Owner),
-		Creator:               MarshallPlayer(lobby.creator),
-		CurrentWord:           lobby.CurrentWord,
-		WordHints:             lobby.wordHints,
-		WordHintsShown:        lobby.wordHintsShown,
-		HintsLeft:             lobby.hintsLeft,
-		HintCount:             lobby.hintCount,
-		Round:                 lobby.Round,
-		WordChoice:            lobby.wordChoice,
-		Wordpack:              lobby.Wordpack,
-		RoundEndTime:          lobby.RoundEndTime,
-
-		//TimeLeftTicker:           lobby.timeLeftTicker, // potential issue
-		ScoreEarnedByGuessers: lobby.scoreEarnedByGuessers,
-		CurrentDrawing:        lobby.currentDrawing,
-		//Lowercaser:               lobby.lowercaser,
+		SchemaVersion:            LobbySchemaVersion,
+		LobbyID:                  lobby.LobbyID,
+		EditableLobbySettings:    lobby.EditableLobbySettings,
+		DrawingTimeNew:           lobby.DrawingTimeNew,
+		CustomWords:              lobby.CustomWords,
+		Words:                    lobby.words,
+		Players:                  MarshallPlayers(lobby.players),
+		State:                    lobby.State,
+		Drawer:                   MarshallPlayer(lobby.drawer),
+		Owner:                    MarshallPlayer(lobby.Owner),
+		Creator:                  MarshallPlayer(lobby.creator),
+		CurrentWord:              lobby.CurrentWord,
+		WordHints:                lobby.wordHints,
+		WordHintsShown:           lobby.wordHintsShown,
+		HintsLeft:                lobby.hintsLeft,
+		HintCount:                lobby.hintCount,
+		Round:                    lobby.Round,
+		WordChoice:               lobby.wordChoice,
+		Wordpack:                 lobby.Wordpack,
+		RoundEndTime:             lobby.RoundEndTime,
+		Turn:                     lobby.Turn,
+		ScoreEarnedByGuessers:    lobby.scoreEarnedByGuessers,
+		CurrentDrawing:           lobby.currentDrawing,
 		LastPlayerDisconnectTime: lobby.LastPlayerDisconnectTime,
 		ReferenceReplicaID:       lobby.ReferenceReplicaID,
+		Version:                  lobby.Version,
 	}
 
 	return m
@@ -155,33 +161,32 @@ func MarshallLobby(lobby *Lobby) LobbyEntity {
 
 func UnmarshallLobby(m LobbyEntity) *Lobby {
 	lobby := Lobby{
-		LobbyID:               m.LobbyID,
-		EditableLobbySettings: m.EditableLobbySettings,
-		DrawingTimeNew:        m.DrawingTimeNew,
-		CustomWords:           m.CustomWords,
-		words:                 m.Words,
-		players:               UnmarshallPlayers(m.Players),
-		drawer:                UnmarshallPlayer(m.Drawer),
-		State:                 m.State,
-		Owner:                 UnmarshallPlayer(m.Owner),
-		creator:               UnmarshallPlayer(m.Creator),
-		CurrentWord:           m.CurrentWord,
-		wordHints:             m.WordHints,
-		wordHintsShown:        m.WordHintsShown,
-		hintsLeft:             m.HintsLeft,
-		hintCount:             m.HintCount,
-		Round:                 m.Round,
-		wordChoice:            m.WordChoice,
-		Wordpack:              m.Wordpack,
-		RoundEndTime:          m.RoundEndTime,
-		//timeLeftTicker:           m.TimeLeftTicker,
+		LobbyID:                  m.LobbyID,
+		EditableLobbySettings:    m.EditableLobbySettings,
+		DrawingTimeNew:           m.DrawingTimeNew,
+		CustomWords:              m.CustomWords,
+		words:                    m.Words,
+		players:                  UnmarshallPlayers(m.Players),
+		drawer:                   UnmarshallPlayer(m.Drawer),
+		State:                    m.State,
+		Owner:                    UnmarshallPlayer(m.Owner),
+		creator:                  UnmarshallPlayer(m.Creator),
+		CurrentWord:              m.CurrentWord,
+		wordHints:                m.WordHints,
+		wordHintsShown:           m.WordHintsShown,
+		hintsLeft:                m.HintsLeft,
+		hintCount:                m.HintCount,
+		Round:                    m.Round,
+		wordChoice:               m.WordChoice,
+		Wordpack:                 m.Wordpack,
+		RoundEndTime:             m.RoundEndTime,
+		Turn:                     m.Turn,
 		scoreEarnedByGuessers:    m.ScoreEarnedByGuessers,
 		currentDrawing:           m.CurrentDrawing,
 		lowercaser:               cases.Lower(language.Make(getLanguageIdentifier(m.Wordpack))),
 		LastPlayerDisconnectTime: m.LastPlayerDisconnectTime,
 		ReferenceReplicaID:       m.ReferenceReplicaID,
-		timeLeftTicker:           time.NewTicker(1 * time.Second),
-		mutex:                    &sync.Mutex{},
+		Version:                  m.Version,
 		WriteJSON: func(ctx context.Context, lobby *Lobby, player *Player, object interface{}) error {
 			//Dummy to pass test.
 			return nil
@@ -190,3 +195,82 @@ func UnmarshallLobby(m LobbyEntity) *Lobby {
 
 	return &lobby
 }
+
+// Refresh replaces the state of the lobby with the state of a newer version
+// of the same lobby, usually one that has been loaded from persistence. The
+// player objects of the lobby are kept and updated, so that their websocket
+// connections stay intact. Players only known to the newer version are added.
+func (lobby *Lobby) Refresh(newer *Lobby) {
+	lobby.Synchronized(func() {
+		lobby.RefreshUnsynchronized(newer)
+	})
+}
+
+// RefreshUnsynchronized works like Refresh, but has to be called on the
+// event loop of the lobby.
+func (lobby *Lobby) RefreshUnsynchronized(newer *Lobby) {
+	existingPlayers := make(map[string]*Player, len(lobby.players))
+	for _, player := range lobby.players {
+		existingPlayers[player.ID] = player
+	}
+
+	players := make([]*Player, 0, len(newer.players))
+	for _, newerPlayer := range newer.players {
+		player, known := existingPlayers[newerPlayer.ID]
+		if !known {
+			players = append(players, newerPlayer)
+			continue
+		}
+
+		player.userSession = newerPlayer.userSession
+		player.disconnectTime = newerPlayer.disconnectTime
+		player.votedForKick = newerPlayer.votedForKick
+		player.Name = newerPlayer.Name
+		player.Score = newerPlayer.Score
+		player.LastScore = newerPlayer.LastScore
+		player.Rank = newerPlayer.Rank
+		player.State = newerPlayer.State
+		//A connection to this instance counts, even if the reference
+		//replica doesn't know about it.
+		player.Connected = newerPlayer.Connected || player.ws != nil
+		players = append(players, player)
+	}
+
+	resolve := func(newerPlayer *Player) *Player {
+		if newerPlayer == nil {
+			return nil
+		}
+		for _, player := range players {
+			if player.ID == newerPlayer.ID {
+				return player
+			}
+		}
+		return newerPlayer
+	}
+
+	lobby.EditableLobbySettings = newer.EditableLobbySettings
+	lobby.DrawingTimeNew = newer.DrawingTimeNew
+	lobby.CustomWords = newer.CustomWords
+	lobby.words = newer.words
+	lobby.players = players
+	lobby.State = newer.State
+	lobby.drawer = resolve(newer.drawer)
+	lobby.Owner = resolve(newer.Owner)
+	lobby.creator = resolve(newer.creator)
+	lobby.CurrentWord = newer.CurrentWord
+	lobby.wordHints = newer.wordHints
+	lobby.wordHintsShown = newer.wordHintsShown
+	lobby.hintsLeft = newer.hintsLeft
+	lobby.hintCount = newer.hintCount
+	lobby.Round = newer.Round
+	lobby.wordChoice = newer.wordChoice
+	lobby.Wordpack = newer.Wordpack
+	lobby.RoundEndTime = newer.RoundEndTime
+	lobby.Turn = newer.Turn
+	lobby.scoreEarnedByGuessers = newer.scoreEarnedByGuessers
+	lobby.currentDrawing = newer.currentDrawing
+	lobby.lowercaser = newer.lowercaser
+	lobby.LastPlayerDisconnectTime = newer.LastPlayerDisconnectTime
+	lobby.ReferenceReplicaID = newer.ReferenceReplicaID
+	lobby.Version = newer.Version
+}
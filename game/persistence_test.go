@@ -3,7 +3,6 @@ package game
 import (
 	"encoding/json"
 	"log"
-	"sync"
 	"testing"
 )
 
@@ -24,7 +23,6 @@ func Test_marshallLobby(t *testing.T) {
 			},
 
 			CustomWords: []string{"d", "e", "f"},
-			mutex:       &sync.Mutex{},
 		}
 		lobby.players = append(lobby.players, &Player{
 			ID:        "a",
@@ -75,7 +73,7 @@ func Test_marshallLobby(t *testing.T) {
 	})
 }
 
-const lobby1 = "{\"LobbyID\":\"\",\"EditableLobbySettings\":{\"maxPlayers\":0,\"public\":false,\"enableVotekick\":false,\"customWordsChance\":0,\"clientsPerIpLimit\":0,\"drawingTime\":0,\"rounds\":0},\"DrawingTimeNew\":0,\"CustomWords\":[\"d\",\"e\",\"f\"],\"Words\":[\"a\",\"b\",\"c\"],\"Players\":[{\"UserSession\":\"\",\"LastKnownAddress\":\"\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"a\",\"Name\":\"\",\"Score\":1,\"Connected\":true,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},{\"UserSession\":\"\",\"LastKnownAddress\":\"\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"b\",\"Name\":\"\",\"Score\":1,\"Connected\":true,\"LastScore\":0,\"Rank\":0,\"State\":\"\"}],\"State\":\"\",\"Owner\":{\"UserSession\":\"test\",\"LastKnownAddress\":\"lastKnown\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"id\",\"Name\":\"\",\"Score\":0,\"Connected\":false,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},\"Creator\":{\"UserSession\":\"test\",\"LastKnownAddress\":\"lastKnown\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"id\",\"Name\":\"\",\"Score\":0,\"Connected\":false,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},\"CurrentWord\":\"\",\"WordHints\":null,\"WordHintsShown\":null,\"HintsLeft\":0,\"HintCount\":0,\"Round\":0,\"WordChoice\":null,\"Wordpack\":\"\",\"RoundEndTime\":0,\"TimeLeftTicker\":null,\"ScoreEarnedByGuessers\":0,\"CurrentDrawing\":[{\"type\":\"line\",\"data\":{\"fromX\":1,\"fromY\":2,\"toX\":3,\"toY\":4,\"color\":{\"r\":255,\"g\":127,\"b\":0},\"lineWidth\":1}},{\"type\":\"line\",\"data\":{\"fromX\":4,\"fromY\":3,\"toX\":2,\"toY\":1,\"color\":{\"r\":255,\"g\":127,\"b\":0},\"lineWidth\":1}}],\"Lowercaser\":{},\"LastPlayerDisconnectTime\":null}"
+const lobby1 = "{\"SchemaVersion\":2,\"LobbyID\":\"\",\"EditableLobbySettings\":{\"maxPlayers\":0,\"public\":false,\"enableVotekick\":false,\"customWordsChance\":0,\"clientsPerIpLimit\":0,\"drawingTime\":0,\"rounds\":0},\"DrawingTimeNew\":0,\"CustomWords\":[\"d\",\"e\",\"f\"],\"Words\":[\"a\",\"b\",\"c\"],\"Players\":[{\"UserSession\":\"\",\"LastKnownAddress\":\"\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"a\",\"Name\":\"\",\"Score\":1,\"Connected\":true,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},{\"UserSession\":\"\",\"LastKnownAddress\":\"\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"b\",\"Name\":\"\",\"Score\":1,\"Connected\":true,\"LastScore\":0,\"Rank\":0,\"State\":\"\"}],\"State\":\"\",\"Drawer\":null,\"Owner\":{\"UserSession\":\"test\",\"LastKnownAddress\":\"lastKnown\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"id\",\"Name\":\"\",\"Score\":0,\"Connected\":false,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},\"Creator\":{\"UserSession\":\"test\",\"LastKnownAddress\":\"lastKnown\",\"DisconnectTime\":null,\"VotedForKick\":null,\"ID\":\"id\",\"Name\":\"\",\"Score\":0,\"Connected\":false,\"LastScore\":0,\"Rank\":0,\"State\":\"\"},\"CurrentWord\":\"\",\"WordHints\":null,\"WordHintsShown\":null,\"HintsLeft\":0,\"HintCount\":0,\"Round\":0,\"WordChoice\":null,\"Wordpack\":\"\",\"RoundEndTime\":0,\"Turn\":0,\"ScoreEarnedByGuessers\":0,\"CurrentDrawing\":[{\"type\":\"line\",\"version\":1,\"data\":{\"fromX\":1,\"fromY\":2,\"toX\":3,\"toY\":4,\"color\":{\"r\":255,\"g\":127,\"b\":0},\"lineWidth\":1}},{\"type\":\"line\",\"version\":1,\"data\":{\"fromX\":4,\"fromY\":3,\"toX\":2,\"toY\":1,\"color\":{\"r\":255,\"g\":127,\"b\":0},\"lineWidth\":1}}],\"LastPlayerDisconnectTime\":null,\"ReferenceReplicaID\":\"\",\"Version\":0}"
 
 func Test_unmarshallLobby(t *testing.T) {
 	t.Run("test unmarshalling a simple lobby", func(t *testing.T) {
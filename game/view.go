@@ -0,0 +1,88 @@
+package game
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// LobbyView is an immutable copy of the parts of a lobby that are read
+// from outside of its event loop, for example in order to route events to
+// the players connected to this replica or to collect stats. The event loop
+// publishes a new view after each command, see Lobby.View.
+type LobbyView struct {
+	ReferenceReplicaID string
+	Version            int64
+	Players            []PlayerView
+}
+
+// PlayerView is the copy of a player within a LobbyView.
+type PlayerView struct {
+	ID        string
+	Connected bool
+	// Websocket is the connection of the player, as long as the player is
+	// connected to this replica.
+	Websocket      *websocket.Conn
+	disconnectTime *time.Time
+}
+
+// View returns the latest view published by the event loop of the lobby.
+// This may be called from anywhere except the event loop itself, where the
+// lobby can be accessed directly. The view might lag behind a command that
+// is running concurrently.
+func (lobby *Lobby) View() *LobbyView {
+	if view, published := lobby.view.Load().(*LobbyView); published {
+		return view
+	}
+
+	//Nothing has run on the event loop yet, so there's no view yet.
+	lobby.Synchronized(func() {})
+	return lobby.view.Load().(*LobbyView)
+}
+
+// publishView replaces the view of the lobby with its current state.
+func (lobby *Lobby) publishView() {
+	view := &LobbyView{
+		ReferenceReplicaID: lobby.ReferenceReplicaID,
+		Version:            lobby.Version,
+		Players:            make([]PlayerView, 0, len(lobby.players)),
+	}
+	for _, player := range lobby.players {
+		view.Players = append(view.Players, PlayerView{
+			ID:             player.ID,
+			Connected:      player.Connected,
+			Websocket:      player.ws,
+			disconnectTime: player.disconnectTime,
+		})
+	}
+	lobby.view.Store(view)
+}
+
+// IsReferenceReplica tells whether this replica has been the reference
+// replica of the lobby as of the view.
+func (view *LobbyView) IsReferenceReplica() bool {
+	return view.ReferenceReplicaID == ReplicaID
+}
+
+// GetConnectedPlayerCount works like Lobby.GetConnectedPlayerCount.
+func (view *LobbyView) GetConnectedPlayerCount() int {
+	var count int
+	for _, player := range view.Players {
+		if player.Connected {
+			count++
+		}
+	}
+	return count
+}
+
+// GetOccupiedPlayerSlots works like Lobby.GetOccupiedPlayerSlots.
+func (view *LobbyView) GetOccupiedPlayerSlots() int {
+	var occupiedPlayerSlots int
+	now := time.Now()
+	for _, player := range view.Players {
+		if occupiesSlot(player.Connected, player.disconnectTime, now) {
+			occupiedPlayerSlots++
+		}
+	}
+	return occupiedPlayerSlots
+}
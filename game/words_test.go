@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 	"testing"
 
 	"golang.org/x/text/cases"
@@ -65,7 +64,6 @@ func Test_getRandomWords(t *testing.T) {
 				CustomWordsChance: 0,
 			},
 			words: []string{"a", "b", "c"},
-			mutex: &sync.Mutex{},
 		}
 
 		randomWords := GetRandomWords(3, lobby)
@@ -85,7 +83,6 @@ func Test_getRandomWords(t *testing.T) {
 			},
 
 			CustomWords: []string{"d", "e", "f"},
-			mutex:       &sync.Mutex{},
 		}
 
 		randomWords := GetRandomWords(3, lobby)
@@ -104,7 +101,6 @@ func Test_getRandomWords(t *testing.T) {
 				CustomWordsChance: 100,
 			},
 			CustomWords: nil,
-			mutex:       &sync.Mutex{},
 		}
 
 		randomWords := GetRandomWords(3, lobby)
@@ -123,7 +119,6 @@ func Test_getRandomWords(t *testing.T) {
 				CustomWordsChance: 100,
 			},
 			CustomWords: []string{"d", "e", "f"},
-			mutex:       &sync.Mutex{},
 		}
 
 		randomWords := GetRandomWords(3, lobby)
@@ -142,7 +137,6 @@ func Test_regressionGetRandomWords_singleCustomWord(t *testing.T) {
 			CustomWordsChance: 99,
 		},
 		CustomWords: []string{"custom"},
-		mutex:       &sync.Mutex{},
 	}
 
 	words := make([]string, 99)
@@ -181,7 +175,6 @@ func Test_getRandomWordsReloading(t *testing.T) {
 				CustomWordsChance: 0,
 			},
 			CustomWords: nil,
-			mutex:       &sync.Mutex{},
 		}
 
 		//Running this 10 times, expecting it to get 3 words each time, even
@@ -201,7 +194,6 @@ func Test_getRandomWordsReloading(t *testing.T) {
 				CustomWordsChance: 100,
 			},
 			CustomWords: nil,
-			mutex:       &sync.Mutex{},
 		}
 
 		//Running this 10 times, expecting it to get 3 words each time, even
@@ -221,7 +213,6 @@ func Test_getRandomWordsReloading(t *testing.T) {
 				CustomWordsChance: 100,
 			},
 			CustomWords: []string{"a"},
-			mutex:       &sync.Mutex{},
 		}
 
 		//Running this 10 times, expecting it to get 3 words each time, even
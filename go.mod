@@ -5,19 +5,19 @@ go 1.16
 require (
 	github.com/Bios-Marcel/discordemojimap/v2 v2.0.1
 	github.com/agnivade/levenshtein v1.1.0
+	github.com/alicebob/miniredis/v2 v2.30.5
 	github.com/dustinkirkland/golang-petname v0.0.0-20191129215211-8e5a1ed0cff0
 	github.com/gofrs/uuid v4.0.0+incompatible
 	github.com/gomodule/redigo v1.8.4
-	github.com/google/uuid v1.2.0 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/kennygrant/sanitize v1.2.4
 	go.opentelemetry.io/otel v0.17.0
 	go.opentelemetry.io/otel/exporters/otlp v0.17.0
-	go.opentelemetry.io/otel/exporters/stdout v0.17.0 
+	go.opentelemetry.io/otel/exporters/stdout v0.17.0
 	go.opentelemetry.io/otel/metric v0.17.0
 	go.opentelemetry.io/otel/sdk v0.17.0
 	go.opentelemetry.io/otel/sdk/metric v0.17.0
-	go.opentelemetry.io/otel/trace v0.17.0 // indirect
+	go.opentelemetry.io/otel/trace v0.17.0
 	golang.org/x/net v0.0.0-20210220033124-5f55cee0dc0d // indirect
 	golang.org/x/text v0.3.5
 	google.golang.org/grpc v1.35.0
@@ -9,9 +9,9 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gofrs/uuid"
 	"github.com/guillaumerosinosky/scribble.rs/api"
 	"github.com/guillaumerosinosky/scribble.rs/frontend"
 	"github.com/guillaumerosinosky/scribble.rs/game"
@@ -38,6 +38,30 @@ func handleErr(err error, message string) {
 	}
 }
 
+// lookupDuration overrides the given setting with the environment variable,
+// if it is set.
+func lookupDuration(name string, setting *time.Duration) {
+	value, set := os.LookupEnv(name)
+	if !set {
+		return
+	}
+	parsed, parseError := time.ParseDuration(value)
+	handleErr(parseError, "failed to parse "+name)
+	*setting = parsed
+}
+
+// lookupInt overrides the given setting with the environment variable, if
+// it is set.
+func lookupInt(name string, setting *int) {
+	value, set := os.LookupEnv(name)
+	if !set {
+		return
+	}
+	parsed, parseError := strconv.Atoi(value)
+	handleErr(parseError, "failed to parse "+name)
+	*setting = parsed
+}
+
 func initProvider(collectorEndpoint string, serviceName string) func() {
 	ctx := context.Background()
 
@@ -91,6 +115,7 @@ func initProvider(collectorEndpoint string, serviceName string) func() {
 func main() {
 	log.Printf("Starting Scribblers")
 	portHTTPFlag := flag.Int("portHTTP", -1, "defines the port to be used for http mode")
+	replicaIDFlag := flag.String("replicaID", "", "defines a stable ID for this replica, allowing it to reclaim its lobbies after restarting")
 	flag.Parse()
 
 	var portHTTP int
@@ -118,20 +143,103 @@ func main() {
 		log.Printf("Listening on default port %d\n", portHTTP)
 	}
 
+	//The replica has to be known before connecting to the message bus.
+	replicaID := *replicaIDFlag
+	if replicaID == "" {
+		replicaID = os.Getenv("REPLICA_ID")
+	}
+	replicaIDFromHostname, _ := os.LookupEnv("REPLICA_ID_FROM_HOSTNAME")
+	resolvedReplicaID, replicaIDError := state.ResolveReplicaID(replicaID, replicaIDFromHostname == "true")
+	handleErr(replicaIDError, "failed to determine replica ID")
+	game.ReplicaID = resolvedReplicaID
+
+	storeKind := state.MemoryStore
 	databaseServer, databaseAvailable := os.LookupEnv("DB_HOST")
 	if databaseAvailable {
 		state.DatabaseHost = databaseServer
-		state.Persistence = true
-		log.Printf("Persistence enabled on %s redis Server\n", state.DatabaseHost)
-
-	} else {
-		state.Persistence = false
+		storeKind = state.RedisStore
+	}
+	//REDIS_URL supersedes DB_HOST, see state.ParseRedisConfig.
+	redisURL, redisURLAvailable := os.LookupEnv("REDIS_URL")
+	if redisURLAvailable {
+		state.RedisURL = redisURL
+		storeKind = state.RedisStore
+	}
+	redisPassword, redisPasswordSet := os.LookupEnv("REDIS_PASSWORD")
+	if redisPasswordSet {
+		state.RedisPassword = redisPassword
 	}
+	lobbyStore, lobbyStoreSet := os.LookupEnv("LOBBY_STORE")
+	if lobbyStoreSet {
+		storeKind = lobbyStore
+	}
+	storePath, storePathSet := os.LookupEnv("LOBBY_STORE_PATH")
+	if storePathSet {
+		state.StorePath = storePath
+	}
+	advertisedAddress, advertisedAddressSet := os.LookupEnv("ADVERTISED_ADDRESS")
+	if advertisedAddressSet {
+		state.AdvertisedAddress = strings.TrimSuffix(advertisedAddress, "/")
+	}
+	routingMode, routingModeSet := os.LookupEnv("ROUTING_MODE")
+	if routingModeSet {
+		handleErr(api.SetRoutingMode(routingMode), "failed to set routing mode")
+	}
+	outboundPolicy, outboundPolicySet := os.LookupEnv("OUTBOUND_POLICY")
+	if outboundPolicySet {
+		handleErr(api.SetOutboundPolicy(outboundPolicy), "failed to set outbound policy")
+	}
+	lookupInt("OUTBOUND_QUEUE_SIZE", &api.OutboundQueueSize)
+	lookupDuration("OUTBOUND_WRITE_TIMEOUT", &api.OutboundWriteTimeout)
+	lookupDuration("HEARTBEAT_INTERVAL", &api.HeartbeatInterval)
+	lookupDuration("HEARTBEAT_TIMEOUT", &api.HeartbeatTimeout)
+	lookupInt("REDIS_MAX_IDLE", &state.RedisMaxIdle)
+	lookupInt("REDIS_MAX_ACTIVE", &state.RedisMaxActive)
+	lookupDuration("REDIS_IDLE_TIMEOUT", &state.RedisIdleTimeout)
+	lookupDuration("REDIS_CONNECT_TIMEOUT", &state.RedisConnectTimeout)
+	lookupDuration("REDIS_READ_TIMEOUT", &state.RedisReadTimeout)
+	lookupDuration("REDIS_WRITE_TIMEOUT", &state.RedisWriteTimeout)
+	lookupInt("REDIS_RETRIES", &state.RedisRetries)
+	lookupDuration("REDIS_RETRY_BACKOFF", &state.RedisRetryBackoff)
+	lookupInt("REDIS_BREAKER_THRESHOLD", &state.RedisBreakerThreshold)
+	lookupDuration("REDIS_BREAKER_COOLDOWN", &state.RedisBreakerCooldown)
+	lookupDuration("DIRTY_FLUSH_INTERVAL", &state.DirtyFlushInterval)
+	store, storeError := state.NewLobbyStore(storeKind)
+	handleErr(storeError, "failed to create lobby store")
+	state.Store = store
+	log.Printf("Using %s lobby store\n", storeKind)
+	replicas, replicasError := state.NewReplicaRegistry(storeKind)
+	handleErr(replicasError, "failed to create replica registry")
+	state.Replicas = replicas
+
+	handleErr(state.StartGeneration(), "failed to start replica generation")
+	log.Printf("Started replica %s in generation %d\n", game.ReplicaID, state.ReplicaGeneration)
 
 	pubSub, pubSubAvailable := os.LookupEnv("PUBSUB")
 	if pubSubAvailable && pubSub == "true" {
 		state.PubSub = true
-		//go state.SubscribeRedis()
+		busKind := state.RedisBus
+		messageBus, messageBusSet := os.LookupEnv("MESSAGE_BUS")
+		if messageBusSet {
+			busKind = messageBus
+		}
+		//Streams deliver each message to a single replica only, whereas the
+		//output channels of the lobbies have to reach all replicas.
+		if busKind == state.RedisStreamBus {
+			log.Fatalf("the %s message bus can only be used as INPUT_BUS", busKind)
+		}
+		bus, busError := state.NewBus(busKind)
+		handleErr(busError, "failed to create message bus")
+		state.MessageBus = bus
+		log.Printf("Using %s message bus\n", busKind)
+
+		inputBusKind, inputBusSet := os.LookupEnv("INPUT_BUS")
+		if inputBusSet && inputBusKind != busKind {
+			inputBus, inputBusError := state.NewBus(inputBusKind)
+			handleErr(inputBusError, "failed to create input bus")
+			state.InputBus = inputBus
+			log.Printf("Using %s input bus\n", inputBusKind)
+		}
 	} else {
 		state.PubSub = false
 	}
@@ -148,6 +256,9 @@ func main() {
 	}
 	state.PersistenceMode = persistenceMode
 
+	lookupDuration("LOBBY_EXPIRY", &state.LobbyExpiry)
+	lookupDuration("LOBBY_SWEEP_INTERVAL", &state.LobbySweepInterval)
+
 	telemetryServer, telemetryServerAvailable := os.LookupEnv("OTEL_HOST")
 
 	if telemetryActivated == "true" {
@@ -181,9 +292,11 @@ func main() {
 	//Setting the seed in order for the petnames to be random.
 	rand.Seed(time.Now().UnixNano())
 
-	game.ReplicaID = uuid.Must(uuid.NewV4()).String()
-
-	log.Println("Started replica {}.", game.ReplicaID)
+	state.LoadLobbies()
+	state.StartLeaseKeeper()
+	state.StartLobbySweeper()
+	state.StartHeartbeat()
+	state.StartDirtyLobbyFlusher()
 
 	api.SetupRoutes()
 	frontend.SetupRoutes()
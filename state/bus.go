@@ -0,0 +1,268 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ErrBusClosed is returned when using a Bus that has already been closed.
+var ErrBusClosed = errors.New("bus has been closed")
+
+// MessageHandler handles a single message received via a Bus. Returning an
+// error signals that the message couldn't be handled. Depending on the Bus,
+// such a message might be delivered again.
+type MessageHandler func(data []byte) error
+
+// Bus transports messages between the replicas. Implementations have to be
+// safe for concurrent use. Messages published to a channel are delivered to
+// every subscriber of that channel, in the order they were published.
+type Bus interface {
+	// Publish sends the data to all subscribers of the channel.
+	Publish(channel string, data []byte) error
+	// Subscribe calls the handler for each message published to the
+	// channel, until the returned unsubscribe function is called. The
+	// handler is never called concurrently.
+	Subscribe(channel string, handler MessageHandler) (unsubscribe func(), err error)
+	// Close stops all subscriptions and releases the underlying resources.
+	Close() error
+}
+
+// channelRemover is implemented by the buses that keep messages per channel,
+// which have to be removed once the channel isn't used anymore.
+type channelRemover interface {
+	// RemoveChannel drops the channel along with all of its messages.
+	RemoveChannel(channel string) error
+}
+
+// Available Bus implementations, see NewBus. Brokers such as NATS or Kafka
+// can be supported by implementing Bus and adding them here.
+const (
+	InProcessBus   = "memory"
+	RedisBus       = "redis"
+	RedisStreamBus = "redis-streams"
+)
+
+// NewBus creates the Bus of the given kind. The redis buses connect to
+// RedisURL or DatabaseHost. The redis streams bus uses the current game.ReplicaID as
+// consumer, so it has to be set beforehand.
+func NewBus(kind string) (Bus, error) {
+	switch kind {
+	case InProcessBus:
+		return NewInProcessBus(), nil
+	case RedisBus, RedisStreamBus:
+		config, err := currentRedisConfig()
+		if err != nil {
+			return nil, err
+		}
+		if kind == RedisBus {
+			return NewRedisBus(config), nil
+		}
+		return NewRedisStreamBus(config, game.ReplicaID), nil
+	}
+
+	return nil, fmt.Errorf("unknown message bus '%s'", kind)
+}
+
+// subscriber receives the messages of a single subscription. The messages
+// are handled in order by a goroutine per subscriber, so that subscribers
+// don't block each other. The queue of a subscriber isn't bounded, as
+// delivering mustn't block the receive loop of a bus, which all of its
+// subscribers depend on, and the messages of the lobby input channels can't
+// be recovered once dropped.
+type subscriber struct {
+	mutex  *sync.Mutex
+	queue  [][]byte
+	queued chan struct{}
+	done   chan struct{}
+	once   *sync.Once
+}
+
+func newSubscriber(channel string, handler MessageHandler) *subscriber {
+	newSubscriber := &subscriber{
+		mutex:  &sync.Mutex{},
+		queued: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+	}
+	go newSubscriber.handle(channel, handler)
+	return newSubscriber
+}
+
+func (subscriber *subscriber) handle(channel string, handler MessageHandler) {
+	for {
+		select {
+		case <-subscriber.queued:
+		case <-subscriber.done:
+			return
+		}
+
+		for data, queued := subscriber.next(); queued; data, queued = subscriber.next() {
+			if err := handler(data); err != nil {
+				log.Printf("Error handling message of channel %s: %s", channel, err)
+			}
+		}
+	}
+}
+
+// next removes the oldest message from the queue. Once the subscriber has
+// stopped or the queue is empty, false is returned.
+func (subscriber *subscriber) next() ([]byte, bool) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.stopped() || len(subscriber.queue) == 0 {
+		return nil, false
+	}
+	data := subscriber.queue[0]
+	subscriber.queue[0] = nil
+	subscriber.queue = subscriber.queue[1:]
+	return data, true
+}
+
+// deliver queues the data for the subscriber without waiting for the
+// subscriber to catch up.
+func (subscriber *subscriber) deliver(data []byte) {
+	subscriber.mutex.Lock()
+	if !subscriber.stopped() {
+		subscriber.queue = append(subscriber.queue, data)
+	}
+	subscriber.mutex.Unlock()
+
+	select {
+	case subscriber.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (subscriber *subscriber) stop() {
+	subscriber.once.Do(func() {
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+
+		close(subscriber.done)
+		subscriber.queue = nil
+	})
+}
+
+func (subscriber *subscriber) stopped() bool {
+	select {
+	case <-subscriber.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribers keeps track of the subscribers of each channel. It is used by
+// the Bus implementations for delivering received messages locally.
+type subscribers struct {
+	mutex    *sync.Mutex
+	channels map[string][]*subscriber
+	closed   bool
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		mutex:    &sync.Mutex{},
+		channels: make(map[string][]*subscriber),
+	}
+}
+
+func (subscribers *subscribers) add(channel string, handler MessageHandler) (func(), error) {
+	subscribers.mutex.Lock()
+	defer subscribers.mutex.Unlock()
+
+	if subscribers.closed {
+		return nil, ErrBusClosed
+	}
+
+	added := newSubscriber(channel, handler)
+	subscribers.channels[channel] = append(subscribers.channels[channel], added)
+	return func() {
+		subscribers.remove(channel, added)
+	}, nil
+}
+
+func (subscribers *subscribers) remove(channel string, removed *subscriber) {
+	subscribers.mutex.Lock()
+	defer subscribers.mutex.Unlock()
+
+	remaining := subscribers.channels[channel][:0]
+	for _, existing := range subscribers.channels[channel] {
+		if existing != removed {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(subscribers.channels, channel)
+	} else {
+		subscribers.channels[channel] = remaining
+	}
+	removed.stop()
+}
+
+// deliver hands the data to all subscribers of the channel. Channels without
+// subscribers are ignored.
+func (subscribers *subscribers) deliver(channel string, data []byte) {
+	subscribers.mutex.Lock()
+	targets := make([]*subscriber, len(subscribers.channels[channel]))
+	copy(targets, subscribers.channels[channel])
+	subscribers.mutex.Unlock()
+
+	for _, target := range targets {
+		target.deliver(data)
+	}
+}
+
+func (subscribers *subscribers) close() {
+	subscribers.mutex.Lock()
+	defer subscribers.mutex.Unlock()
+
+	subscribers.closed = true
+	for channel, channelSubscribers := range subscribers.channels {
+		for _, existing := range channelSubscribers {
+			existing.stop()
+		}
+		delete(subscribers.channels, channel)
+	}
+}
+
+func (subscribers *subscribers) isClosed() bool {
+	subscribers.mutex.Lock()
+	defer subscribers.mutex.Unlock()
+
+	return subscribers.closed
+}
+
+// inProcessBus delivers messages within the current process only. It is
+// meant for single replica deployments and for tests.
+type inProcessBus struct {
+	subscribers *subscribers
+}
+
+// NewInProcessBus creates a Bus that doesn't leave the current process.
+func NewInProcessBus() Bus {
+	return &inProcessBus{subscribers: newSubscribers()}
+}
+
+func (bus *inProcessBus) Publish(channel string, data []byte) error {
+	if bus.subscribers.isClosed() {
+		return ErrBusClosed
+	}
+
+	bus.subscribers.deliver(channel, data)
+	return nil
+}
+
+func (bus *inProcessBus) Subscribe(channel string, handler MessageHandler) (func(), error) {
+	return bus.subscribers.add(channel, handler)
+}
+
+func (bus *inProcessBus) Close() error {
+	bus.subscribers.close()
+	return nil
+}
@@ -0,0 +1,313 @@
+package state
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testBuses creates a fresh instance of each Bus implementation. Unlike
+// the others, the redis streams bus delivers each message to a single
+// subscriber only, so it doesn't broadcast.
+var testBuses = map[string]struct {
+	create    func(t *testing.T) Bus
+	broadcast bool
+}{
+	InProcessBus: {
+		create:    func(t *testing.T) Bus { return NewInProcessBus() },
+		broadcast: true,
+	},
+	RedisBus: {
+		create: func(t *testing.T) Bus {
+			return NewRedisBus(&RedisConfig{Address: createTestStreamServer(t).Addr()})
+		},
+		broadcast: true,
+	},
+	RedisStreamBus: {
+		create: func(t *testing.T) Bus {
+			return NewRedisStreamBus(&RedisConfig{Address: createTestStreamServer(t).Addr()}, "consumer")
+		},
+	},
+}
+
+func subscribeTestChannel(t *testing.T, bus Bus, channel string) (chan string, func()) {
+	received := make(chan string, 64)
+	unsubscribe, err := bus.Subscribe(channel, func(data []byte) error {
+		received <- string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received, unsubscribe
+}
+
+// awaitSubscription publishes until the subscriber receives something, as
+// subscriptions to a remote bus are established asynchronously.
+func awaitSubscription(t *testing.T, bus Bus, channel string, received chan string) {
+	deadline := time.After(2 * time.Second)
+	for {
+		if err := bus.Publish(channel, []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-received:
+			//Drain duplicates caused by publishing repeatedly.
+			time.Sleep(50 * time.Millisecond)
+			for len(received) > 0 {
+				<-received
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("subscription not established")
+		}
+	}
+}
+
+// busConformanceCases describe the behavior all Bus implementations have
+// in common. Each case is run against a fresh bus, which it has to close.
+var busConformanceCases = []struct {
+	name      string
+	broadcast bool
+	test      func(t *testing.T, bus Bus)
+}{
+	{name: "ordering", test: testBusOrdering},
+	{name: "channels", test: testBusChannels},
+	{name: "broadcast", broadcast: true, test: testBusBroadcast},
+	{name: "unsubscribe while delivering", test: testBusUnsubscribeWhileDelivering},
+	{name: "slow subscriber", test: testBusSlowSubscriber},
+	{name: "close", test: testBusClose},
+}
+
+func Test_BusConformance(t *testing.T) {
+	for name, implementation := range testBuses {
+		implementation := implementation
+		for _, testCase := range busConformanceCases {
+			if testCase.broadcast && !implementation.broadcast {
+				continue
+			}
+			testCase := testCase
+			t.Run(name+"/"+testCase.name, func(t *testing.T) {
+				bus := implementation.create(t)
+				defer bus.Close()
+				testCase.test(t, bus)
+			})
+		}
+	}
+}
+
+func testBusOrdering(t *testing.T, bus Bus) {
+	received, unsubscribe := subscribeTestChannel(t, bus, "channel")
+	defer unsubscribe()
+	awaitSubscription(t, bus, "channel", received)
+
+	for index := 0; index < 100; index++ {
+		if err := bus.Publish("channel", []byte(strconv.Itoa(index))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := 0; index < 100; index++ {
+		expectMessage(t, received, strconv.Itoa(index))
+	}
+}
+
+func testBusChannels(t *testing.T, bus Bus) {
+	received, unsubscribe := subscribeTestChannel(t, bus, "channel")
+	defer unsubscribe()
+	other, unsubscribeOther := subscribeTestChannel(t, bus, "other")
+	defer unsubscribeOther()
+	awaitSubscription(t, bus, "channel", received)
+	awaitSubscription(t, bus, "other", other)
+
+	if err := bus.Publish("channel", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, received, "a")
+	select {
+	case data := <-other:
+		t.Errorf("received '%s' on another channel", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testBusBroadcast(t *testing.T, bus Bus) {
+	first, unsubscribeFirst := subscribeTestChannel(t, bus, "channel")
+	second, unsubscribeSecond := subscribeTestChannel(t, bus, "channel")
+	defer unsubscribeSecond()
+	awaitSubscription(t, bus, "channel", first)
+	for len(second) > 0 {
+		<-second
+	}
+
+	for _, message := range []string{"a", "b", "c"} {
+		if err := bus.Publish("channel", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, received := range []chan string{first, second} {
+		for _, expected := range []string{"a", "b", "c"} {
+			expectMessage(t, received, expected)
+		}
+	}
+
+	unsubscribeFirst()
+	if err := bus.Publish("channel", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, second, "d")
+	select {
+	case data := <-first:
+		t.Errorf("received '%s' after unsubscribing", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testBusUnsubscribeWhileDelivering(t *testing.T, bus Bus) {
+	handling := make(chan string, 64)
+	release := make(chan struct{})
+	unsubscribe, err := bus.Subscribe("channel", func(data []byte) error {
+		handling <- string(data)
+		if string(data) == "a" {
+			<-release
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSubscription(t, bus, "channel", handling)
+
+	//The handler is busy with the first message, while the others queue up.
+	for _, message := range []string{"a", "b", "c"} {
+		if err := bus.Publish("channel", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessage(t, handling, "a")
+	unsubscribed := make(chan struct{})
+	go func() {
+		unsubscribe()
+		close(unsubscribed)
+	}()
+	//Unsubscribing might wait for the message being handled.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	select {
+	case <-unsubscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unsubscribing doesn't end")
+	}
+
+	if err := bus.Publish("channel", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-handling:
+		t.Errorf("handled '%s' after unsubscribing", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testBusSlowSubscriber(t *testing.T, bus Bus) {
+	other, unsubscribeOther := subscribeTestChannel(t, bus, "other")
+	defer unsubscribeOther()
+	awaitSubscription(t, bus, "other", other)
+
+	//A subscriber that is stuck mustn't hold up the others, nor lose any
+	//messages.
+	blocked := make(chan struct{})
+	received := make(chan string, 1000)
+	unsubscribe, err := bus.Subscribe("slow", func(data []byte) error {
+		<-blocked
+		received <- string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	for index := 0; index < 500; index++ {
+		if err := bus.Publish("slow", []byte(strconv.Itoa(index))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bus.Publish("other", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, other, "a")
+
+	close(blocked)
+	for index := 0; index < 500; index++ {
+		expectMessage(t, received, strconv.Itoa(index))
+	}
+}
+
+func testBusClose(t *testing.T, bus Bus) {
+	received, _ := subscribeTestChannel(t, bus, "channel")
+	awaitSubscription(t, bus, "channel", received)
+
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish("channel", []byte("a")); err != ErrBusClosed {
+		t.Errorf("expected ErrBusClosed when publishing, but got %v", err)
+	}
+	if _, err := bus.Subscribe("channel", func(data []byte) error { return nil }); err != ErrBusClosed {
+		t.Errorf("expected ErrBusClosed when subscribing, but got %v", err)
+	}
+	select {
+	case data := <-received:
+		t.Errorf("received '%s' after closing", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_LobbyOutputInterest(t *testing.T) {
+	MessageBus = NewInProcessBus()
+	defer func() {
+		MessageBus.Close()
+		MessageBus = nil
+	}()
+
+	received := make(chan *PersistedEvent, 16)
+	LobbyOutputHandler = func(event *PersistedEvent) error {
+		received <- event
+		return nil
+	}
+	defer func() {
+		LobbyOutputHandler = func(event *PersistedEvent) error { return nil }
+	}()
+
+	publish := func(sequence int64) {
+		data, _ := json.Marshal(&PersistedEvent{LobbyId: "lobby", ReplicaId: "replica", Sequence: sequence})
+		MessageBus.Publish(LobbyOutputChannel("lobby"), data)
+	}
+
+	//Two local players are connected, but each message is only handled once.
+	SubscribeLobbyOutput("lobby")
+	SubscribeLobbyOutput("lobby")
+	publish(1)
+	time.Sleep(50 * time.Millisecond)
+	if len(received) != 1 {
+		t.Errorf("expected message to be handled once, was handled %d times", len(received))
+	}
+	<-received
+
+	UnsubscribeLobbyOutput("lobby")
+	publish(2)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not handled while a player is still connected")
+	}
+
+	UnsubscribeLobbyOutput("lobby")
+	publish(3)
+	time.Sleep(50 * time.Millisecond)
+	if len(received) != 0 {
+		t.Errorf("message handled after the last player left")
+	}
+}
@@ -0,0 +1,289 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// RedisMaxIdle is the maximum number of idle connections kept per redis
+	// server.
+	RedisMaxIdle = 50
+	// RedisMaxActive is the maximum number of connections per redis server.
+	// 0 means that there is no limit.
+	RedisMaxActive = 10000
+	// RedisIdleTimeout defines after which time idle connections are closed.
+	RedisIdleTimeout = 4 * time.Minute
+	// RedisConnectTimeout limits how long connecting to redis may take.
+	RedisConnectTimeout = 5 * time.Second
+	// RedisReadTimeout limits how long to wait for a reply. Blocking
+	// commands wait for this long in addition to their blocking time.
+	RedisReadTimeout = 10 * time.Second
+	// RedisWriteTimeout limits how long sending a command may take.
+	RedisWriteTimeout = 10 * time.Second
+	// RedisRetries defines how often opening a dedicated connection, such as
+	// a subscription, is retried before giving up. Pooled connections aren't
+	// retried, as they are mostly used from the event loops of the lobbies,
+	// which mustn't be held up. Failed writes leave the lobby dirty instead,
+	// which is retried by the flusher. Commands themselves aren't retried
+	// either, as they might have been executed even though their reply got
+	// lost.
+	RedisRetries = 3
+	// RedisRetryBackoff is the delay before the first retry, which doubles
+	// with each further retry.
+	RedisRetryBackoff = 100 * time.Millisecond
+	// RedisBreakerThreshold is the number of consecutive failures after
+	// which redis is considered to be unavailable.
+	RedisBreakerThreshold = 5
+	// RedisBreakerCooldown defines how long requests fail fast once redis is
+	// considered to be unavailable, before trying to reach it again.
+	RedisBreakerCooldown = 10 * time.Second
+)
+
+// ErrRedisUnavailable is returned instead of contacting redis, while it is
+// considered to be unavailable due to previous failures.
+var ErrRedisUnavailable = errors.New("redis is unavailable")
+
+var (
+	redisClientsMutex = &sync.Mutex{}
+	// redisClients are the clients shared by everything using the same
+	// RedisConfig, see acquireRedisClient.
+	redisClients = make(map[string]*redisClient)
+)
+
+// redisClient is a connection pool for a single redis server, guarded by a
+// circuit breaker. Once too many requests have failed in a row, requests
+// fail fast with ErrRedisUnavailable, instead of each of them waiting for
+// redis to time out.
+type redisClient struct {
+	key     string
+	pool    *redis.Pool
+	breaker *circuitBreaker
+
+	// references is guarded by redisClientsMutex.
+	references int
+}
+
+// acquireRedisClient returns the client for the given configuration,
+// creating it if necessary. Each call has to be paired with a call to
+// release, once the client isn't needed anymore.
+func acquireRedisClient(config *RedisConfig) *redisClient {
+	redisClientsMutex.Lock()
+	defer redisClientsMutex.Unlock()
+
+	client, available := redisClients[config.key()]
+	if !available {
+		client = newRedisClient(config)
+		redisClients[client.key] = client
+	}
+	client.references++
+	return client
+}
+
+// release gives up a reference to the client. The connections are closed
+// once the last reference has been released.
+func (client *redisClient) release() error {
+	redisClientsMutex.Lock()
+	defer redisClientsMutex.Unlock()
+
+	client.references--
+	if client.references > 0 {
+		return nil
+	}
+	if redisClients[client.key] == client {
+		delete(redisClients, client.key)
+	}
+	return client.pool.Close()
+}
+
+func newRedisClient(config *RedisConfig) *redisClient {
+	//The breaker names the server in its logs.
+	name := config.Address
+	if config.SentinelMaster != "" {
+		name = config.SentinelMaster
+	}
+	return &redisClient{
+		key: config.key(),
+		pool: &redis.Pool{
+			MaxIdle:     RedisMaxIdle,
+			MaxActive:   RedisMaxActive,
+			IdleTimeout: RedisIdleTimeout,
+			Dial:        config.dial,
+			//Connections that have been idle for a while might have been
+			//dropped by redis or anything in between.
+			TestOnBorrow: func(conn redis.Conn, idleSince time.Time) error {
+				if time.Since(idleSince) < time.Minute {
+					return nil
+				}
+				_, err := conn.Do("PING")
+				return err
+			},
+		},
+		breaker: &circuitBreaker{name: name, mutex: &sync.Mutex{}},
+	}
+}
+
+// Get returns a pooled connection, which has to be closed after use. Just
+// like with redis.Pool, errors while connecting are returned by the first
+// command sent via the connection. Connecting isn't retried, see
+// RedisRetries.
+func (client *redisClient) Get() redis.Conn {
+	conn, err := client.connect(func() (redis.Conn, error) {
+		return client.pool.GetContext(context.Background())
+	}, 0)
+	if err != nil {
+		return failedConn{err: err}
+	}
+	return &trackedConn{Conn: conn, breaker: client.breaker}
+}
+
+// Dial opens a connection that isn't part of the pool, which is meant for
+// long-lived connections such as subscriptions. Unlike with Get, failing
+// commands aren't recorded by the circuit breaker, as these connections are
+// usually ended by closing them.
+func (client *redisClient) Dial() (redis.Conn, error) {
+	return client.connect(client.pool.Dial, RedisRetries)
+}
+
+// connect retries to connect up to the given number of times with
+// exponential backoff, unless the circuit breaker is open.
+func (client *redisClient) connect(dial func() (redis.Conn, error), retries int) (redis.Conn, error) {
+	if !client.breaker.allow() {
+		return nil, ErrRedisUnavailable
+	}
+
+	var err error
+	backoff := RedisRetryBackoff
+	for attempt := 0; ; attempt++ {
+		var conn redis.Conn
+		conn, err = dial()
+		//An exhausted pool says nothing about the health of redis.
+		if err == nil || err == redis.ErrPoolExhausted {
+			return conn, err
+		}
+		if attempt >= retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	client.breaker.record(err)
+	return nil, err
+}
+
+// circuitBreaker keeps track of consecutive failures of a redis server.
+type circuitBreaker struct {
+	// name identifies the redis server in the logs.
+	name string
+
+	mutex     *sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow decides whether redis may be contacted. While the breaker is open,
+// a single request is let through after each cooldown, in order to find out
+// whether redis is available again.
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.failures < RedisBreakerThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(breaker.openUntil) {
+		return false
+	}
+	breaker.openUntil = now.Add(RedisBreakerCooldown)
+	return true
+}
+
+// record updates the breaker with the outcome of a request. Errors replied
+// by redis prove that it is available, only other errors count as failures,
+// as well as writes rejected by a replica that used to be the master.
+func (breaker *circuitBreaker) record(err error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if _, isReply := err.(redis.Error); err == nil || (isReply && !isReadOnlyError(err)) {
+		if breaker.failures >= RedisBreakerThreshold {
+			log.Printf("Redis at %s is available again", breaker.name)
+		}
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures == RedisBreakerThreshold {
+		log.Printf("Redis at %s is unavailable, failing fast for %s : %s", breaker.name, RedisBreakerCooldown, err)
+	}
+	if breaker.failures >= RedisBreakerThreshold {
+		breaker.openUntil = time.Now().Add(RedisBreakerCooldown)
+	}
+}
+
+// trackedConn records the outcome of each command with the circuit breaker.
+type trackedConn struct {
+	redis.Conn
+	breaker *circuitBreaker
+}
+
+func (conn *trackedConn) Do(command string, arguments ...interface{}) (interface{}, error) {
+	reply, err := conn.Conn.Do(command, arguments...)
+	conn.breaker.record(err)
+	return reply, err
+}
+
+func (conn *trackedConn) Send(command string, arguments ...interface{}) error {
+	err := conn.Conn.Send(command, arguments...)
+	if err != nil {
+		conn.breaker.record(err)
+	}
+	return err
+}
+
+func (conn *trackedConn) Receive() (interface{}, error) {
+	reply, err := conn.Conn.Receive()
+	conn.breaker.record(err)
+	return reply, err
+}
+
+func (conn *trackedConn) DoWithTimeout(timeout time.Duration, command string, arguments ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(conn.Conn, timeout, command, arguments...)
+	conn.breaker.record(err)
+	return reply, err
+}
+
+func (conn *trackedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(conn.Conn, timeout)
+	conn.breaker.record(err)
+	return reply, err
+}
+
+// failedConn is returned by redisClient.Get if no connection could be
+// established. All of its methods return the error.
+type failedConn struct {
+	err error
+}
+
+func (conn failedConn) Do(string, ...interface{}) (interface{}, error) { return nil, conn.err }
+func (conn failedConn) Send(string, ...interface{}) error              { return conn.err }
+func (conn failedConn) Flush() error                                   { return conn.err }
+func (conn failedConn) Receive() (interface{}, error)                  { return nil, conn.err }
+func (conn failedConn) Err() error                                     { return conn.err }
+func (conn failedConn) Close() error                                   { return nil }
+
+func (conn failedConn) DoWithTimeout(time.Duration, string, ...interface{}) (interface{}, error) {
+	return nil, conn.err
+}
+
+func (conn failedConn) ReceiveWithTimeout(time.Duration) (interface{}, error) {
+	return nil, conn.err
+}
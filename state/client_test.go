@@ -0,0 +1,162 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	previousThreshold, previousCooldown := RedisBreakerThreshold, RedisBreakerCooldown
+	defer func() { RedisBreakerThreshold, RedisBreakerCooldown = previousThreshold, previousCooldown }()
+	RedisBreakerThreshold = 2
+	RedisBreakerCooldown = 100 * time.Millisecond
+
+	breaker := newRedisClient(&RedisConfig{Address: "breaker"}).breaker
+	breaker.record(errors.New("connection refused"))
+	//Errors replied by redis prove that it is available.
+	breaker.record(redis.Error("WRONGTYPE"))
+	breaker.record(errors.New("connection refused"))
+	if !breaker.allow() {
+		t.Fatal("expected the breaker to stay closed")
+	}
+
+	breaker.record(errors.New("connection refused"))
+	if breaker.allow() {
+		t.Fatal("expected the breaker to be open")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !breaker.allow() {
+		t.Fatal("expected a probe to be let through after the cooldown")
+	}
+	if breaker.allow() {
+		t.Fatal("expected only a single probe to be let through")
+	}
+
+	breaker.record(nil)
+	if !breaker.allow() {
+		t.Error("expected the breaker to be closed after a successful probe")
+	}
+}
+
+func Test_redisClient(t *testing.T) {
+	previousThreshold, previousCooldown := RedisBreakerThreshold, RedisBreakerCooldown
+	previousRetries, previousBackoff := RedisRetries, RedisRetryBackoff
+	defer func() {
+		RedisBreakerThreshold, RedisBreakerCooldown = previousThreshold, previousCooldown
+		RedisRetries, RedisRetryBackoff = previousRetries, previousBackoff
+	}()
+	RedisBreakerThreshold = 2
+	RedisBreakerCooldown = 100 * time.Millisecond
+	RedisRetries = 1
+	RedisRetryBackoff = time.Millisecond
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := newRedisClient(&RedisConfig{Address: server.Addr()})
+	defer client.pool.Close()
+	do := func() error {
+		conn := client.Get()
+		defer conn.Close()
+		_, err := conn.Do("PING")
+		return err
+	}
+
+	if err := do(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	for attempt := 0; attempt < RedisBreakerThreshold; attempt++ {
+		if err := do(); err == nil || err == ErrRedisUnavailable {
+			t.Fatalf("expected a connection error, but got %v", err)
+		}
+	}
+	if err := do(); err != ErrRedisUnavailable {
+		t.Fatalf("expected to fail fast, but got %v", err)
+	}
+
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := do(); err != nil {
+		t.Errorf("expected redis to be available again, but got %s", err)
+	}
+}
+
+func Test_acquireRedisClient(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	first := acquireRedisClient(&RedisConfig{Address: server.Addr()})
+	second := acquireRedisClient(&RedisConfig{Address: server.Addr()})
+	if first != second {
+		t.Fatal("expected the client to be shared")
+	}
+
+	if err := first.release(); err != nil {
+		t.Fatal(err)
+	}
+	conn := second.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Errorf("expected the client to be usable until released by everyone, but got %s", err)
+	}
+	conn.Close()
+
+	if err := second.release(); err != nil {
+		t.Fatal(err)
+	}
+	if third := acquireRedisClient(&RedisConfig{Address: server.Addr()}); third == first {
+		t.Error("expected a new client once the previous one has been released")
+	} else {
+		third.release()
+	}
+}
+
+func Test_redisClientRetries(t *testing.T) {
+	previousRetries, previousBackoff := RedisRetries, RedisRetryBackoff
+	defer func() { RedisRetries, RedisRetryBackoff = previousRetries, previousBackoff }()
+	RedisRetries = 2
+	RedisRetryBackoff = 100 * time.Millisecond
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newRedisClient(&RedisConfig{Address: server.Addr()})
+	defer client.pool.Close()
+	server.Close()
+
+	//Pooled connections are used by the event loops of the lobbies, which
+	//mustn't wait for retries.
+	start := time.Now()
+	conn := client.Get()
+	_, err = conn.Do("PING")
+	conn.Close()
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if elapsed := time.Since(start); elapsed >= RedisRetryBackoff {
+		t.Errorf("expected pooled connections not to be retried, but took %s", elapsed)
+	}
+
+	start = time.Now()
+	if _, err := client.Dial(); err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if elapsed := time.Since(start); elapsed < 3*RedisRetryBackoff {
+		t.Errorf("expected dedicated connections to be retried, but took %s", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"log"
+	"time"
+)
+
+var (
+	// HeartbeatInterval defines how often a replica renews its entry in the
+	// replica registry.
+	HeartbeatInterval = 5 * time.Second
+	// HeartbeatTimeout defines how long a replica is considered to be alive
+	// after its last heartbeat. This has to be considerably longer than
+	// HeartbeatInterval.
+	HeartbeatTimeout = 15 * time.Second
+
+	replicaStartTime = time.Now()
+)
+
+// StartHeartbeat registers this replica in the replica registry and keeps
+// renewing its entry, so that the other replicas know about it.
+func StartHeartbeat() {
+	registerReplica()
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		for {
+			<-ticker.C
+			registerReplica()
+		}
+	}()
+}
+
+// replicaStats returns the lobbies this replica is the reference replica for
+// and the stats of these lobbies. Unlike with Stats, only players connected
+// to this replica count as connected.
+func replicaStats() ([]string, *pageStats) {
+	owned := []string{}
+	stats := &pageStats{}
+	for _, lobby := range getLobbies() {
+		view := lobby.View()
+		for _, player := range view.Players {
+			if player.Websocket != nil {
+				stats.ConnectedPlayersCount++
+			}
+		}
+		if !view.IsReferenceReplica() {
+			continue
+		}
+
+		owned = append(owned, lobby.LobbyID)
+		stats.ActiveLobbyCount++
+		stats.PlayersCount += uint64(len(view.Players))
+		stats.OccupiedPlayerSlotCount += uint64(view.GetOccupiedPlayerSlots())
+	}
+	return owned, stats
+}
+
+// clusterStatus represents the live members of the cluster and the stats of
+// the whole cluster.
+type clusterStatus struct {
+	Replicas []*Replica `json:"replicas"`
+	Totals   *pageStats `json:"totals"`
+}
+
+// ClusterStatus lists all replicas that are alive according to the replica
+// registry and adds up their stats.
+func ClusterStatus() *clusterStatus {
+	replicas, err := Replicas.LoadReplicaList()
+	if err != nil {
+		log.Printf("Error while loading replica list: %s", err)
+		replicas = []*Replica{}
+	}
+
+	totals := &pageStats{}
+	for _, replica := range replicas {
+		if replica.Stats == nil {
+			continue
+		}
+		totals.ActiveLobbyCount += replica.Stats.ActiveLobbyCount
+		totals.PlayersCount += replica.Stats.PlayersCount
+		totals.OccupiedPlayerSlotCount += replica.Stats.OccupiedPlayerSlotCount
+		totals.ConnectedPlayersCount += replica.Stats.ConnectedPlayersCount
+	}
+	return &clusterStatus{Replicas: replicas, Totals: totals}
+}
+
+// ClusterStats works like Stats, but covers the whole cluster.
+func ClusterStats() *pageStats {
+	return ClusterStatus().Totals
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func Test_ReplicaRegistryList(t *testing.T) {
+	registries, elapse := createTestRegistries(t)
+	for name, registry := range registries {
+		registry := registry
+		t.Run(name, func(t *testing.T) {
+			if err := registry.SaveReplica(&Replica{ID: "alive"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := registry.SaveReplica(&Replica{ID: "dead"}, 100*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			elapse(150 * time.Millisecond)
+
+			replicas, err := registry.LoadReplicaList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replicas) != 1 || replicas[0].ID != "alive" {
+				t.Errorf("expected only the alive replica, but got %v", replicas)
+			}
+		})
+	}
+}
+
+func Test_replicaStats(t *testing.T) {
+	previousReplica := game.ReplicaID
+	defer func() { game.ReplicaID = previousReplica }()
+	game.ReplicaID = "local"
+
+	//The owner is connected to this replica, the guest to another one.
+	owned := createTestLobby(t, "owned")
+	owned.ReferenceReplicaID = "local"
+	owned.GetPlayers()[0].SetWebsocket(&websocket.Conn{})
+	owned.JoinPlayer("guest").Connected = true
+	//Players of lobbies owned by other replicas are counted there, unless
+	//they are connected to this replica.
+	foreign := createTestLobby(t, "foreign")
+	foreign.ReferenceReplicaID = "remote"
+	foreign.GetPlayers()[0].SetWebsocket(&websocket.Conn{})
+
+	putTestLobbies(owned, foreign)
+	defer clearTestLobbies()
+
+	ownedIDs, stats := replicaStats()
+	expectLobbyIDs(t, ownedIDs, "owned")
+	if stats.ActiveLobbyCount != 1 || stats.PlayersCount != 2 || stats.ConnectedPlayersCount != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func Test_registerReplicaWhilePlayersJoin(t *testing.T) {
+	previousReplica, previousReplicas := game.ReplicaID, Replicas
+	defer func() { game.ReplicaID, Replicas = previousReplica, previousReplicas }()
+	game.ReplicaID = "local"
+	Replicas = NewMemoryReplicaRegistry()
+
+	lobby := createTestLobby(t, "joining")
+	lobby.ReferenceReplicaID = "local"
+	putTestLobbies(lobby)
+	defer clearTestLobbies()
+	defer lobby.Stop()
+
+	//The heartbeat mustn't touch the lobby while its event loop is joining
+	//players and losing or regaining the lease, see "go test -race".
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			lobby.Synchronized(func() {
+				lobby.JoinPlayer("guest").SetWebsocket(&websocket.Conn{})
+				if i%2 == 0 {
+					lobby.ReferenceReplicaID = "remote"
+				} else {
+					lobby.ReferenceReplicaID = "local"
+				}
+			})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		registerReplica()
+	}
+
+	_, stats := replicaStats()
+	if stats.ConnectedPlayersCount != 100 {
+		t.Errorf("expected the 100 joined players to be connected, but got %+v", stats)
+	}
+}
+
+func Test_ClusterStatus(t *testing.T) {
+	previousReplicas := Replicas
+	defer func() { Replicas = previousReplicas }()
+	Replicas = NewMemoryReplicaRegistry()
+
+	for _, replica := range []*Replica{
+		{ID: "a", Stats: &pageStats{ActiveLobbyCount: 2, PlayersCount: 5, OccupiedPlayerSlotCount: 4, ConnectedPlayersCount: 3}},
+		{ID: "b", Stats: &pageStats{ActiveLobbyCount: 1, PlayersCount: 2, OccupiedPlayerSlotCount: 2, ConnectedPlayersCount: 4}},
+	} {
+		if err := Replicas.SaveReplica(replica, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := ClusterStatus()
+	if len(status.Replicas) != 2 {
+		t.Errorf("expected two replicas, but got %d", len(status.Replicas))
+	}
+	expected := pageStats{ActiveLobbyCount: 3, PlayersCount: 7, OccupiedPlayerSlotCount: 6, ConnectedPlayersCount: 7}
+	if *status.Totals != expected {
+		t.Errorf("expected totals %+v, but got %+v", expected, *status.Totals)
+	}
+}
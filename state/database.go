@@ -4,14 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/guillaumerosinosky/scribble.rs/game"
 )
 
 var (
-	Persistence     bool
 	DatabaseHost    string
 	PersistenceMode string
 	PubSub          bool
@@ -20,143 +20,549 @@ var (
 type PersistedEvent struct {
 	LobbyId  string
 	PlayerId string
-	Data     []byte
+	// Recipients are the players an event published to the output channel
+	// of the lobby is meant for, if it's meant for more than a single
+	// player. PlayerId is empty in that case.
+	Recipients []string `json:",omitempty"`
+	Data       []byte
+	// ReplicaId is the replica that published the event to the output
+	// channel of the lobby, see StampLobbyEvent.
+	ReplicaId string
+	// Epoch tells apart the sequences stamped by ReplicaId, as they start
+	// over once the replica is restarted.
+	Epoch int64 `json:",omitempty"`
+	// Sequence orders the events published to the output channel of the
+	// lobby by ReplicaId and Epoch. It is 0 for events that haven't been
+	// stamped.
+	Sequence int64
 }
 
-func PublishRedis(channel string, message []byte) {
-	c, err := redis.Dial("tcp", DatabaseHost+":6379")
+// redisLobbyStore persists lobbies in redis. Each lobby is stored as a JSON
+// document under "lobby-<id>", its event log as a list under "events-<id>",
+// the drawing of its current turn as a list under "drawing-<id>-<turn>",
+// its player registry as a hash under "players-<id>" and the lease of its
+// reference replica under "lease-<id>". Replicas are registered under
+// "replica-<id>". The lobbies are listed via sets maintained along with the
+// documents, see indexCommands.
+type redisLobbyStore struct {
+	client    *redisClient
+	indexOnce *sync.Once
+}
+
+// NewRedisLobbyStore creates a LobbyStore using the given redis
+// configuration. The connections are shared with the buses using the same
+// configuration.
+func NewRedisLobbyStore(config *RedisConfig) LobbyStore {
+	return &redisLobbyStore{client: acquireRedisClient(config), indexOnce: &sync.Once{}}
+}
+
+func lobbyKey(lobbyID string) string {
+	return "lobby-" + lobbyID
+}
+
+func eventsKey(lobbyID string) string {
+	return "events-" + lobbyID
+}
+
+func sequenceKey(lobbyID string) string {
+	return "sequence-" + lobbyID
+}
+
+func drawingKey(lobbyID string, turn int) string {
+	return fmt.Sprintf("drawing-%s-%d", lobbyID, turn)
+}
+
+func leaseKey(lobbyID string) string {
+	return "lease-" + lobbyID
+}
+
+// acquireLeaseScript sets the lease if it isn't held by anyone, or extends
+// it if it's already held by the requesting replica. The current holder is
+// returned either way.
+var acquireLeaseScript = redis.NewScript(1, `
+local holder = redis.call("GET", KEYS[1])
+if not holder then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return ARGV[1]
+end
+if holder == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return holder
+`)
+
+func (store *redisLobbyStore) SaveLobby(lobby *game.Lobby) error {
+	return store.compareAndSet(lobby, false)
+}
+
+// compareAndSet stores the lobby, as long as no one else has changed it since
+// it has been loaded or saved by us. The additional commands are executed in
+// the same transaction, as are the updates of the indexes.
+func (store *redisLobbyStore) compareAndSet(lobby *game.Lobby, includeDrawing bool, commands ...[]interface{}) error {
+	store.ensureIndexes()
+	commands = append(commands, indexCommands(lobby)...)
+	commands = append(commands,
+		[]interface{}{"PEXPIRE", playersKey(lobby.LobbyID), LobbyExpiry.Milliseconds()},
+		[]interface{}{"PEXPIRE", drawingKey(lobby.LobbyID, lobby.Turn), LobbyExpiry.Milliseconds()})
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	key := lobbyKey(lobby.LobbyID)
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return err
+	}
+
+	storedDocument, err := redis.String(conn.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		return err
+	}
+	if err := checkVersion(lobby, storedDocument); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	document, version := lobbyDocument(lobby, includeDrawing)
+	conn.Send("MULTI")
+	conn.Send("SET", key, document, "PX", LobbyExpiry.Milliseconds())
+	for _, command := range commands {
+		conn.Send(command[0].(string), command[1:]...)
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	//A nil reply means that the watched key has been modified in the meantime.
+	if reply == nil {
+		return ErrVersionConflict
+	}
+
+	lobby.Version = version
+	return nil
+}
+
+func (store *redisLobbyStore) LoadLobby(id string) (*game.Lobby, error) {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("GET", lobbyKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrLobbyNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entity, err := decodeLobbyEntity(value)
+	if err != nil {
+		return nil, err
+	}
+	drawing, err := redis.ByteSlices(conn.Do("LRANGE", drawingKey(id, entity.Turn), 0, -1))
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
-	c.Do("PUBLISH", channel, message)
+	return assembleLobby(value, drawing)
 }
 
-func SubscribeRedis(pChannel string, channel chan []byte) {
-	c, err := redis.Dial("tcp", DatabaseHost+":6379")
+func (store *redisLobbyStore) DeleteLobby(id string) error {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	keys := []interface{}{lobbyKey(id), eventsKey(id), sequenceKey(id), leaseKey(id), playersKey(id)}
+	wordpack, err := indexedWordpack(conn, id)
+	if err != nil {
+		return err
+	}
+	//Drawings of previous turns are cleared when the turn ends, therefore
+	//only the drawing of the current turn is left. Without the document,
+	//the drawing expires along with it.
+	value, err := redis.String(conn.Do("GET", lobbyKey(id)))
+	if err == nil {
+		//Corrupt documents don't tell the turn, so the drawing is kept.
+		if entity, err := decodeLobbyEntity(value); err == nil {
+			keys = append(keys, drawingKey(id, entity.Turn))
+			wordpack = entity.Wordpack
+		}
+	} else if err != redis.ErrNil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", keys...)
+	for _, command := range unindexCommands(id, wordpack) {
+		conn.Send(command[0].(string), command[1:]...)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func quarantineKey(lobbyID string) string {
+	return "quarantine-" + lobbyID
+}
+
+func (store *redisLobbyStore) QuarantineLobby(id string) error {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	wordpack, err := indexedWordpack(conn, id)
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-	psc := redis.PubSubConn{Conn: c}
-	psc.Subscribe(pChannel)
-	for {
-		switch v := psc.Receive().(type) {
-		case redis.Message:
-			//fmt.Printf("%s: message: %s\n", v.Channel, v.Data)
-			channel <- v.Data
-
-		case redis.Subscription:
-			fmt.Printf("%s: %s %d\n", v.Channel, v.Kind, v.Count)
-		case error:
-			fmt.Println(v)
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("RENAME", lobbyKey(id), quarantineKey(id))
+	//The document would otherwise expire like the lobby it belonged to.
+	conn.Send("PERSIST", quarantineKey(id))
+	conn.Send("DEL", eventsKey(id), sequenceKey(id), leaseKey(id), playersKey(id))
+	for _, command := range unindexCommands(id, wordpack) {
+		conn.Send(command[0].(string), command[1:]...)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (store *redisLobbyStore) LoadLobbyList() ([]string, error) {
+	store.ensureIndexes()
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	var ids []string
+	for cursor := ""; ; {
+		batch, next, err := scanSet(conn, allLobbiesIndexKey, cursor, LobbyScanCount)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, batch...)
+
+		if next == "" {
+			return ids, nil
 		}
+		cursor = next
 	}
 }
 
-func OnSubscribeMessageRedis() {
+func (store *redisLobbyStore) TouchLobby(id string) error {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	keys := []string{lobbyKey(id), playersKey(id)}
+	//The drawing of the current turn has to live as long as the lobby.
+	value, err := redis.String(conn.Do("GET", lobbyKey(id)))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if entity, err := decodeLobbyEntity(value); err == nil {
+		keys = append(keys, drawingKey(id, entity.Turn))
+	}
 
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("PEXPIRE", key, LobbyExpiry.Milliseconds())
+	}
+	_, err = conn.Do("EXEC")
+	return err
 }
 
-func nPool() *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:   50,
-		MaxActive: 10000,
-		Dial: func() (redis.Conn, error) {
-			conn, err := redis.Dial("tcp", DatabaseHost+":6379")
+// ExpiredLobbies returns the lobbies that are still indexed, while redis has
+// already dropped their document due to its expiry.
+func (store *redisLobbyStore) ExpiredLobbies() ([]string, error) {
+	store.ensureIndexes()
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	var expired []string
+	for cursor := ""; ; {
+		batch, next, err := scanSet(conn, allLobbiesIndexKey, cursor, LobbyScanCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			conn.Send("EXISTS", lobbyKey(id))
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			exists, err := redis.Bool(conn.Receive())
 			if err != nil {
-				log.Printf("ERROR: fail initializing the redis pool: %s", err.Error())
-				os.Exit(1)
+				return nil, err
+			}
+			if !exists {
+				expired = append(expired, id)
 			}
-			return conn, err
-		},
+		}
+
+		if next == "" {
+			return expired, nil
+		}
+		cursor = next
 	}
 }
 
-func DeleteLobby(id string) {
-	rPool := nPool()
-	conn := rPool.Get()
+func (store *redisLobbyStore) NextLobbySequence(id string) (int64, error) {
+	conn := store.client.Get()
 	defer conn.Close()
-	_, err := conn.Do("DEL", "lobby-"+id)
+
+	return redis.Int64(conn.Do("INCR", sequenceKey(id)))
+}
+
+func (store *redisLobbyStore) AppendLobbyEvent(event *LobbyEvent) (int, error) {
+	data, err := json.Marshal(event)
 	if err != nil {
-		log.Fatalf("Error while deleting lobby %s : %s", id, err)
+		return 0, err
 	}
-	//log.Printf("Result: %s", values.(string))
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("RPUSH", eventsKey(event.LobbyID), data))
 }
 
-func SaveLobby(lobby *game.Lobby) {
-	rPool := nPool()
-	conn := rPool.Get()
+func (store *redisLobbyStore) LoadLobbyEvents(id string) ([]*LobbyEvent, error) {
+	conn := store.client.Get()
 	defer conn.Close()
-	_, err := conn.Do("SET", "lobby-"+lobby.LobbyID, LobbyToJson(lobby))
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", eventsKey(id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*LobbyEvent, 0, len(values))
+	for _, value := range values {
+		var event LobbyEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+func (store *redisLobbyStore) SnapshotLobby(lobby *game.Lobby) error {
+	return store.compareAndSet(lobby, true, []interface{}{"DEL", eventsKey(lobby.LobbyID)})
+}
+
+func (store *redisLobbyStore) AppendDrawing(lobbyID string, turn int, operation *game.DrawingOperation) error {
+	data, err := json.Marshal(operation)
 	if err != nil {
-		log.Fatalf("Error while saving lobby %s : %s", lobby.LobbyID, err)
+		return err
 	}
-	//log.Printf("Result: %s", values.(string))
 
+	conn := store.client.Get()
+	defer conn.Close()
+
+	//The drawing expires along with the lobby, see TouchLobby.
+	conn.Send("MULTI")
+	conn.Send("RPUSH", drawingKey(lobbyID, turn), data)
+	conn.Send("PEXPIRE", drawingKey(lobbyID, turn), LobbyExpiry.Milliseconds())
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (store *redisLobbyStore) ClearDrawing(lobbyID string, turn int) error {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", drawingKey(lobbyID, turn))
+	return err
+}
+
+func (store *redisLobbyStore) AcquireLease(lobbyID, replicaID string, duration time.Duration) (string, error) {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	return redis.String(acquireLeaseScript.Do(conn, leaseKey(lobbyID), replicaID, duration.Milliseconds()))
+}
+
+func (store *redisLobbyStore) LoadLeaseHolder(lobbyID string) (string, error) {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	holder, err := redis.String(conn.Do("GET", leaseKey(lobbyID)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return holder, err
+}
+
+// DeleteLobby removes the lobby from the Store and drops its input channel,
+// see removeLobbyInput.
+func DeleteLobby(id string) {
+	forgetLobbyEvents(id)
+	forgetDirtyLobby(id)
+	if err := Store.DeleteLobby(id); err != nil {
+		log.Printf("Error while deleting lobby %s : %s", id, err)
+	}
+	removeLobbyInput(id)
+}
+
+// SaveLobby writes the lobby to the Store. The current drawing isn't part of
+// this, as it is persisted incrementally, see attachDrawingPersistence. If
+// the lobby couldn't be persisted before, it is left to the flusher, which
+// writes it completely, so that the event loop isn't held up by contacting
+// a Store that has just failed. If the lobby has been modified concurrently,
+// the conflict is resolved, see resolveVersionConflictUnsynchronized, and
+// ErrVersionConflict is returned if this replica has stepped down.
+func SaveLobby(lobby *game.Lobby) error {
+	if isLobbyDirty(lobby.LobbyID) {
+		return nil
+	}
+
+	err := Store.SaveLobby(lobby)
+	if err == ErrVersionConflict && resolveVersionConflictUnsynchronized(lobby) {
+		err = Store.SaveLobby(lobby)
+	}
+	if err == ErrVersionConflict {
+		log.Printf("Lobby %s has been modified concurrently, version %d is outdated", lobby.LobbyID, lobby.Version)
+	} else if err != nil {
+		log.Printf("Error while saving lobby %s : %s", lobby.LobbyID, err)
+		markLobbyDirty(lobby.LobbyID)
+	}
+	return err
 }
 
 func NoSaveLobby(lobby *game.Lobby) {
 	// default behaviour
 }
 
-func AddLobbyEvent(lobby *game.Lobby) {
+// LobbyWriters installs the functions a lobby sends its events with, see
+// Lobby.WriteJSON and Lobby.BroadcastJSON. It is applied to every lobby
+// loaded from the Store, as those would otherwise keep the dummy writers
+// set by game.UnmarshallLobby and never reach their players.
+var LobbyWriters = func(lobby *game.Lobby) {}
 
+// LoadLobby loads the lobby with the given ID from the Store. In EVENTS
+// persistence mode, the event log is replayed on top of the last snapshot.
+// If the lobby can't be loaded, nil is returned.
+func LoadLobby(id string) *game.Lobby {
+	var lobby *game.Lobby
+	if PersistenceMode == "EVENTS" {
+		lobby = ReplayLobby(id)
+	} else if stored, err := loadStoredLobby(id); err == nil {
+		lobby = stored
+		attachDrawingPersistence(lobby)
+	}
+	if lobby == nil {
+		return nil
+	}
+
+	//The events are only sent once the lobby has been replayed, as the
+	//players have received them before already.
+	LobbyWriters(lobby)
+	return lobby
 }
 
-func LoadLobby(key string) *game.Lobby {
-	rPool := nPool()
-	conn := rPool.Get()
-	defer conn.Close()
-	value, err := redis.String(conn.Do("GET", key))
-	if err != nil {
-		log.Fatalf("Error while loading lobby %s : %s", key, err)
+// attachDrawingPersistence makes the lobby persist each drawing operation as
+// soon as it has been drawn. This is only required in BASIC persistence mode,
+// as the event log in EVENTS mode already contains all drawing operations.
+func attachDrawingPersistence(lobby *game.Lobby) {
+	if PersistenceMode != "BASIC" {
+		return
+	}
+
+	//The drawing of dirty lobbies is rewritten once they are flushed.
+	lobby.OnDrawingAppended = func(lobby *game.Lobby, operation *game.DrawingOperation) {
+		if isLobbyDirty(lobby.LobbyID) {
+			return
+		}
+		if err := Store.AppendDrawing(lobby.LobbyID, lobby.Turn, operation); err != nil {
+			log.Printf("Error while appending drawing of lobby %s : %s", lobby.LobbyID, err)
+			markLobbyDirty(lobby.LobbyID)
+		}
+	}
+	lobby.OnDrawingCleared = func(lobby *game.Lobby) {
+		if isLobbyDirty(lobby.LobbyID) {
+			return
+		}
+		if err := Store.ClearDrawing(lobby.LobbyID, lobby.Turn); err != nil {
+			log.Printf("Error while clearing drawing of lobby %s : %s", lobby.LobbyID, err)
+			markLobbyDirty(lobby.LobbyID)
+		}
 	}
-	//log.Printf("Load lobby: %s", value)
-	return JsonToLobby(value)
 }
 
+// LoadLobbyList returns the IDs of all lobbies in the Store.
 func LoadLobbyList() []string {
-	if Persistence {
-		rPool := nPool()
-		conn := rPool.Get()
-		values, err := redis.Strings(conn.Do("KEYS", "lobby-*"))
-		if err != nil {
-			log.Fatalf("Error while gettings keys %s", err)
-		}
-		return values
-	} else {
+	ids, err := Store.LoadLobbyList()
+	if err != nil {
+		log.Printf("Error while loading lobby list: %s", err)
 		return []string{}
 	}
+	return ids
 }
 
 func LobbyToJson(lobby *game.Lobby) string {
+	return entityToJson(game.MarshallLobby(lobby))
+}
+
+// lobbyDocument serializes the lobby the way it is going to be stored by the
+// next save, meaning with an incremented version. The current drawing is
+// only included if requested, as it usually is persisted separately via
+// LobbyStore.AppendDrawing.
+func lobbyDocument(lobby *game.Lobby, includeDrawing bool) (string, int64) {
 	m := game.MarshallLobby(lobby)
+	m.Version++
+	if !includeDrawing {
+		m.CurrentDrawing = nil
+	}
+	return entityToJson(m), m.Version
+}
+
+// checkVersion makes sure that the stored document is still at the version
+// of the lobby that is about to be saved. An empty document means that the
+// lobby hasn't been stored yet.
+func checkVersion(lobby *game.Lobby, storedDocument string) error {
+	var storedVersion int64
+	if storedDocument != "" {
+		stored, err := decodeLobbyEntity(storedDocument)
+		if err != nil {
+			return err
+		}
+		storedVersion = stored.Version
+	}
+
+	if storedVersion != lobby.Version {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func entityToJson(m game.LobbyEntity) string {
 	result, err := json.Marshal(m)
 	if err != nil {
-		log.Fatalf("LobbyToJson: %s", err)
+		log.Printf("LobbyToJson: %s", err)
 	}
 	//log.Printf("%s", string(result))
 	return string(result)
 }
 
-func JsonToLobby(value string) *game.Lobby {
-	var l game.LobbyEntity
-	err := json.Unmarshal([]byte(value), &l)
+func JsonToLobby(value string) (*game.Lobby, error) {
+	m, err := decodeLobbyEntity(value)
 	if err != nil {
-		log.Fatalf("JsonToLobby: %s", err)
+		return nil, err
 	}
-	return game.UnmarshallLobby(l)
+	return game.UnmarshallLobby(m), nil
 }
 
-/*
-func clearFigure(lobby *game.Lobby) {
-	rPool := nPool()
-	conn := rPool.Get()
-	values, err := redis.Strings(conn.Do("KEYS"))
-}
-
-func appendLine(lobby *game.Lobby) {
-
+// assembleLobby creates a lobby from its document and the drawing operations
+// that have been stored separately for its current turn.
+func assembleLobby(value string, drawing [][]byte) (*game.Lobby, error) {
+	m, err := decodeLobbyEntity(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, rawOperation := range drawing {
+		operation := &game.DrawingOperation{}
+		if err := json.Unmarshal(rawOperation, operation); err != nil {
+			return nil, err
+		}
+		m.CurrentDrawing = append(m.CurrentDrawing, operation)
+	}
+	return game.UnmarshallLobby(m), nil
 }
-*/
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// DirtyFlushInterval defines how often persisting the lobbies that
+	// couldn't be persisted is retried.
+	DirtyFlushInterval = 5 * time.Second
+
+	dirtyLobbiesMutex = &sync.Mutex{}
+	// dirtyLobbies are the lobbies that are ahead of their state in the
+	// Store, as persisting them has failed, for example because redis has
+	// been unavailable. They keep running from memory until they have been
+	// flushed.
+	dirtyLobbies = make(map[string]bool)
+)
+
+// StartDirtyLobbyFlusher periodically retries persisting the lobbies that
+// couldn't be persisted.
+func StartDirtyLobbyFlusher() {
+	go func() {
+		ticker := time.NewTicker(DirtyFlushInterval)
+		for {
+			<-ticker.C
+			flushDirtyLobbies()
+		}
+	}()
+}
+
+func markLobbyDirty(lobbyID string) {
+	dirtyLobbiesMutex.Lock()
+	defer dirtyLobbiesMutex.Unlock()
+
+	if !dirtyLobbies[lobbyID] {
+		log.Printf("Lobby %s couldn't be persisted, keeping it in memory until it can be flushed", lobbyID)
+	}
+	dirtyLobbies[lobbyID] = true
+}
+
+func isLobbyDirty(lobbyID string) bool {
+	dirtyLobbiesMutex.Lock()
+	defer dirtyLobbiesMutex.Unlock()
+
+	return dirtyLobbies[lobbyID]
+}
+
+func forgetDirtyLobby(lobbyID string) {
+	dirtyLobbiesMutex.Lock()
+	defer dirtyLobbiesMutex.Unlock()
+
+	delete(dirtyLobbies, lobbyID)
+}
+
+func getDirtyLobbyIDs() []string {
+	dirtyLobbiesMutex.Lock()
+	defer dirtyLobbiesMutex.Unlock()
+
+	ids := make([]string, 0, len(dirtyLobbies))
+	for id := range dirtyLobbies {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// flushDirtyLobbies persists all dirty lobbies this replica is still the
+// reference replica for. The state of the other dirty lobbies is up to
+// their new reference replica, so it is dropped.
+func flushDirtyLobbies() {
+	for _, id := range getDirtyLobbyIDs() {
+		lobby := GetLobby(id)
+		if lobby == nil || !lobby.View().IsReferenceReplica() {
+			forgetDirtyLobby(id)
+			continue
+		}
+
+		lobby.Synchronized(func() {
+			flushLobbyUnsynchronized(lobby)
+		})
+	}
+}
+
+// flushLobbyUnsynchronized writes the complete lobby to the Store, which
+// brings the Store up to date with all changes that couldn't be persisted
+// in the meantime. If the lobby has been modified concurrently, the changes
+// are dropped. Otherwise the lobby stays dirty until flushing succeeds.
+func flushLobbyUnsynchronized(lobby *game.Lobby) {
+	err := writeLobby(lobby)
+	if err == ErrVersionConflict && resolveVersionConflictUnsynchronized(lobby) {
+		err = writeLobby(lobby)
+	}
+	if err == ErrVersionConflict {
+		log.Printf("Dropping unpersisted changes of lobby %s, as it has been modified concurrently", lobby.LobbyID)
+		forgetDirtyLobby(lobby.LobbyID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error while flushing lobby %s : %s", lobby.LobbyID, err)
+		return
+	}
+
+	log.Printf("Flushed lobby %s", lobby.LobbyID)
+	forgetDirtyLobby(lobby.LobbyID)
+}
+
+// writeLobby stores the lobby including its current drawing. In BASIC
+// persistence mode, the drawing is stored separately, so it is rewritten,
+// as drawing operations might have been lost. Otherwise, a snapshot
+// contains the drawing and supersedes the event log.
+func writeLobby(lobby *game.Lobby) error {
+	if PersistenceMode != "BASIC" {
+		return Store.SnapshotLobby(lobby)
+	}
+
+	if err := Store.SaveLobby(lobby); err != nil {
+		return err
+	}
+	if err := Store.ClearDrawing(lobby.LobbyID, lobby.Turn); err != nil {
+		return err
+	}
+	for _, operation := range game.MarshallLobby(lobby).CurrentDrawing {
+		if err := Store.AppendDrawing(lobby.LobbyID, lobby.Turn, operation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// unavailableStore fails all writes and lobby listings while unavailable,
+// just like a redis store does during an outage.
+type unavailableStore struct {
+	LobbyStore
+	unavailable bool
+}
+
+func (store *unavailableStore) SaveLobby(lobby *game.Lobby) error {
+	if store.unavailable {
+		return ErrRedisUnavailable
+	}
+	return store.LobbyStore.SaveLobby(lobby)
+}
+
+func (store *unavailableStore) SnapshotLobby(lobby *game.Lobby) error {
+	if store.unavailable {
+		return ErrRedisUnavailable
+	}
+	return store.LobbyStore.SnapshotLobby(lobby)
+}
+
+func (store *unavailableStore) AppendDrawing(lobbyID string, turn int, operation *game.DrawingOperation) error {
+	if store.unavailable {
+		return ErrRedisUnavailable
+	}
+	return store.LobbyStore.AppendDrawing(lobbyID, turn, operation)
+}
+
+func (store *unavailableStore) LoadLobbyList() ([]string, error) {
+	if store.unavailable {
+		return nil, ErrRedisUnavailable
+	}
+	return store.LobbyStore.LoadLobbyList()
+}
+
+func Test_flushDirtyLobbies(t *testing.T) {
+	useTestStore(t)
+	previousMode := PersistenceMode
+	defer func() { PersistenceMode = previousMode }()
+	store := &unavailableStore{LobbyStore: Store, unavailable: true}
+	Store = store
+	PersistenceMode = "BASIC"
+	game.ReplicaID = "local"
+	defer clearTestLobbies()
+
+	lobby := createTestLobby(t, "dirty")
+	lobby.ReferenceReplicaID = "local"
+	if err := AddLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	defer forgetDirtyLobby("dirty")
+	if !isLobbyDirty("dirty") {
+		t.Fatal("expected the lobby to be dirty")
+	}
+
+	//The lobby keeps running from memory while the Store is unavailable.
+	lobby.AppendLine(&game.LineEvent{Type: "line", Data: &game.Line{ToX: 1, ToY: 1}})
+	synchronizeLobbies()
+	evictLobbies()
+	flushDirtyLobbies()
+	if GetLobby("dirty") == nil {
+		t.Fatal("expected the lobby to be kept")
+	}
+
+	//Lobbies that aren't in the Store yet survive the synchronization.
+	store.unavailable = false
+	synchronizeLobbies()
+	if GetLobby("dirty") == nil {
+		t.Fatal("expected the lobby to be kept")
+	}
+
+	flushDirtyLobbies()
+	if isLobbyDirty("dirty") {
+		t.Error("expected the lobby to be flushed")
+	}
+	stored, err := Store.LoadLobby("dirty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != lobby.Version {
+		t.Errorf("expected version %d to be stored, but got %d", lobby.Version, stored.Version)
+	}
+	if drawing := game.MarshallLobby(stored).CurrentDrawing; len(drawing) != 1 {
+		t.Errorf("expected the drawing to be flushed, but got %d operations", len(drawing))
+	}
+}
+
+func Test_flushDirtyLobbiesConflict(t *testing.T) {
+	useTestStore(t)
+	previousMode := PersistenceMode
+	defer func() { PersistenceMode = previousMode }()
+	PersistenceMode = "EVENTS"
+	game.ReplicaID = "local"
+	defer clearTestLobbies()
+
+	lobby := createTestLobby(t, "conflicting")
+	lobby.ReferenceReplicaID = "local"
+	if err := AddLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	//Another replica has taken over and stored the lobby in the meantime.
+	other := createTestLobby(t, "conflicting")
+	other.Version = lobby.Version
+	if err := Store.SaveLobby(other); err != nil {
+		t.Fatal(err)
+	}
+
+	markLobbyDirty("conflicting")
+	flushDirtyLobbies()
+	if isLobbyDirty("conflicting") {
+		t.Error("expected the changes to be dropped")
+	}
+}
@@ -0,0 +1,189 @@
+package state
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// SnapshotInterval defines after how many logged events a new snapshot of
+// the lobby is taken. The snapshot replaces all events logged before it,
+// which keeps replaying a lobby bounded.
+var SnapshotInterval = 100
+
+// LobbyEvent is a single accepted GameEvent as it is stored in the event log
+// of a lobby when running in EVENTS persistence mode.
+type LobbyEvent struct {
+	LobbyID   string
+	PlayerID  string
+	Sequence  int64
+	Timestamp time.Time
+	// Data is the raw GameEvent as it has been sent by the player.
+	Data []byte
+}
+
+var (
+	snapshotTurnsMutex = &sync.Mutex{}
+	// snapshotTurns remembers the timer state of each lobby at the time of
+	// its last logged event. Turns are advanced and hints are revealed
+	// either by the turn timer or by events that involve choosing random
+	// words. Neither can be replayed faithfully, so a change of the timer
+	// state always causes a new snapshot.
+	snapshotTurns = make(map[string]timerState)
+)
+
+// timerState is the part of a lobby that is changed by the turn timer.
+type timerState struct {
+	roundEndTime int64
+	hintsLeft    int
+}
+
+func timerStateOf(lobby *game.Lobby) timerState {
+	return timerState{roundEndTime: lobby.RoundEndTime, hintsLeft: lobby.GetHintsLeft()}
+}
+
+// AppendLobbyEvent adds an event that has been accepted by the lobby to its
+// event log. This has to be called while the lobby is still locked, as the
+// order of the log has to match the order in which the events were handled.
+// Lobbies that couldn't be persisted before are skipped, as their event log
+// is incomplete. The flusher snapshots them instead.
+func AppendLobbyEvent(lobby *game.Lobby, playerID string, data []byte) {
+	if isLobbyDirty(lobby.LobbyID) {
+		return
+	}
+
+	sequence, err := Store.NextLobbySequence(lobby.LobbyID)
+	if err != nil {
+		log.Printf("Error while incrementing sequence of lobby %s : %s", lobby.LobbyID, err)
+		markLobbyDirty(lobby.LobbyID)
+		return
+	}
+
+	if turnChanged(lobby) {
+		SnapshotLobby(lobby)
+		return
+	}
+
+	length, err := Store.AppendLobbyEvent(&LobbyEvent{
+		LobbyID:   lobby.LobbyID,
+		PlayerID:  playerID,
+		Sequence:  sequence,
+		Timestamp: lobby.GetEventTime(),
+		Data:      data,
+	})
+	if err != nil {
+		log.Printf("Error while appending event to lobby %s : %s", lobby.LobbyID, err)
+		markLobbyDirty(lobby.LobbyID)
+		return
+	}
+
+	if length >= SnapshotInterval {
+		SnapshotLobby(lobby)
+	}
+}
+
+func turnChanged(lobby *game.Lobby) bool {
+	snapshotTurnsMutex.Lock()
+	defer snapshotTurnsMutex.Unlock()
+
+	lastState, known := snapshotTurns[lobby.LobbyID]
+	snapshotTurns[lobby.LobbyID] = timerStateOf(lobby)
+	return !known || lastState != timerStateOf(lobby)
+}
+
+// SnapshotLobby stores the complete lobby and drops all events that have
+// been logged so far, since they are contained in the snapshot. Conflicts
+// are handled the same way as by SaveLobby.
+func SnapshotLobby(lobby *game.Lobby) error {
+	err := Store.SnapshotLobby(lobby)
+	if err == ErrVersionConflict && resolveVersionConflictUnsynchronized(lobby) {
+		err = Store.SnapshotLobby(lobby)
+	}
+	if err == ErrVersionConflict {
+		log.Printf("Error while taking snapshot of lobby %s : %s", lobby.LobbyID, err)
+		forgetDirtyLobby(lobby.LobbyID)
+		return err
+	}
+	if err != nil {
+		log.Printf("Error while taking snapshot of lobby %s : %s", lobby.LobbyID, err)
+		markLobbyDirty(lobby.LobbyID)
+		return err
+	}
+	forgetDirtyLobby(lobby.LobbyID)
+	return nil
+}
+
+// ReplayLobby loads the last snapshot of a lobby and applies all events that
+// have been logged after the snapshot has been taken. If the lobby can't be
+// loaded, nil is returned.
+func ReplayLobby(id string) *game.Lobby {
+	lobby, err := loadStoredLobby(id)
+	if err != nil {
+		return nil
+	}
+
+	events, err := Store.LoadLobbyEvents(id)
+	if err != nil {
+		log.Printf("Error while loading events of lobby %s : %s", id, err)
+		return lobby
+	}
+
+	for _, event := range events {
+		replayEvent(lobby, event)
+	}
+
+	snapshotTurnsMutex.Lock()
+	snapshotTurns[lobby.LobbyID] = timerStateOf(lobby)
+	snapshotTurnsMutex.Unlock()
+
+	return lobby
+}
+
+func replayEvent(lobby *game.Lobby, event *LobbyEvent) {
+	var player *game.Player
+	for _, p := range lobby.GetPlayers() {
+		if p.ID == event.PlayerID {
+			player = p
+			break
+		}
+	}
+	if player == nil {
+		log.Printf("Skipping event %d of lobby %s, player %s unknown", event.Sequence, event.LobbyID, event.PlayerID)
+		return
+	}
+
+	received := &game.GameEvent{}
+	if err := json.Unmarshal(event.Data, received); err != nil {
+		log.Printf("Skipping event %d of lobby %s: %s", event.Sequence, event.LobbyID, err)
+		return
+	}
+
+	//The lobby isn't shared yet, so there's no need for its event loop.
+	if err := lobby.ReplayEvent(event.Data, received, player, event.Timestamp); err != nil {
+		log.Printf("Error replaying event %d of lobby %s: %s", event.Sequence, event.LobbyID, err)
+	}
+}
+
+// snapshotJoinedPlayer makes sure that a player who has joined the lobby is
+// part of its persisted state. In EVENTS persistence mode, only the events
+// of the players are logged, so the lobby is snapshotted, as the events of
+// the new player couldn't be replayed otherwise. This is done by the
+// reference replica of the lobby only, as it is the one logging the events.
+// Otherwise, the lobby isn't saved, so only its indexes are updated.
+func snapshotJoinedPlayer(lobby *game.Lobby) {
+	if PersistenceMode == "EVENTS" && lobby.IsReferenceReplica() {
+		SnapshotLobby(lobby)
+		return
+	}
+	IndexLobbyUnsynchronized(lobby)
+}
+
+func forgetLobbyEvents(lobbyID string) {
+	snapshotTurnsMutex.Lock()
+	defer snapshotTurnsMutex.Unlock()
+
+	delete(snapshotTurns, lobbyID)
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func Test_ReplayLobbyWithoutEventLoop(t *testing.T) {
+	useTestStore(t)
+	previousMode := PersistenceMode
+	defer func() { PersistenceMode = previousMode }()
+	PersistenceMode = "EVENTS"
+
+	lobby := createTestLobby(t, "replayed")
+	if err := Store.SnapshotLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Store.AppendLobbyEvent(&LobbyEvent{
+		LobbyID:   lobby.LobbyID,
+		PlayerID:  lobby.GetPlayers()[0].ID,
+		Sequence:  1,
+		Timestamp: time.Now(),
+		Data:      []byte(`{"type":"message","data":"hello"}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Loaded lobbies are often thrown away right away, for example when
+	//listing the public lobbies, so replaying mustn't leave anything behind.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if LoadLobby("replayed") == nil {
+			t.Fatal("expected the lobby to be replayed")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("expected no goroutines to be left behind, but went from %d to %d", before, after)
+	}
+}
+
+// createLoggedTestLobby creates a lobby in EVENTS persistence mode that has
+// been snapshotted and returns a function handling events the way the api
+// package does, logging them.
+func createLoggedTestLobby(t *testing.T, id string) (*game.Lobby, func(player *game.Player, data string)) {
+	lobby := createTestLobby(t, id)
+	t.Cleanup(lobby.Stop)
+	lobby.WriteJSON = func(ctx context.Context, lobby *game.Lobby, player *game.Player, object interface{}) error {
+		return nil
+	}
+	if err := Store.SnapshotLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	return lobby, func(player *game.Player, data string) {
+		received := &game.GameEvent{}
+		if err := json.Unmarshal([]byte(data), received); err != nil {
+			t.Fatal(err)
+		}
+		persist := func(lobby *game.Lobby) {
+			AppendLobbyEvent(lobby, player.ID, []byte(data))
+		}
+		if err := lobby.HandleEvent([]byte(data), received, player, persist); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ReplayLobby(t *testing.T) {
+	useTestStore(t)
+	previousMode := PersistenceMode
+	defer func() { PersistenceMode = previousMode }()
+	PersistenceMode = "EVENTS"
+	game.ReplicaID = "local"
+
+	lobby, handle := createLoggedTestLobby(t, "replayed")
+	lobby.DrawingTime = 10
+	owner := lobby.GetPlayers()[0]
+
+	//The players join after the lobby has been snapshotted, their events
+	//have to be replayed nonetheless.
+	var guessers []*game.Player
+	lobby.Synchronized(func() {
+		for _, name := range []string{"first", "second"} {
+			guesser := lobby.JoinPlayer(name)
+			guesser.Connected = true
+			RegisterJoinedPlayerUnsynchronized(lobby, guesser)
+			guessers = append(guessers, guesser)
+		}
+	})
+
+	handle(owner, `{"type":"start"}`)
+	handle(owner, `{"type":"choose-word","data":0}`)
+	var word string
+	lobby.Synchronized(func() {
+		word = lobby.CurrentWord
+	})
+	handle(guessers[0], fmt.Sprintf(`{"type":"message","data":"%s"}`, word))
+
+	var score int
+	lobby.Synchronized(func() {
+		score = guessers[0].Score
+	})
+	if score == 0 {
+		t.Fatal("expected the guess to be scored")
+	}
+	if events, _ := Store.LoadLobbyEvents("replayed"); len(events) == 0 {
+		t.Fatal("expected the guess to be logged")
+	}
+
+	//The score of the guess depends on the time it has been made at.
+	time.Sleep(1100 * time.Millisecond)
+	replayed := LoadLobby("replayed")
+	if replayed == nil {
+		t.Fatal("expected the lobby to be replayed")
+	}
+	replayedGuesser := replayed.GetPlayerByID(guessers[0].ID)
+	if replayedGuesser == nil {
+		t.Fatal("expected the guesser to be known")
+	}
+	if replayedGuesser.Score != score || replayed.CurrentWord != word {
+		t.Errorf("expected score %d for %s, but got %d for %s", score, word, replayedGuesser.Score, replayed.CurrentWord)
+	}
+}
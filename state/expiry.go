@@ -0,0 +1,116 @@
+package state
+
+import (
+	"log"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// LobbyExpiry defines how long a lobby is kept after it has last been
+	// saved or touched. Replicas touch the lobbies that have players
+	// connected to them, so only abandoned lobbies expire.
+	LobbyExpiry = 75 * time.Second
+	// LobbySweepInterval defines how often expired lobbies are cleaned up.
+	LobbySweepInterval = 90 * time.Second
+)
+
+// sweeperLeaseID is the lease held by the replica that is in charge of
+// cleaning up expired lobbies, so that the replicas don't all sweep at once.
+const sweeperLeaseID = "sweeper"
+
+// StartLobbySweeper keeps the lobbies with connected players alive, evicts
+// lobbies that have expired from this instance and periodically removes
+// expired lobbies from the Store.
+func StartLobbySweeper() {
+	go func() {
+		touchTicker := time.NewTicker(LobbyExpiry / 3)
+		sweepTicker := time.NewTicker(LobbySweepInterval)
+		for {
+			select {
+			case <-touchTicker.C:
+				touchLobbies()
+			case <-sweepTicker.C:
+				sweepLobbies()
+				evictLobbies()
+			}
+		}
+	}()
+}
+
+// touchLobbies refreshes the expiry of all lobbies that have players
+// connected to this instance. The indexes of all lobbies are refreshed as
+// well, since the slots reserved for disconnected players become free over
+// time.
+func touchLobbies() {
+	for _, lobby := range getLobbies() {
+		lobby.Synchronized(func() {
+			IndexLobbyUnsynchronized(lobby)
+		})
+		if !lobby.HasConnectedPlayers() {
+			continue
+		}
+		if err := Store.TouchLobby(lobby.LobbyID); err != nil {
+			log.Printf("Error while touching lobby %s : %s", lobby.LobbyID, err)
+		}
+	}
+}
+
+// sweepLobbies removes the expired lobbies and everything related to them
+// from the Store. Only the replica holding the sweeper lease does this.
+func sweepLobbies() {
+	holder, err := Replicas.AcquireSweeperLease(game.ReplicaID, LobbySweepInterval)
+	if err != nil {
+		log.Printf("Error while acquiring sweeper lease: %s", err)
+		return
+	}
+	if holder != game.ReplicaID {
+		return
+	}
+
+	expired, err := Store.ExpiredLobbies()
+	if err != nil {
+		log.Printf("Error while listing expired lobbies: %s", err)
+		return
+	}
+	for _, id := range expired {
+		log.Printf("Lobby %s has expired.", id)
+		DeleteLobby(id)
+	}
+}
+
+// evictLobbies drops the local copies of the lobbies that are gone from the
+// Store, either because they have expired or because they have been removed
+// by another replica. Expired lobbies are evicted right away, even if the
+// sweeper hasn't removed them yet, so that all replicas evict them at about
+// the same time. Lobbies with players connected to this instance are kept,
+// as they have been touched and will be saved again, as are lobbies that
+// haven't been flushed yet, see markLobbyDirty.
+func evictLobbies() {
+	ids, err := Store.LoadLobbyList()
+	if err != nil {
+		log.Printf("Error while loading lobby list: %s", err)
+		return
+	}
+	stored := make(map[string]bool)
+	for _, id := range ids {
+		stored[id] = true
+	}
+	expired, err := Store.ExpiredLobbies()
+	if err != nil {
+		log.Printf("Error while listing expired lobbies: %s", err)
+		return
+	}
+	for _, id := range expired {
+		delete(stored, id)
+	}
+
+	//Checking for connected players has to wait for the lobby, so this
+	//mustn't happen while holding the global state lock.
+	for _, lobby := range getLobbies() {
+		if !stored[lobby.LobbyID] && !lobby.HasConnectedPlayers() && !isLobbyDirty(lobby.LobbyID) {
+			evictLobby(lobby)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// createExpiringTestStores works like createTestStores, but additionally
+// returns a function for letting time pass, as miniredis doesn't expire
+// keys on its own.
+func createExpiringTestStores(t *testing.T) (map[string]LobbyStore, func(time.Duration)) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	fileStore, err := NewFileLobbyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]LobbyStore{
+		MemoryStore: NewMemoryLobbyStore(),
+		FileStore:   fileStore,
+		RedisStore:  NewRedisLobbyStore(&RedisConfig{Address: server.Addr()}),
+	}
+	elapse := func(duration time.Duration) {
+		time.Sleep(duration)
+		server.FastForward(duration)
+	}
+	return stores, elapse
+}
+
+func Test_LobbyStoreExpiry(t *testing.T) {
+	previousExpiry := LobbyExpiry
+	defer func() { LobbyExpiry = previousExpiry }()
+	LobbyExpiry = 300 * time.Millisecond
+
+	stores, elapse := createExpiringTestStores(t)
+	for name, store := range stores {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"abandoned", "touched"} {
+				if err := store.SaveLobby(createTestLobby(t, id)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			elapse(200 * time.Millisecond)
+			if err := store.TouchLobby("touched"); err != nil {
+				t.Fatal(err)
+			}
+			elapse(200 * time.Millisecond)
+
+			expired, err := store.ExpiredLobbies()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectLobbyIDs(t, expired, "abandoned")
+
+			if err := store.DeleteLobby("abandoned"); err != nil {
+				t.Fatal(err)
+			}
+			expired, err = store.ExpiredLobbies()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectLobbyIDs(t, expired)
+
+			ids, err := store.LoadLobbyList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectLobbyIDs(t, ids, "touched")
+		})
+	}
+}
+
+func Test_redisLobbyStoreExpiryLeavesNoKeys(t *testing.T) {
+	previousExpiry := LobbyExpiry
+	defer func() { LobbyExpiry = previousExpiry }()
+	LobbyExpiry = time.Second
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store := NewRedisLobbyStore(&RedisConfig{Address: server.Addr()})
+
+	lobby := createTestLobby(t, "expired")
+	if err := store.SaveLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendDrawing("expired", lobby.Turn, game.NewFillOperation(&game.Fill{X: 1, Y: 2})); err != nil {
+		t.Fatal(err)
+	}
+	server.FastForward(2 * time.Second)
+
+	//Without the document, the sweeper can't tell the wordpack or the turn
+	//of the lobby anymore.
+	expired, err := store.ExpiredLobbies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLobbyIDs(t, expired, "expired")
+	if err := store.DeleteLobby("expired"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range server.Keys() {
+		if key == indexVersionKey {
+			continue
+		}
+		if members, err := server.Members(key); err != nil || len(members) > 0 {
+			t.Errorf("expected key %s to be gone, but got %v", key, members)
+		}
+	}
+}
+
+func Test_sweepLobbies(t *testing.T) {
+	useTestStore(t)
+	previousReplicas, previousExpiry := Replicas, LobbyExpiry
+	defer func() { Replicas, LobbyExpiry = previousReplicas, previousExpiry }()
+	Replicas = NewMemoryReplicaRegistry()
+	//Lobbies expire right away.
+	LobbyExpiry = -time.Second
+	game.ReplicaID = "sweeper-replica"
+
+	if err := Store.SaveLobby(createTestLobby(t, "expired")); err != nil {
+		t.Fatal(err)
+	}
+
+	//Only the replica holding the sweeper lease removes expired lobbies.
+	if _, err := Replicas.AcquireSweeperLease("other-replica", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	sweepLobbies()
+	if ids := LoadLobbyList(); len(ids) != 1 {
+		t.Errorf("expected the lobby to be kept, but got %v", ids)
+	}
+
+	Store = NewMemoryLobbyStore()
+	Replicas = NewMemoryReplicaRegistry()
+	if err := Store.SaveLobby(createTestLobby(t, "expired")); err != nil {
+		t.Fatal(err)
+	}
+	sweepLobbies()
+	if ids := LoadLobbyList(); len(ids) != 0 {
+		t.Errorf("expected the lobby to be removed, but got %v", ids)
+	}
+}
+
+func Test_evictLobbies(t *testing.T) {
+	useTestStore(t)
+
+	stored := createTestLobby(t, "stored")
+	if err := Store.SaveLobby(stored); err != nil {
+		t.Fatal(err)
+	}
+	removed := createTestLobby(t, "removed")
+	connected := createTestLobby(t, "connected")
+	connected.GetPlayers()[0].Connected = true
+
+	putTestLobbies(stored, removed, connected)
+	defer clearTestLobbies()
+
+	evictLobbies()
+
+	var remaining []string
+	for _, lobby := range getLobbies() {
+		remaining = append(remaining, lobby.LobbyID)
+	}
+	sort.Strings(remaining)
+	expectLobbyIDs(t, remaining, "connected", "stored")
+
+	//Evicting only drops the local copy.
+	if _, err := Store.LoadLobby("stored"); err != nil {
+		t.Errorf("expected the stored lobby to be kept, but got %s", err)
+	}
+}
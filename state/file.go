@@ -0,0 +1,657 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// fileLobbyStore persists lobbies as files in a single directory. Each lobby
+// consists of a JSON document, an event log with one JSON event per line, a
+// file holding the last sequence number of the event log, a drawing with
+// one JSON drawing operation per line, a JSON document holding the player
+// registry and a file holding the lease. Lobbies that couldn't be loaded
+// are kept in a separate quarantine file.
+type fileLobbyStore struct {
+	mutex     *sync.Mutex
+	directory string
+}
+
+// NewFileLobbyStore creates a LobbyStore writing to the given directory. The
+// directory is created if it doesn't exist yet.
+func NewFileLobbyStore(directory string) (LobbyStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating store directory: %w", err)
+	}
+
+	return &fileLobbyStore{
+		mutex:     &sync.Mutex{},
+		directory: directory,
+	}, nil
+}
+
+// path returns the file path for the given lobby. Since lobby IDs can be
+// chosen by the user, they are escaped in order to stay inside the directory.
+func (store *fileLobbyStore) path(prefix, id, suffix string) string {
+	return escapedPath(store.directory, prefix, id, suffix)
+}
+
+func escapedPath(directory, prefix, id, suffix string) string {
+	escaped := url.PathEscape(id)
+	if escaped == "." || escaped == ".." {
+		escaped = strings.ReplaceAll(escaped, ".", "%2E")
+	}
+	return filepath.Join(directory, prefix+escaped+suffix)
+}
+
+func (store *fileLobbyStore) lobbyPath(id string) string {
+	return store.path("lobby-", id, ".json")
+}
+
+func (store *fileLobbyStore) eventsPath(id string) string {
+	return store.path("events-", id, ".jsonl")
+}
+
+func (store *fileLobbyStore) sequencePath(id string) string {
+	return store.path("sequence-", id, "")
+}
+
+func (store *fileLobbyStore) drawingPath(id string, turn int) string {
+	return store.path("drawing-", id, fmt.Sprintf("-%d.jsonl", turn))
+}
+
+func (store *fileLobbyStore) leasePath(id string) string {
+	return store.path("lease-", id, "")
+}
+
+func (store *fileLobbyStore) playersPath(id string) string {
+	return store.path("players-", id, ".json")
+}
+
+func (store *fileLobbyStore) quarantinePath(id string) string {
+	return store.path("quarantine-", id, ".json")
+}
+
+// writeFile replaces the file atomically, so that a crash never leaves a
+// partially written lobby behind.
+func writeFile(path string, data []byte) error {
+	temporary := path + ".tmp"
+	if err := ioutil.WriteFile(temporary, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// appendLine adds the data as a new line to the end of the file.
+func appendLine(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// readLines returns all lines of the file. A file that doesn't exist is
+// treated like an empty file.
+func readLines(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	//Events can get rather big, so we don't want to rely on the default
+	//line limit.
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *fileLobbyStore) SaveLobby(lobby *game.Lobby) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.compareAndSet(lobby, false)
+}
+
+func (store *fileLobbyStore) compareAndSet(lobby *game.Lobby, includeDrawing bool) error {
+	storedDocument, err := ioutil.ReadFile(store.lobbyPath(lobby.LobbyID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := checkVersion(lobby, string(storedDocument)); err != nil {
+		return err
+	}
+
+	document, version := lobbyDocument(lobby, includeDrawing)
+	if err := writeFile(store.lobbyPath(lobby.LobbyID), []byte(document)); err != nil {
+		return err
+	}
+	lobby.Version = version
+	return nil
+}
+
+func (store *fileLobbyStore) LoadLobby(id string) (*game.Lobby, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	value, err := ioutil.ReadFile(store.lobbyPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrLobbyNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entity, err := decodeLobbyEntity(string(value))
+	if err != nil {
+		return nil, err
+	}
+	drawing, err := readLines(store.drawingPath(id, entity.Turn))
+	if err != nil {
+		return nil, err
+	}
+	return assembleLobby(string(value), drawing)
+}
+
+func (store *fileLobbyStore) DeleteLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	paths := []string{store.lobbyPath(id), store.eventsPath(id), store.sequencePath(id), store.leasePath(id), store.playersPath(id)}
+	//Drawings of previous turns are cleared when the turn ends, therefore
+	//only the drawing of the current turn is left.
+	value, err := ioutil.ReadFile(store.lobbyPath(id))
+	if err == nil {
+		//Corrupt documents don't tell the turn, so the drawing is kept.
+		if entity, err := decodeLobbyEntity(string(value)); err == nil {
+			paths = append(paths, store.drawingPath(id, entity.Turn))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := removeFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexLobby does nothing, as the file store doesn't maintain any indexes.
+func (store *fileLobbyStore) IndexLobby(lobby *game.Lobby) error {
+	return nil
+}
+
+// ScanPublicLobbies reads all lobby documents, as the file store doesn't
+// maintain any indexes.
+func (store *fileLobbyStore) ScanPublicLobbies(filter LobbyFilter, cursor string, count int) ([]string, string, error) {
+	ids, err := store.LoadLobbyList()
+	if err != nil {
+		return nil, "", err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var matching []string
+	for _, id := range ids {
+		value, err := ioutil.ReadFile(store.lobbyPath(id))
+		if err != nil {
+			continue
+		}
+		entity, err := decodeLobbyEntity(string(value))
+		if err != nil {
+			continue
+		}
+		if indexEntryOf(game.UnmarshallLobby(entity)).matches(filter) {
+			matching = append(matching, id)
+		}
+	}
+	return pageLobbyIDs(matching, cursor, count)
+}
+
+func (store *fileLobbyStore) QuarantineLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := os.Rename(store.lobbyPath(id), store.quarantinePath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, path := range []string{store.eventsPath(id), store.sequencePath(id), store.leasePath(id), store.playersPath(id)} {
+		if err := removeFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *fileLobbyStore) LoadLobbyList() ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "lobby-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		id, err := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(name, "lobby-"), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// TouchLobby updates the modification time of the lobby document, which is
+// what the expiry of a lobby is based on.
+func (store *fileLobbyStore) TouchLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	err := os.Chtimes(store.lobbyPath(id), now, now)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *fileLobbyStore) ExpiredLobbies() ([]string, error) {
+	ids, err := store.LoadLobbyList()
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var expired []string
+	for _, id := range ids {
+		info, err := os.Stat(store.lobbyPath(id))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) > LobbyExpiry {
+			expired = append(expired, id)
+		}
+	}
+	return expired, nil
+}
+
+func (store *fileLobbyStore) SavePlayer(lobbyID string, player *game.PlayerEntity) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	players, err := store.loadPlayers(lobbyID)
+	if err != nil {
+		return err
+	}
+	players[player.ID] = player
+
+	data, err := json.Marshal(players)
+	if err != nil {
+		return err
+	}
+	return writeFile(store.playersPath(lobbyID), data)
+}
+
+func (store *fileLobbyStore) LoadPlayer(lobbyID, playerID string) (*game.PlayerEntity, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	players, err := store.loadPlayers(lobbyID)
+	if err != nil {
+		return nil, err
+	}
+	player, available := players[playerID]
+	if !available {
+		return nil, ErrPlayerNotStored
+	}
+	return player, nil
+}
+
+// LoadPlayerBySession searches the registry of the lobby, which is fine, as
+// lobbies only ever have a handful of players.
+func (store *fileLobbyStore) LoadPlayerBySession(lobbyID, userSession string) (*game.PlayerEntity, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	players, err := store.loadPlayers(lobbyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, player := range players {
+		if player.UserSession == userSession {
+			return player, nil
+		}
+	}
+	return nil, ErrPlayerNotStored
+}
+
+// loadPlayers reads the player registry of the lobby, which maps the player
+// IDs to the players.
+func (store *fileLobbyStore) loadPlayers(lobbyID string) (map[string]*game.PlayerEntity, error) {
+	players := make(map[string]*game.PlayerEntity)
+	data, err := ioutil.ReadFile(store.playersPath(lobbyID))
+	if os.IsNotExist(err) {
+		return players, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return players, json.Unmarshal(data, &players)
+}
+
+func (store *fileLobbyStore) NextLobbySequence(id string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return incrementCounter(store.sequencePath(id))
+}
+
+// incrementCounter increments the number held by the file, which is created
+// if it doesn't exist yet, and returns the new number.
+func incrementCounter(path string) (int64, error) {
+	var sequence int64
+	value, err := ioutil.ReadFile(path)
+	if err == nil {
+		sequence, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	sequence++
+	return sequence, writeFile(path, []byte(strconv.FormatInt(sequence, 10)))
+}
+
+func (store *fileLobbyStore) AppendLobbyEvent(event *LobbyEvent) (int, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := appendLine(store.eventsPath(event.LobbyID), data); err != nil {
+		return 0, err
+	}
+
+	lines, err := readLines(store.eventsPath(event.LobbyID))
+	return len(lines), err
+}
+
+func (store *fileLobbyStore) LoadLobbyEvents(id string) ([]*LobbyEvent, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.loadLobbyEvents(id)
+}
+
+func (store *fileLobbyStore) loadLobbyEvents(id string) ([]*LobbyEvent, error) {
+	lines, err := readLines(store.eventsPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*LobbyEvent, 0, len(lines))
+	for _, line := range lines {
+		var event LobbyEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+func (store *fileLobbyStore) SnapshotLobby(lobby *game.Lobby) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.compareAndSet(lobby, true); err != nil {
+		return err
+	}
+	return removeFile(store.eventsPath(lobby.LobbyID))
+}
+
+func (store *fileLobbyStore) AppendDrawing(lobbyID string, turn int, operation *game.DrawingOperation) error {
+	data, err := json.Marshal(operation)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return appendLine(store.drawingPath(lobbyID, turn), data)
+}
+
+func (store *fileLobbyStore) ClearDrawing(lobbyID string, turn int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return removeFile(store.drawingPath(lobbyID, turn))
+}
+
+// AcquireLease stores the lease as "<holder> <expiry in unix nanoseconds>".
+func (store *fileLobbyStore) AcquireLease(lobbyID, replicaID string, duration time.Duration) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return acquireFileLease(store.leasePath(lobbyID), replicaID, duration)
+}
+
+func (store *fileLobbyStore) LoadLeaseHolder(lobbyID string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return readLeaseHolder(store.leasePath(lobbyID))
+}
+
+// acquireFileLease acquires or renews the lease held in the given file,
+// unless it is held by another replica. The current holder is returned.
+func acquireFileLease(path, replicaID string, duration time.Duration) (string, error) {
+	holder, err := readLeaseHolder(path)
+	if err != nil {
+		return "", err
+	}
+	if holder != "" && holder != replicaID {
+		return holder, nil
+	}
+
+	expiry := time.Now().Add(duration).UnixNano()
+	return replicaID, writeFile(path, []byte(fmt.Sprintf("%s %d", replicaID, expiry)))
+}
+
+// readLeaseHolder returns the holder of the lease held in the given file,
+// unless the lease doesn't exist or has expired.
+func readLeaseHolder(path string) (string, error) {
+	value, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(value))
+	if len(fields) != 2 {
+		return "", fmt.Errorf("invalid lease '%s'", value)
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().UnixNano() >= expiry {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+// fileReplicaRegistry keeps the replica registry as files in a single
+// directory. Each registered replica has a JSON document of its own and a
+// file holding its generation counter.
+type fileReplicaRegistry struct {
+	mutex     *sync.Mutex
+	directory string
+}
+
+// NewFileReplicaRegistry creates a ReplicaRegistry writing to the given
+// directory, which may be shared with a file LobbyStore. The directory is
+// created if it doesn't exist yet.
+func NewFileReplicaRegistry(directory string) (ReplicaRegistry, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating registry directory: %w", err)
+	}
+
+	return &fileReplicaRegistry{
+		mutex:     &sync.Mutex{},
+		directory: directory,
+	}, nil
+}
+
+// registeredReplicaFile is the content of the file holding the entry of a
+// replica in the replica registry.
+type registeredReplicaFile struct {
+	Replica *Replica `json:"replica"`
+	// Expiry is given in unix nanoseconds.
+	Expiry int64 `json:"expiry"`
+}
+
+func (registry *fileReplicaRegistry) replicaPath(id string) string {
+	return escapedPath(registry.directory, "replica-", id, ".json")
+}
+
+func (registry *fileReplicaRegistry) generationPath(replicaID string) string {
+	return escapedPath(registry.directory, "generation-", replicaID, "")
+}
+
+func (registry *fileReplicaRegistry) SaveReplica(replica *Replica, duration time.Duration) error {
+	data, err := json.Marshal(registeredReplicaFile{
+		Replica: replica,
+		Expiry:  time.Now().Add(duration).UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return writeFile(registry.replicaPath(replica.ID), data)
+}
+
+func (registry *fileReplicaRegistry) LoadReplica(id string) (*Replica, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.loadReplica(registry.replicaPath(id))
+}
+
+func (registry *fileReplicaRegistry) loadReplica(path string) (*Replica, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrReplicaNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var registered registeredReplicaFile
+	if err := json.Unmarshal(data, &registered); err != nil {
+		return nil, err
+	}
+	if registered.Replica == nil || time.Now().UnixNano() >= registered.Expiry {
+		return nil, ErrReplicaNotStored
+	}
+	return registered.Replica, nil
+}
+
+func (registry *fileReplicaRegistry) LoadReplicaList() ([]*Replica, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(registry.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var replicas []*Replica
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "replica-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		replica, err := registry.loadReplica(filepath.Join(registry.directory, name))
+		if err == ErrReplicaNotStored {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+func (registry *fileReplicaRegistry) NextReplicaGeneration(replicaID string) (int64, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return incrementCounter(registry.generationPath(replicaID))
+}
+
+func (registry *fileReplicaRegistry) AcquireSweeperLease(replicaID string, duration time.Duration) (string, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return acquireFileLease(escapedPath(registry.directory, "lease-", sweeperLeaseID, ""), replicaID, duration)
+}
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gofrs/uuid"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ReplicaGeneration counts how often a replica with the same ID has been
+// started, see StartGeneration. It is 0 until the generation is known.
+var ReplicaGeneration int64
+
+// ResolveReplicaID determines the ID of this replica. An explicitly
+// configured ID takes precedence, otherwise the hostname is used if
+// requested, which is stable for example within a Kubernetes StatefulSet.
+// Without either, a random ID is generated, meaning that the replica can't
+// reclaim its lobbies after a restart.
+func ResolveReplicaID(configured string, fromHostname bool) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if fromHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("error determining hostname: %w", err)
+		}
+		if hostname == "" {
+			return "", fmt.Errorf("hostname is empty")
+		}
+		return hostname, nil
+	}
+	return uuid.Must(uuid.NewV4()).String(), nil
+}
+
+// StartGeneration increments the generation counter of this replica in the
+// replica registry, so that restarts of a replica with a stable ID can be
+// told apart.
+func StartGeneration() error {
+	generation, err := Replicas.NextReplicaGeneration(game.ReplicaID)
+	if err != nil {
+		return err
+	}
+
+	ReplicaGeneration = generation
+	if generation > 1 {
+		log.Printf("Replica %s has been restarted, now in generation %d", game.ReplicaID, generation)
+	}
+	return nil
+}
+
+// reclaimLobby makes this replica the reference replica again of a lobby it
+// has been the reference replica for before it has been restarted. If
+// another replica has taken over the lobby in the meantime, the lobby is
+// left to that replica.
+func reclaimLobby(lobby *game.Lobby) {
+	holder, err := Store.AcquireLease(lobby.LobbyID, game.ReplicaID, LeaseDuration)
+	if err != nil {
+		log.Printf("Error while reclaiming lobby %s : %s", lobby.LobbyID, err)
+		return
+	}
+	if holder != game.ReplicaID {
+		log.Printf("Lobby %s has been taken over by replica %s", lobby.LobbyID, holder)
+		lobby.Synchronized(func() {
+			lobby.ReferenceReplicaID = holder
+		})
+		return
+	}
+
+	log.Printf("Reclaiming lobby %s", lobby.LobbyID)
+	subscribeLobbyInput(lobby)
+}
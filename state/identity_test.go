@@ -0,0 +1,120 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func Test_ResolveReplicaID(t *testing.T) {
+	if id, err := ResolveReplicaID("configured", true); err != nil || id != "configured" {
+		t.Errorf("expected the configured ID, but got %s (%v)", id, err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := ResolveReplicaID("", true); err != nil || id != hostname {
+		t.Errorf("expected the hostname %s, but got %s (%v)", hostname, id, err)
+	}
+
+	first, err := ResolveReplicaID("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ResolveReplicaID("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == "" || first == second {
+		t.Errorf("expected distinct random IDs, but got %s and %s", first, second)
+	}
+}
+
+func Test_ReplicaRegistryGeneration(t *testing.T) {
+	registries, _ := createTestRegistries(t)
+	for name, registry := range registries {
+		registry := registry
+		t.Run(name, func(t *testing.T) {
+			for expected := int64(1); expected <= 3; expected++ {
+				generation, err := registry.NextReplicaGeneration("replica")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if generation != expected {
+					t.Errorf("expected generation %d, but got %d", expected, generation)
+				}
+			}
+
+			if generation, err := registry.NextReplicaGeneration("other"); err != nil || generation != 1 {
+				t.Errorf("expected separate counters, but got %d (%v)", generation, err)
+			}
+		})
+	}
+}
+
+func Test_LoadLobbiesReclaimsLobbies(t *testing.T) {
+	useTestStore(t)
+	previousReplicas := Replicas
+	defer func() { Replicas = previousReplicas }()
+	Replicas = NewMemoryReplicaRegistry()
+	game.ReplicaID = "stable"
+	defer clearTestLobbies()
+	published := usePublishingWriters(t, "reclaimed")
+
+	//The input of the reclaimed lobby is handled the way the api package
+	//handles it, so that the responses can be checked.
+	previousHandler := LobbyInputHandler
+	defer func() { LobbyInputHandler = previousHandler }()
+	LobbyInputHandler = func(data []byte) error {
+		lobby := GetLobby("reclaimed")
+		received := &game.GameEvent{}
+		if err := json.Unmarshal(data, received); err != nil {
+			return err
+		}
+		return lobby.HandleEvent(data, received, lobby.GetPlayers()[0], NoSaveLobby)
+	}
+
+	//Both lobbies have been created by the previous generation of this
+	//replica, but one of them has been taken over in the meantime.
+	for _, id := range []string{"reclaimed", "taken-over"} {
+		lobby := createTestLobby(t, id)
+		lobby.ReferenceReplicaID = "stable"
+		if err := Store.SaveLobby(lobby); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Store.AcquireLease("taken-over", "other", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := StartGeneration(); err != nil {
+		t.Fatal(err)
+	}
+	LoadLobbies()
+
+	if holder, _ := Store.LoadLeaseHolder("reclaimed"); holder != "stable" {
+		t.Errorf("expected the lease to be reclaimed, but it is held by '%s'", holder)
+	}
+	if lobby := GetLobby("reclaimed"); lobby == nil || !lobby.IsReferenceReplica() {
+		t.Error("expected to be the reference replica of the reclaimed lobby")
+	}
+	if lobby := GetLobby("taken-over"); lobby == nil || lobby.ReferenceReplicaID != "other" {
+		t.Error("expected the lobby to be left to the other replica")
+	}
+	defer RemoveLobby("reclaimed")
+	defer RemoveLobby("taken-over")
+
+	//The responses to the input of the reclaimed lobby have to reach the
+	//players again.
+	if err := PublishLobbyInput("reclaimed", []byte(`{"type":"message","data":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if event := awaitPublishedEvent(t, published, "message"); event == nil {
+		t.Error("expected the message to be published")
+	}
+}
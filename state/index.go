@@ -0,0 +1,323 @@
+package state
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// LobbyScanCount is the amount of lobbies requested per batch when listing
+// lobbies. It is only a hint, stores might return more or less.
+var LobbyScanCount = 100
+
+// LobbyFilter narrows down the public lobbies listed by
+// LobbyStore.ScanPublicLobbies.
+type LobbyFilter struct {
+	// Wordpack only lists lobbies using the given wordpack, unless empty.
+	Wordpack string
+	// FreeSlots only lists lobbies that have a free player slot.
+	FreeSlots bool
+}
+
+// lobbyIndexEntry holds the properties of a lobby the stores index it by.
+// The index reflects the state of the lobby as of the last save, so it has
+// to be checked again once the lobby has been loaded.
+type lobbyIndexEntry struct {
+	public    bool
+	wordpack  string
+	freeSlots bool
+}
+
+func indexEntryOf(lobby *game.Lobby) lobbyIndexEntry {
+	return lobbyIndexEntry{
+		public:    lobby.IsPublic(),
+		wordpack:  lobby.Wordpack,
+		freeSlots: lobby.HasFreePlayerSlot(),
+	}
+}
+
+func (entry lobbyIndexEntry) matches(filter LobbyFilter) bool {
+	return entry.public &&
+		(filter.Wordpack == "" || entry.wordpack == filter.Wordpack) &&
+		(!filter.FreeSlots || entry.freeSlots)
+}
+
+// IndexLobbyUnsynchronized updates the indexes of the Store according to the
+// current players of the lobby. Players joining, leaving or giving up their
+// reserved slot don't necessarily result in the lobby being saved, which
+// would update the indexes otherwise, for example in EVENTS persistence
+// mode. This is done by the reference replica of the lobby only and has to
+// be called on the event loop of the lobby.
+func IndexLobbyUnsynchronized(lobby *game.Lobby) {
+	if !lobby.IsReferenceReplica() {
+		return
+	}
+	if err := Store.IndexLobby(lobby); err != nil {
+		log.Printf("Error while indexing lobby %s : %s", lobby.LobbyID, err)
+	}
+}
+
+// FindPublicLobbies returns the public lobbies matching the filter. Only the
+// lobbies listed by the index of the Store are loaded, lobbies held by this
+// instance are taken as they are.
+func FindPublicLobbies(filter LobbyFilter) []*game.Lobby {
+	var found []*game.Lobby
+	for cursor := ""; ; {
+		ids, next, err := Store.ScanPublicLobbies(filter, cursor, LobbyScanCount)
+		if err != nil {
+			log.Printf("Error while listing public lobbies: %s", err)
+			break
+		}
+
+		for _, id := range ids {
+			lobby := GetLobby(id)
+			if lobby == nil {
+				lobby = LoadLobby(id)
+			}
+			if lobby != nil && indexEntryOf(lobby).matches(filter) {
+				found = append(found, lobby)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return found
+}
+
+// pageLobbyIDs returns the batch of IDs starting at the cursor, which is an
+// offset into the sorted IDs. This is used by the stores that don't have
+// any native way of iterating.
+func pageLobbyIDs(ids []string, cursor string, count int) ([]string, string, error) {
+	offset := 0
+	if cursor != "" {
+		parsed, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		offset = parsed
+	}
+	if offset >= len(ids) {
+		return nil, "", nil
+	}
+
+	sort.Strings(ids)
+	end := offset + count
+	if count <= 0 || end >= len(ids) {
+		return ids[offset:], "", nil
+	}
+	return ids[offset:end], strconv.Itoa(end), nil
+}
+
+// Keys of the sets the redis store indexes lobbies by. Only public lobbies
+// are indexed by wordpack and free slots, as only those are ever listed.
+const (
+	allLobbiesIndexKey    = "index-lobbies"
+	publicLobbiesIndexKey = "index-public"
+	freeLobbiesIndexKey   = "index-public-free"
+	// wordpacksIndexKey is a hash telling the wordpack index of each
+	// lobby, so that it can be unindexed once its document has expired.
+	wordpacksIndexKey = "index-wordpacks"
+	// indexVersionKey marks that the indexes have been built, since lobbies
+	// stored before the indexes existed have to be added once.
+	indexVersionKey = "index-version"
+)
+
+func wordpackIndexKey(wordpack string) string {
+	return "index-public-wordpack-" + wordpack
+}
+
+// indexCommands updates the indexes according to the current state of the
+// lobby. They are meant to be executed along with saving the lobby.
+func indexCommands(lobby *game.Lobby) [][]interface{} {
+	id := lobby.LobbyID
+	entry := indexEntryOf(lobby)
+
+	commands := [][]interface{}{
+		{"SADD", allLobbiesIndexKey, id},
+		{"HSET", wordpacksIndexKey, id, entry.wordpack},
+	}
+	if entry.public {
+		commands = append(commands,
+			[]interface{}{"SADD", publicLobbiesIndexKey, id},
+			[]interface{}{"SADD", wordpackIndexKey(entry.wordpack), id})
+	} else {
+		commands = append(commands,
+			[]interface{}{"SREM", publicLobbiesIndexKey, id},
+			[]interface{}{"SREM", wordpackIndexKey(entry.wordpack), id})
+	}
+	if entry.public && entry.freeSlots {
+		commands = append(commands, []interface{}{"SADD", freeLobbiesIndexKey, id})
+	} else {
+		commands = append(commands, []interface{}{"SREM", freeLobbiesIndexKey, id})
+	}
+	return commands
+}
+
+// unindexCommands removes the lobby from all indexes, see indexedWordpack.
+func unindexCommands(id, wordpack string) [][]interface{} {
+	return [][]interface{}{
+		{"SREM", allLobbiesIndexKey, id},
+		{"SREM", publicLobbiesIndexKey, id},
+		{"SREM", freeLobbiesIndexKey, id},
+		{"SREM", wordpackIndexKey(wordpack), id},
+		{"HDEL", wordpacksIndexKey, id},
+	}
+}
+
+// indexedWordpack returns the wordpack the lobby has been indexed by. Unlike
+// the document of the lobby, this is still known once the lobby has expired.
+// Lobbies that haven't been saved since the wordpacks have been indexed
+// result in an empty wordpack.
+func indexedWordpack(conn redis.Conn, id string) (string, error) {
+	wordpack, err := redis.String(conn.Do("HGET", wordpacksIndexKey, id))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return wordpack, err
+}
+
+func (store *redisLobbyStore) IndexLobby(lobby *game.Lobby) error {
+	store.ensureIndexes()
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	//Lobbies that have been removed mustn't be listed again.
+	stored, err := redis.Bool(conn.Do("EXISTS", lobbyKey(lobby.LobbyID)))
+	if err != nil || !stored {
+		return err
+	}
+	conn.Send("MULTI")
+	for _, command := range indexCommands(lobby) {
+		conn.Send(command[0].(string), command[1:]...)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// ensureIndexes adds the lobbies stored before the indexes existed to the
+// indexes. This only happens once per store, the documents are iterated via
+// SCAN, so redis isn't blocked.
+func (store *redisLobbyStore) ensureIndexes() {
+	store.indexOnce.Do(func() {
+		if err := store.buildIndexes(); err != nil {
+			log.Printf("Error while building lobby indexes: %s", err)
+		}
+	})
+}
+
+func (store *redisLobbyStore) buildIndexes() error {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	built, err := redis.Bool(conn.Do("EXISTS", indexVersionKey))
+	if err != nil || built {
+		return err
+	}
+
+	for cursor := "0"; ; {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", lobbyKey("*"), "COUNT", LobbyScanCount))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+
+		for _, key := range keys {
+			value, err := redis.String(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			entity, err := decodeLobbyEntity(value)
+			if err != nil {
+				//Corrupt lobbies are quarantined once they are loaded.
+				conn.Do("SADD", allLobbiesIndexKey, strings.TrimPrefix(key, lobbyKey("")))
+				continue
+			}
+			for _, command := range indexCommands(game.UnmarshallLobby(entity)) {
+				conn.Send(command[0].(string), command[1:]...)
+			}
+			if err := conn.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	_, err = conn.Do("SET", indexVersionKey, 1)
+	return err
+}
+
+// scanSet returns a batch of the members of the set, see SSCAN. The returned
+// cursor is empty once the iteration is complete.
+func scanSet(conn redis.Conn, key, cursor string, count int) ([]string, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	reply, err := redis.Values(conn.Do("SSCAN", key, cursor, "COUNT", count))
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	members, err := redis.Strings(reply[1], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if next == "0" {
+		next = ""
+	}
+	return members, next, nil
+}
+
+func (store *redisLobbyStore) ScanPublicLobbies(filter LobbyFilter, cursor string, count int) ([]string, string, error) {
+	store.ensureIndexes()
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	key := publicLobbiesIndexKey
+	if filter.Wordpack != "" {
+		key = wordpackIndexKey(filter.Wordpack)
+	} else if filter.FreeSlots {
+		key = freeLobbiesIndexKey
+	}
+	ids, next, err := scanSet(conn, key, cursor, count)
+	if err != nil || !filter.FreeSlots || key == freeLobbiesIndexKey {
+		return ids, next, err
+	}
+
+	//Lobbies of a wordpack still have to be checked for free slots.
+	for _, id := range ids {
+		conn.Send("SISMEMBER", freeLobbiesIndexKey, id)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, "", err
+	}
+	free := make([]string, 0, len(ids))
+	for _, id := range ids {
+		member, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return nil, "", err
+		}
+		if member {
+			free = append(free, id)
+		}
+	}
+	return free, next, nil
+}
@@ -0,0 +1,186 @@
+package state
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func createIndexTestLobby(t *testing.T, id, wordpack string, public bool, maxPlayers int) *game.Lobby {
+	_, lobby, err := game.CreateLobby("owner", wordpack, public, 120, 4, maxPlayers, 0, 1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobby.LobbyID = id
+	return lobby
+}
+
+// scanAllPublicLobbies iterates with a small batch size, so that the
+// iteration spans multiple batches.
+func scanAllPublicLobbies(t *testing.T, store LobbyStore, filter LobbyFilter) []string {
+	var ids []string
+	for cursor, iterations := "", 0; ; iterations++ {
+		if iterations > 100 {
+			t.Fatal("iteration doesn't end")
+		}
+		batch, next, err := store.ScanPublicLobbies(filter, cursor, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, batch...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func expectLobbyIDs(t *testing.T, actual []string, expected ...string) {
+	if len(actual) != len(expected) {
+		t.Errorf("expected lobbies %v, but got %v", expected, actual)
+		return
+	}
+	for index := range expected {
+		if actual[index] != expected[index] {
+			t.Errorf("expected lobbies %v, but got %v", expected, actual)
+			return
+		}
+	}
+}
+
+func Test_LobbyStoreIndexes(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			englishFree := createIndexTestLobby(t, "english-free", "english", true, 4)
+			englishFull := createIndexTestLobby(t, "english-full", "english", true, 1)
+			germanFree := createIndexTestLobby(t, "german-free", "german", true, 4)
+			private := createIndexTestLobby(t, "private", "english", false, 4)
+			for _, lobby := range []*game.Lobby{englishFree, englishFull, germanFree, private} {
+				if err := store.SaveLobby(lobby); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{}),
+				"english-free", "english-full", "german-free")
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{Wordpack: "english"}),
+				"english-free", "english-full")
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{FreeSlots: true}),
+				"english-free", "german-free")
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{Wordpack: "english", FreeSlots: true}),
+				"english-free")
+
+			//Changes are reflected once the lobby has been saved.
+			englishFree.JoinPlayer("second")
+			englishFree.JoinPlayer("third")
+			englishFree.JoinPlayer("fourth")
+			private.Public = true
+			for _, lobby := range []*game.Lobby{englishFree, private} {
+				if err := store.SaveLobby(lobby); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{Wordpack: "english", FreeSlots: true}),
+				"private")
+
+			if err := store.DeleteLobby("german-free"); err != nil {
+				t.Fatal(err)
+			}
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{FreeSlots: true}), "private")
+
+			ids, err := store.LoadLobbyList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(ids)
+			expectLobbyIDs(t, ids, "english-free", "english-full", "private")
+		})
+	}
+}
+
+func Test_IndexLobbyUnsynchronized(t *testing.T) {
+	useTestStore(t)
+	game.ReplicaID = "local"
+
+	for name, store := range createTestStores(t) {
+		//The file store reads the documents instead of keeping indexes.
+		if name == FileStore {
+			continue
+		}
+		store := store
+		t.Run(name, func(t *testing.T) {
+			Store = store
+			lobby := createIndexTestLobby(t, "joined", "english", true, 2)
+			lobby.ReferenceReplicaID = "local"
+			if err := store.SaveLobby(lobby); err != nil {
+				t.Fatal(err)
+			}
+			unstored := createIndexTestLobby(t, "unstored", "english", true, 2)
+			unstored.ReferenceReplicaID = "local"
+
+			//Joining doesn't save the lobby, unless it's snapshotted.
+			lobby.Synchronized(func() {
+				lobby.JoinPlayer("second")
+				IndexLobbyUnsynchronized(lobby)
+			})
+			unstored.Synchronized(func() {
+				IndexLobbyUnsynchronized(unstored)
+			})
+			lobby.Stop()
+			unstored.Stop()
+
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{FreeSlots: true}))
+			expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{}), "joined")
+		})
+	}
+}
+
+func Test_RedisLobbyStoreBuildsIndexes(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	//Lobbies stored before the indexes existed.
+	lobby := createIndexTestLobby(t, "existing", "english", true, 4)
+	document, _ := lobbyDocument(lobby, false)
+	if err := server.Set(lobbyKey("existing"), document); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewRedisLobbyStore(&RedisConfig{Address: server.Addr()})
+	ids, err := store.LoadLobbyList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLobbyIDs(t, ids, "existing")
+	expectLobbyIDs(t, scanAllPublicLobbies(t, store, LobbyFilter{Wordpack: "english", FreeSlots: true}), "existing")
+}
+
+func Test_FindPublicLobbies(t *testing.T) {
+	useTestStore(t)
+
+	stored := createIndexTestLobby(t, "stored", "english", true, 4)
+	if err := Store.SaveLobby(stored); err != nil {
+		t.Fatal(err)
+	}
+	//The index is outdated, as the lobby has become private since.
+	outdated := createIndexTestLobby(t, "outdated", "english", true, 4)
+	if err := Store.SaveLobby(outdated); err != nil {
+		t.Fatal(err)
+	}
+	outdated.Public = false
+	putTestLobbies(outdated)
+	defer RemoveLobby("outdated")
+
+	found := FindPublicLobbies(LobbyFilter{Wordpack: "english"})
+	if len(found) != 1 || found[0].LobbyID != "stored" {
+		t.Errorf("expected only the stored lobby, but got %v", found)
+	}
+}
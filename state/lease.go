@@ -0,0 +1,159 @@
+package state
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// LeaseDuration defines how long a replica stays the reference replica
+	// of a lobby without renewing its lease. Once the lease has expired,
+	// another replica can take over the lobby.
+	LeaseDuration = 15 * time.Second
+	// LeaseRenewalInterval defines how often leases are renewed. This has
+	// to be considerably shorter than LeaseDuration.
+	LeaseRenewalInterval = 5 * time.Second
+)
+
+// StartLeaseKeeper periodically renews the leases of all lobbies this replica
+// is the reference for and takes over lobbies whose lease has expired.
+func StartLeaseKeeper() {
+	go func() {
+		ticker := time.NewTicker(LeaseRenewalInterval)
+		for {
+			<-ticker.C
+			maintainLeases()
+		}
+	}()
+}
+
+// acquireLease acquires the lease for a lobby this replica has just created.
+func acquireLease(lobby *game.Lobby) {
+	if _, err := Store.AcquireLease(lobby.LobbyID, game.ReplicaID, LeaseDuration); err != nil {
+		log.Printf("Error while acquiring lease of lobby %s : %s", lobby.LobbyID, err)
+	}
+}
+
+func maintainLeases() {
+	for _, lobbyID := range LoadLobbyList() {
+		holder, err := Store.AcquireLease(lobbyID, game.ReplicaID, LeaseDuration)
+		if err != nil {
+			log.Printf("Error while renewing lease of lobby %s : %s", lobbyID, err)
+			continue
+		}
+
+		lobby := GetLobby(lobbyID)
+		if holder != game.ReplicaID {
+			//Another replica might have taken over in case we failed to
+			//renew the lease in time.
+			if lobby != nil && lobby.View().IsReferenceReplica() {
+				log.Printf("Lost lease of lobby %s to replica %s", lobbyID, holder)
+				lobby.Synchronized(func() {
+					lobby.ReferenceReplicaID = holder
+				})
+				unsubscribeLobbyInput(lobbyID)
+			}
+			continue
+		}
+
+		if lobby == nil {
+			lobby = loadLobbyForTakeOver(lobbyID)
+			if lobby == nil {
+				continue
+			}
+		} else if view := lobby.View(); view.IsReferenceReplica() {
+			continue
+		} else if stored := LoadLobby(lobbyID); stored != nil && stored.Version > view.Version {
+			lobby.Refresh(stored)
+		}
+
+		takeOver(lobby)
+	}
+}
+
+// loadLobbyForTakeOver loads a lobby unknown to this replica, so that it can
+// be taken over.
+func loadLobbyForTakeOver(lobbyID string) *game.Lobby {
+	lobby := LoadLobby(lobbyID)
+	if lobby == nil {
+		return nil
+	}
+
+	globalStateMutex.Lock()
+	defer globalStateMutex.Unlock()
+
+	//The lobby might have been loaded concurrently.
+	if existing := lobbies[lobbyID]; existing != nil {
+		return existing
+	}
+	putLobby(lobby)
+	return lobby
+}
+
+func takeOver(lobby *game.Lobby) {
+	log.Printf("Taking over lobby %s from replica %s", lobby.LobbyID, lobby.View().ReferenceReplicaID)
+	var err error
+	lobby.Synchronized(func() {
+		lobby.TakeOverUnsynchronized(context.Background())
+		err = persistLobby(lobby)
+	})
+	//Yet another replica has taken over the lobby in the meantime.
+	if err == ErrVersionConflict {
+		return
+	}
+	subscribeLobbyInput(lobby)
+}
+
+// persistLobby writes the complete lobby to the Store according to the
+// PersistenceMode.
+func persistLobby(lobby *game.Lobby) error {
+	switch PersistenceMode {
+	case "BASIC":
+		return SaveLobby(lobby)
+	case "EVENTS":
+		return SnapshotLobby(lobby)
+	}
+	return nil
+}
+
+// resolveVersionConflictUnsynchronized deals with a lobby that couldn't be
+// persisted, as a newer version of it has been stored in the meantime. If
+// this replica still holds the lease of the lobby, the newer version has
+// been written by a replica that hasn't noticed losing the lease yet. Its
+// version is adopted, so that persisting the lobby again overwrites it, and
+// true is returned. Otherwise, this replica steps down and the lobby is
+// refreshed from the Store. This has to be called on the event loop of the
+// lobby.
+func resolveVersionConflictUnsynchronized(lobby *game.Lobby) bool {
+	holder, err := Store.LoadLeaseHolder(lobby.LobbyID)
+	if err != nil {
+		log.Printf("Error while loading lease holder of lobby %s : %s", lobby.LobbyID, err)
+		return false
+	}
+	stored := LoadLobby(lobby.LobbyID)
+	if stored == nil {
+		return false
+	}
+
+	if holder == game.ReplicaID {
+		lobby.Version = stored.Version
+		return true
+	}
+
+	log.Printf("Lobby %s has been modified by replica %s, refreshing it", lobby.LobbyID, holder)
+	wasReferenceReplica := lobby.IsReferenceReplica()
+	lobby.RefreshUnsynchronized(stored)
+	if holder != "" {
+		lobby.ReferenceReplicaID = holder
+	}
+	forgetDirtyLobby(lobby.LobbyID)
+	if wasReferenceReplica && !lobby.IsReferenceReplica() {
+		//Unsubscribing waits for the input being handled, which might be
+		//the very event that has caused the lobby to be persisted.
+		go unsubscribeLobbyInput(lobby.LobbyID)
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// usePublishingWriters makes the lobbies loaded from the Store publish their
+// events to their output channel, the way the api package does, and returns
+// the events published for the given lobby.
+func usePublishingWriters(t *testing.T, lobbyID string) <-chan *game.GameEvent {
+	previousPubSub, previousBus, previousWriters := PubSub, MessageBus, LobbyWriters
+	t.Cleanup(func() { PubSub, MessageBus, LobbyWriters = previousPubSub, previousBus, previousWriters })
+	PubSub = true
+	MessageBus = NewInProcessBus()
+
+	publish := func(ctx context.Context, lobby *game.Lobby, player *game.Player, object interface{}) error {
+		data, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		return PublishLobbyOutput(lobby.LobbyID, data)
+	}
+	LobbyWriters = func(lobby *game.Lobby) {
+		lobby.WriteJSON = publish
+		lobby.BroadcastJSON = func(ctx context.Context, lobby *game.Lobby, players []*game.Player, object interface{}) error {
+			return publish(ctx, lobby, nil, object)
+		}
+	}
+
+	published := make(chan *game.GameEvent, 100)
+	unsubscribe, err := MessageBus.Subscribe(LobbyOutputChannel(lobbyID), func(data []byte) error {
+		event := &game.GameEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			t.Error(err)
+		}
+		published <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+	return published
+}
+
+// awaitPublishedEvent waits for an event of the given type to be published.
+func awaitPublishedEvent(t *testing.T, published <-chan *game.GameEvent, eventType string) *game.GameEvent {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-published:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("expected a %s event to be published", eventType)
+			return nil
+		}
+	}
+}
+
+func Test_maintainLeasesTakesOver(t *testing.T) {
+	useTestStore(t)
+	game.ReplicaID = "local"
+	defer clearTestLobbies()
+	published := usePublishingWriters(t, "abandoned")
+
+	//The replica that has created the lobby is gone, so its lease has
+	//expired.
+	lobby := createTestLobby(t, "abandoned")
+	lobby.ReferenceReplicaID = "gone"
+	if err := Store.SaveLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	maintainLeases()
+	defer RemoveLobby("abandoned")
+
+	if lobby := GetLobby("abandoned"); lobby == nil || !lobby.IsReferenceReplica() {
+		t.Fatal("expected the lobby to be taken over")
+	}
+	event := awaitPublishedEvent(t, published, "system-message")
+	if event.Data != "The server hosting this lobby has changed." {
+		t.Errorf("expected the players to be told about the takeover, but got %v", event.Data)
+	}
+}
+
+func Test_SaveLobbyVersionConflict(t *testing.T) {
+	saveTwice := func(t *testing.T, holder string) (*game.Lobby, error, error) {
+		useTestStore(t)
+		game.ReplicaID = "local"
+		lobby := createTestLobby(t, "conflict")
+		lobby.ReferenceReplicaID = "local"
+		if err := Store.SaveLobby(lobby); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Store.AcquireLease("conflict", holder, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		//Another replica has written the lobby in the meantime.
+		other, err := Store.LoadLobby("conflict")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Round = 3
+		if err := Store.SaveLobby(other); err != nil {
+			t.Fatal(err)
+		}
+
+		var first, second error
+		lobby.Synchronized(func() {
+			first = SaveLobby(lobby)
+			second = SaveLobby(lobby)
+		})
+		lobby.Stop()
+		return lobby, first, second
+	}
+
+	t.Run("lease held", func(t *testing.T) {
+		lobby, first, second := saveTwice(t, "local")
+		if first != nil || second != nil {
+			t.Fatalf("expected the stale version to be overwritten, but got %v and %v", first, second)
+		}
+		stored, err := Store.LoadLobby("conflict")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Round == 3 || stored.Version != lobby.Version {
+			t.Errorf("expected the lobby to be stored as version %d, but got round %d of version %d", lobby.Version, stored.Round, stored.Version)
+		}
+	})
+
+	t.Run("lease lost", func(t *testing.T) {
+		lobby, first, second := saveTwice(t, "remote")
+		if first != ErrVersionConflict {
+			t.Errorf("expected a conflict, but got %v", first)
+		}
+		if second != nil {
+			t.Errorf("expected the refreshed lobby not to conflict anymore, but got %v", second)
+		}
+		if lobby.IsReferenceReplica() || lobby.ReferenceReplicaID != "remote" {
+			t.Errorf("expected the lobby to be handed to the lease holder, but got %s", lobby.ReferenceReplicaID)
+		}
+		if lobby.Round != 3 {
+			t.Errorf("expected the lobby to be refreshed, but got round %d", lobby.Round)
+		}
+	})
+}
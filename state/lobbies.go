@@ -1,100 +1,268 @@
 package state
 
 import (
+	"context"
 	"log"
 	"sync"
-	"time"
 
 	"github.com/guillaumerosinosky/scribble.rs/game"
 )
 
 var (
-	globalStateMutex               = &sync.Mutex{}
-	lobbies          []*game.Lobby = nil
+	// globalStateMutex guards the lobbies held by this instance and the
+	// indexes of their players. Lookups only need the read lock. Neither the
+	// Store nor the lobbies themselves are accessed while holding the lock,
+	// so that a slow Store or a busy lobby can't hold up other requests.
+	globalStateMutex = &sync.RWMutex{}
+	// lobbies holds the lobbies by their ID.
+	lobbies = make(map[string]*game.Lobby)
+	// lobbyOrder holds the same lobbies in the order they have been added,
+	// so that listing them, for example in the lobby browser, is stable.
+	lobbyOrder []*game.Lobby
+	// lobbiesByPlayerID and lobbiesBySession map players to the ID of their
+	// lobby, see indexPlayer.
+	lobbiesByPlayerID = make(map[string]string)
+	lobbiesBySession  = make(map[string]string)
+	// indexedPlayers are the players indexed per lobby, so that they can be
+	// dropped from the indexes along with the lobby.
+	indexedPlayers = make(map[string][]indexedPlayer)
 )
 
-func init() {
-	//Task to clean up empty lobbies.
-	go func() {
-		lobbyCleanupTicker := time.NewTicker(90 * time.Second)
-		for {
-			<-lobbyCleanupTicker.C
-
-			globalStateMutex.Lock()
-
-			for index := len(lobbies) - 1; index >= 0; index-- {
-				lobby := lobbies[index]
-				if lobby.HasConnectedPlayers() {
-					continue
-				}
-
-				disconnectTime := lobby.LastPlayerDisconnectTime
-				if disconnectTime == nil || time.Since(*disconnectTime) >= 75*time.Second {
-					removeLobbyByIndex(index)
-				}
+type indexedPlayer struct {
+	id          string
+	userSession string
+}
+
+// LoadLobbies synchronizes the lobbies with the Store. Lobbies that have been
+// removed from the Store are dropped and lobbies not known yet are loaded.
+// Lobbies that are already held by this instance are kept, since they might
+// have players connected to them. However, if this instance isn't the
+// reference for such a lobby and a newer version has been stored, its state
+// is refreshed. Newly loaded lobbies this replica has been the reference
+// replica for before restarting are reclaimed and their turn timers are
+// resumed.
+func LoadLobbies() {
+	//Resuming might end the turn, which publishes events, therefore this
+	//mustn't happen while holding the global state lock.
+	for _, lobby := range synchronizeLobbies() {
+		resumeLobby(lobby)
+	}
+}
+
+// SynchronizeLobby works like LoadLobbies, but only loads or refreshes the
+// lobby with the given ID, which is all a request for a single lobby needs.
+func SynchronizeLobby(id string) {
+	if lobby := GetLobby(id); lobby != nil {
+		refreshLobby(lobby)
+		return
+	}
+
+	lobby := LoadLobby(id)
+	if lobby == nil {
+		return
+	}
+	globalStateMutex.Lock()
+	//The lobby might have been added in the meantime.
+	added := lobbies[id] == nil
+	if added {
+		putLobby(lobby)
+	}
+	globalStateMutex.Unlock()
+
+	if added {
+		resumeLobby(lobby)
+	}
+}
+
+// resumeLobby reclaims a newly loaded lobby, if this replica has been its
+// reference replica before restarting, and resumes its turn timer.
+func resumeLobby(lobby *game.Lobby) {
+	if lobby.View().IsReferenceReplica() {
+		reclaimLobby(lobby)
+	}
+	lobby.RestartTimeTicker(context.Background())
+}
+
+// refreshLobby updates a lobby held by another reference replica, if a
+// newer version of it has been stored.
+func refreshLobby(lobby *game.Lobby) {
+	if view := lobby.View(); !view.IsReferenceReplica() {
+		if stored := LoadLobby(lobby.LobbyID); stored != nil && stored.Version > view.Version {
+			lobby.Refresh(stored)
+		}
+	}
+}
+
+// synchronizeLobbies does the work of LoadLobbies and returns the lobbies
+// that have been newly loaded.
+func synchronizeLobbies() []*game.Lobby {
+	//Without the list, all lobbies would be dropped, which must not happen
+	//just because the Store is unavailable.
+	lobbyList, err := Store.LoadLobbyList()
+	if err != nil {
+		log.Printf("Error while loading lobby list: %s", err)
+		return nil
+	}
+
+	//Loading from the Store takes a while, so the lock is only held for
+	//applying the changes afterwards.
+	listed := make(map[string]bool, len(lobbyList))
+	var loaded []*game.Lobby
+	for _, lobbyID := range lobbyList {
+		listed[lobbyID] = true
+		lobby := GetLobby(lobbyID)
+		if lobby == nil {
+			if lobby = LoadLobby(lobbyID); lobby != nil {
+				loaded = append(loaded, lobby)
 			}
+		} else {
+			refreshLobby(lobby)
+		}
+	}
 
-			globalStateMutex.Unlock()
+	globalStateMutex.Lock()
+	var newLobbies, dropped []*game.Lobby
+	for _, lobby := range loaded {
+		//The lobby might have been added in the meantime.
+		if lobbies[lobby.LobbyID] == nil {
+			putLobby(lobby)
+			newLobbies = append(newLobbies, lobby)
 		}
-	}()
+	}
+	for id, lobby := range lobbies {
+		//Dirty lobbies might not have made it to the Store yet.
+		if !listed[id] && !isLobbyDirty(id) {
+			dropLobby(lobby)
+			dropped = append(dropped, lobby)
+		}
+	}
+	globalStateMutex.Unlock()
+
+	for _, lobby := range dropped {
+		releaseLobby(lobby)
+	}
+	return newLobbies
+}
 
+// AddLobby adds a lobby to the instance, making it visible for GetLobby calls.
+// If a lobby with the same ID has already been stored, ErrVersionConflict is
+// returned and the lobby isn't added. On other errors while storing the
+// lobby, it is still added, as it is usable by this instance, and flushed
+// later on.
+func AddLobby(lobby *game.Lobby) error {
+	err := Store.SaveLobby(lobby)
+	if err == ErrVersionConflict {
+		return err
+	}
+	if err != nil {
+		log.Printf("Error while saving lobby %s : %s", lobby.LobbyID, err)
+		markLobbyDirty(lobby.LobbyID)
+	}
+
+	attachDrawingPersistence(lobby)
 	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
-	LoadLobbies()
+	putLobby(lobby)
+	globalStateMutex.Unlock()
+
+	for _, player := range lobby.GetPlayers() {
+		RegisterPlayer(lobby, player)
+	}
+	acquireLease(lobby)
+	subscribeLobbyInput(lobby)
+	return nil
 }
 
-func LoadLobbies() {
-	lobbyList := LoadLobbyList()
-	lobbies = []*game.Lobby{}
-	for _, lobbyId := range lobbyList {
-		lobby := LoadLobby(lobbyId)
-		lobbies = append(lobbies, lobby)
+// putLobby adds the lobby and its players to the indexes. The write lock
+// has to be held by the caller.
+func putLobby(lobby *game.Lobby) {
+	if existing := lobbies[lobby.LobbyID]; existing != nil {
+		removeLobbyOrder(existing)
+	}
+	lobbies[lobby.LobbyID] = lobby
+	lobbyOrder = append(lobbyOrder, lobby)
+	for _, player := range lobby.GetPlayers() {
+		putPlayer(lobby.LobbyID, player)
 	}
 }
 
-// AddLobby adds a lobby to the instance, making it visible for GetLobby calls.
-func AddLobby(lobby *game.Lobby) {
+// indexPlayer makes the player available to GetPlayer and
+// GetPlayerBySession, as long as the lobby is held by this instance. This
+// has to be done for each player joining a lobby, which RegisterPlayer takes
+// care of.
+func indexPlayer(lobby *game.Lobby, player *game.Player) {
 	globalStateMutex.Lock()
 	defer globalStateMutex.Unlock()
 
-	lobbies = append(lobbies, lobby)
-	SaveLobby(lobby)
+	if lobbies[lobby.LobbyID] == lobby {
+		putPlayer(lobby.LobbyID, player)
+	}
+}
+
+func putPlayer(lobbyID string, player *game.Player) {
+	if lobbiesByPlayerID[player.ID] == lobbyID {
+		return
+	}
 
+	lobbiesByPlayerID[player.ID] = lobbyID
+	lobbiesBySession[player.GetUserSession()] = lobbyID
+	indexedPlayers[lobbyID] = append(indexedPlayers[lobbyID], indexedPlayer{
+		id:          player.ID,
+		userSession: player.GetUserSession(),
+	})
 }
 
-//
+// GetPlayer returns the player with the given ID, as long as its lobby is
+// held by this instance.
 func GetPlayer(id string) *game.Player {
-	for _, l := range lobbies {
-		for _, p := range l.GetPlayers() {
-			if p.ID == id {
-				return p
-			}
-		}
+	globalStateMutex.RLock()
+	lobby := lobbies[lobbiesByPlayerID[id]]
+	globalStateMutex.RUnlock()
+
+	if lobby == nil {
+		return nil
 	}
-	return nil
+	var player *game.Player
+	lobby.Synchronized(func() {
+		player = lobby.GetPlayerByID(id)
+	})
+	return player
+}
+
+// GetPlayerBySession works like GetPlayer, but identifies the player by
+// their user session and returns their lobby as well.
+func GetPlayerBySession(userSession string) (*game.Lobby, *game.Player) {
+	globalStateMutex.RLock()
+	lobby := lobbies[lobbiesBySession[userSession]]
+	globalStateMutex.RUnlock()
+
+	if lobby == nil {
+		return nil, nil
+	}
+	var player *game.Player
+	lobby.Synchronized(func() {
+		player = lobby.GetPlayer(userSession)
+	})
+	if player == nil {
+		return nil, nil
+	}
+	return lobby, player
 }
 
 // GetLobby returns a Lobby that has a matching ID or no Lobby if none could
 // be found.
 func GetLobby(id string) *game.Lobby {
-	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
+	globalStateMutex.RLock()
+	defer globalStateMutex.RUnlock()
 
-	for _, l := range lobbies {
-		if l.LobbyID == id {
-			return l
-		}
-	}
-
-	return nil
+	return lobbies[id]
 }
 
 // GetActiveLobbyCount indicates how many activate lobby there are. This includes
 // both private and public lobbies and it doesn't matter whether the game is
 // already over, hasn't even started or is still ongoing.
 func GetActiveLobbyCount() int {
-	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
+	globalStateMutex.RLock()
+	defer globalStateMutex.RUnlock()
 
 	return len(lobbies)
 }
@@ -103,11 +271,8 @@ func GetActiveLobbyCount() int {
 // This implies that the lobbies can be found in the lobby browser ob the
 // homepage.
 func GetPublicLobbies() []*game.Lobby {
-	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
-
 	var publicLobbies []*game.Lobby
-	for _, lobby := range lobbies {
+	for _, lobby := range getLobbies() {
 		if lobby.IsPublic() {
 			publicLobbies = append(publicLobbies, lobby)
 		}
@@ -116,33 +281,90 @@ func GetPublicLobbies() []*game.Lobby {
 	return publicLobbies
 }
 
+// getLobbies returns all lobbies held by this instance, so that they can be
+// iterated without holding the lock.
+func getLobbies() []*game.Lobby {
+	globalStateMutex.RLock()
+	defer globalStateMutex.RUnlock()
+
+	local := make([]*game.Lobby, len(lobbyOrder))
+	copy(local, lobbyOrder)
+	return local
+}
+
 // RemoveLobby deletes a lobby, not allowing anyone to connect to it again.
 func RemoveLobby(id string) {
 	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
+	lobby := lobbies[id]
+	if lobby != nil {
+		dropLobby(lobby)
+	}
+	remaining := len(lobbies)
+	globalStateMutex.Unlock()
 
-	removeLobby(id)
+	if lobby != nil {
+		releaseLobby(lobby)
+		DeleteLobby(id)
+		log.Printf("Closing lobby %s. There are currently %d open lobbies left.\n", id, remaining)
+	}
 }
 
-func removeLobby(id string) {
-	indexToDelete := -1
-	for index, l := range lobbies {
-		if l.LobbyID == id {
-			indexToDelete = index
-			break
+// evictLobby drops the local copy of a lobby, while leaving the Store
+// untouched, as other replicas might still have players connected to it.
+func evictLobby(lobby *game.Lobby) {
+	globalStateMutex.Lock()
+	//The lobby might have been replaced in the meantime.
+	evicted := lobbies[lobby.LobbyID] == lobby
+	if evicted {
+		dropLobby(lobby)
+	}
+	remaining := len(lobbies)
+	globalStateMutex.Unlock()
+
+	if evicted {
+		releaseLobby(lobby)
+		log.Printf("Evicting lobby %s. There are currently %d open lobbies left.\n", lobby.LobbyID, remaining)
+	}
+}
+
+// dropLobby removes the lobby and its players from the indexes and stops
+// it. The write lock has to be held by the caller, which has to call
+// releaseLobby once the lock has been released.
+func dropLobby(lobby *game.Lobby) {
+	delete(lobbies, lobby.LobbyID)
+	removeLobbyOrder(lobby)
+	for _, player := range indexedPlayers[lobby.LobbyID] {
+		if lobbiesByPlayerID[player.id] == lobby.LobbyID {
+			delete(lobbiesByPlayerID, player.id)
+		}
+		if lobbiesBySession[player.userSession] == lobby.LobbyID {
+			delete(lobbiesBySession, player.userSession)
 		}
 	}
+	delete(indexedPlayers, lobby.LobbyID)
+
+	forgetOutputSequence(lobby.LobbyID)
+	forgetDirtyLobby(lobby.LobbyID)
+	lobby.Stop()
+}
 
-	if indexToDelete != -1 {
-		removeLobbyByIndex(indexToDelete)
+// removeLobbyOrder removes the lobby from lobbyOrder. The write lock has to
+// be held by the caller.
+func removeLobbyOrder(lobby *game.Lobby) {
+	for index, ordered := range lobbyOrder {
+		if ordered == lobby {
+			lobbyOrder = append(lobbyOrder[:index], lobbyOrder[index+1:]...)
+			return
+		}
 	}
 }
 
-func removeLobbyByIndex(indexToDelete int) {
-	lobby := lobbies[indexToDelete]
-	lobbies = append(lobbies[:indexToDelete], lobbies[indexToDelete+1:]...)
-	DeleteLobby(lobby.LobbyID)
-	log.Printf("Closing lobby %s. There are currently %d open lobbies left.\n", lobby.LobbyID, len(lobbies))
+// releaseLobby ends the input subscription of a dropped lobby. Unsubscribing
+// waits for the input being handled, which might need the global state lock.
+func releaseLobby(lobby *game.Lobby) {
+	if lobby.View().IsReferenceReplica() {
+		unsubscribeLobbyInput(lobby.LobbyID)
+	}
 }
 
 // pageStats represents dynamic information about the website.
@@ -156,20 +378,20 @@ type pageStats struct {
 // Stats delivers information about the state of the service. Currently this
 // is lobby and player counts.
 func Stats() *pageStats {
-	globalStateMutex.Lock()
-	defer globalStateMutex.Unlock()
+	local := getLobbies()
 
 	var playerCount, occupiedPlayerSlotCount, connectedPlayerCount uint64
-	//While one would expect locking the lobby here, it's not very
-	//important to get 100% consistent results here.
-	for _, lobby := range lobbies {
-		playerCount += uint64(len(lobby.GetPlayers()))
-		occupiedPlayerSlotCount += uint64(lobby.GetOccupiedPlayerSlots())
-		connectedPlayerCount += uint64(lobby.GetConnectedPlayerCount())
+	//The views might lag behind a little, but the stats don't have to be
+	//100% consistent anyway.
+	for _, lobby := range local {
+		view := lobby.View()
+		playerCount += uint64(len(view.Players))
+		occupiedPlayerSlotCount += uint64(view.GetOccupiedPlayerSlots())
+		connectedPlayerCount += uint64(view.GetConnectedPlayerCount())
 	}
 
 	return &pageStats{
-		ActiveLobbyCount:        len(lobbies),
+		ActiveLobbyCount:        len(local),
 		PlayersCount:            playerCount,
 		OccupiedPlayerSlotCount: occupiedPlayerSlotCount,
 		ConnectedPlayersCount:   connectedPlayerCount,
@@ -0,0 +1,203 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func Test_lobbyIndexes(t *testing.T) {
+	useTestStore(t)
+	game.ReplicaID = "local"
+	defer clearTestLobbies()
+
+	lobby := createTestLobby(t, "indexed")
+	defer lobby.Stop()
+	owner := lobby.GetPlayers()[0]
+	if err := AddLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	if GetLobby("indexed") != lobby || GetLobby("unknown") != nil {
+		t.Error("expected the lobby to be found by its ID")
+	}
+	if GetPlayer(owner.ID) != owner {
+		t.Error("expected the owner to be found by their ID")
+	}
+	if foundLobby, player := GetPlayerBySession(owner.GetUserSession()); foundLobby != lobby || player != owner {
+		t.Error("expected the owner to be found by their session")
+	}
+
+	//Players joining later on are indexed once registered.
+	var guest *game.Player
+	lobby.Synchronized(func() {
+		guest = lobby.JoinPlayer("guest")
+	})
+	RegisterPlayer(lobby, guest)
+	if GetPlayer(guest.ID) != guest {
+		t.Error("expected the guest to be found by their ID")
+	}
+
+	RemoveLobby("indexed")
+	if GetLobby("indexed") != nil || GetPlayer(owner.ID) != nil || GetPlayer(guest.ID) != nil {
+		t.Error("expected the lobby and its players to be gone")
+	}
+	if _, player := GetPlayerBySession(guest.GetUserSession()); player != nil {
+		t.Error("expected the session of the guest to be gone")
+	}
+	if len(lobbiesByPlayerID) != 0 || len(lobbiesBySession) != 0 || len(indexedPlayers) != 0 {
+		t.Error("expected the indexes to be empty")
+	}
+}
+
+func Test_GetPublicLobbiesOrder(t *testing.T) {
+	defer clearTestLobbies()
+
+	var added []string
+	for i := 0; i < 20; i++ {
+		lobby := createTestLobby(t, fmt.Sprintf("public-%d", i))
+		lobby.Public = i != 5
+		putTestLobbies(lobby)
+		if lobby.Public {
+			added = append(added, lobby.LobbyID)
+		}
+	}
+	globalStateMutex.Lock()
+	dropLobby(lobbies["public-10"])
+	globalStateMutex.Unlock()
+	added = append(added[:9], added[10:]...)
+
+	//The lobby browser mustn't shuffle the lobbies on every reload.
+	for attempt := 0; attempt < 5; attempt++ {
+		publicLobbies := GetPublicLobbies()
+		if len(publicLobbies) != len(added) {
+			t.Fatalf("expected %d public lobbies, but got %d", len(added), len(publicLobbies))
+		}
+		for index, lobby := range publicLobbies {
+			if lobby.LobbyID != added[index] {
+				t.Fatalf("expected %s at position %d, but got %s", added[index], index, lobby.LobbyID)
+			}
+		}
+	}
+}
+
+func Test_LoadLobbiesResumesTurns(t *testing.T) {
+	useTestStore(t)
+	game.ReplicaID = "stable"
+	defer clearTestLobbies()
+	published := usePublishingWriters(t, "resumed")
+
+	//The turn has ended while this replica was restarting.
+	lobby := createTestLobby(t, "resumed")
+	lobby.ReferenceReplicaID = "stable"
+	lobby.State = game.Ongoing
+	lobby.Round = 1
+	lobby.RoundEndTime = time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	if err := Store.SaveLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	LoadLobbies()
+	defer RemoveLobby("resumed")
+
+	awaitPublishedEvent(t, published, "next-turn")
+}
+
+func Test_SynchronizeLobby(t *testing.T) {
+	useTestStore(t)
+	game.ReplicaID = "local"
+	defer clearTestLobbies()
+
+	for _, id := range []string{"requested", "other"} {
+		lobby := createTestLobby(t, id)
+		lobby.ReferenceReplicaID = "remote"
+		if err := Store.SaveLobby(lobby); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SynchronizeLobby("requested")
+	defer RemoveLobby("requested")
+	if GetLobby("requested") == nil {
+		t.Fatal("expected the requested lobby to be loaded")
+	}
+	if GetLobby("other") != nil {
+		t.Error("expected only the requested lobby to be loaded")
+	}
+
+	//Lobbies held already are refreshed instead.
+	stored, err := Store.LoadLobby("requested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Round = 3
+	if err := Store.SaveLobby(stored); err != nil {
+		t.Fatal(err)
+	}
+	SynchronizeLobby("requested")
+	lobby := GetLobby("requested")
+	lobby.Synchronized(func() {
+		if lobby.Round != 3 {
+			t.Errorf("expected the lobby to be refreshed, but got round %d", lobby.Round)
+		}
+	})
+}
+
+func Test_RegisterPlayerOfUnknownLobby(t *testing.T) {
+	useTestStore(t)
+	defer clearTestLobbies()
+
+	//Lobbies that aren't held by this instance mustn't end up in the
+	//indexes, as nothing would ever remove them again.
+	lobby := createTestLobby(t, "elsewhere")
+	RegisterPlayer(lobby, lobby.GetPlayers()[0])
+	if GetPlayer(lobby.GetPlayers()[0].ID) != nil || len(indexedPlayers) != 0 {
+		t.Error("expected the player not to be indexed")
+	}
+}
+
+// putBenchmarkLobbies makes this instance hold the given amount of lobbies
+// with a single player each and returns the players.
+func putBenchmarkLobbies(b *testing.B, count int) []*game.Player {
+	players := make([]*game.Player, 0, count)
+	for i := 0; i < count; i++ {
+		lobby := &game.Lobby{LobbyID: fmt.Sprintf("lobby-%d", i)}
+		players = append(players, lobby.JoinPlayer("player"))
+		putTestLobbies(lobby)
+	}
+	b.Cleanup(clearTestLobbies)
+	b.ResetTimer()
+	return players
+}
+
+func BenchmarkGetLobby(b *testing.B) {
+	putBenchmarkLobbies(b, 10000)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if GetLobby(fmt.Sprintf("lobby-%d", i%10000)) == nil {
+				b.Fatal("lobby not found")
+			}
+		}
+	})
+}
+
+func BenchmarkGetPlayerBySession(b *testing.B) {
+	players := putBenchmarkLobbies(b, 10000)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, player := GetPlayerBySession(players[i%len(players)].GetUserSession()); player == nil {
+				b.Fatal("player not found")
+			}
+		}
+	})
+	b.StopTimer()
+	for _, player := range players {
+		if lobby, _ := GetPlayerBySession(player.GetUserSession()); lobby != nil {
+			lobby.Stop()
+		}
+	}
+}
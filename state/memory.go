@@ -0,0 +1,416 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ErrLobbyNotStored is returned when loading a lobby that isn't known to
+// the store.
+var ErrLobbyNotStored = errors.New("lobby isn't stored")
+
+// memoryLobbyStore keeps all lobbies in the memory of the current process.
+// The lobbies are still serialized, so that loading a lobby behaves the same
+// way it does with the durable stores.
+type memoryLobbyStore struct {
+	mutex   *sync.Mutex
+	lobbies map[string]string
+	// quarantined holds the documents of lobbies that couldn't be loaded.
+	quarantined map[string]string
+	indexes     map[string]lobbyIndexEntry
+	expiries    map[string]time.Time
+	// players holds the encoded registered players by lobby and player ID,
+	// sessions maps the user sessions of each lobby to player IDs.
+	players   map[string]map[string][]byte
+	sessions  map[string]map[string]string
+	events    map[string][]*LobbyEvent
+	sequences map[string]int64
+	drawings  map[string]map[int][][]byte
+	leases    map[string]*lease
+}
+
+// lease is held by a replica until it expires.
+type lease struct {
+	holder string
+	expiry time.Time
+}
+
+// NewMemoryLobbyStore creates a LobbyStore that isn't durable. It is meant
+// for single replica deployments without persistence and for tests.
+func NewMemoryLobbyStore() LobbyStore {
+	return &memoryLobbyStore{
+		mutex:       &sync.Mutex{},
+		lobbies:     make(map[string]string),
+		quarantined: make(map[string]string),
+		indexes:     make(map[string]lobbyIndexEntry),
+		expiries:    make(map[string]time.Time),
+		players:     make(map[string]map[string][]byte),
+		sessions:    make(map[string]map[string]string),
+		events:      make(map[string][]*LobbyEvent),
+		sequences:   make(map[string]int64),
+		drawings:    make(map[string]map[int][][]byte),
+		leases:      make(map[string]*lease),
+	}
+}
+
+func (store *memoryLobbyStore) SaveLobby(lobby *game.Lobby) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.compareAndSet(lobby, false)
+}
+
+func (store *memoryLobbyStore) compareAndSet(lobby *game.Lobby, includeDrawing bool) error {
+	if err := checkVersion(lobby, store.lobbies[lobby.LobbyID]); err != nil {
+		return err
+	}
+
+	document, version := lobbyDocument(lobby, includeDrawing)
+	store.lobbies[lobby.LobbyID] = document
+	store.indexes[lobby.LobbyID] = indexEntryOf(lobby)
+	store.expiries[lobby.LobbyID] = time.Now().Add(LobbyExpiry)
+	lobby.Version = version
+	return nil
+}
+
+func (store *memoryLobbyStore) LoadLobby(id string) (*game.Lobby, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	value, available := store.lobbies[id]
+	if !available {
+		return nil, ErrLobbyNotStored
+	}
+	entity, err := decodeLobbyEntity(value)
+	if err != nil {
+		return nil, err
+	}
+	return assembleLobby(value, store.drawings[id][entity.Turn])
+}
+
+func (store *memoryLobbyStore) DeleteLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.lobbies, id)
+	delete(store.indexes, id)
+	delete(store.expiries, id)
+	delete(store.players, id)
+	delete(store.sessions, id)
+	delete(store.events, id)
+	delete(store.sequences, id)
+	delete(store.drawings, id)
+	delete(store.leases, id)
+	return nil
+}
+
+func (store *memoryLobbyStore) IndexLobby(lobby *game.Lobby) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, available := store.lobbies[lobby.LobbyID]; available {
+		store.indexes[lobby.LobbyID] = indexEntryOf(lobby)
+	}
+	return nil
+}
+
+func (store *memoryLobbyStore) ScanPublicLobbies(filter LobbyFilter, cursor string, count int) ([]string, string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var ids []string
+	for id, entry := range store.indexes {
+		if entry.matches(filter) {
+			ids = append(ids, id)
+		}
+	}
+	return pageLobbyIDs(ids, cursor, count)
+}
+
+func (store *memoryLobbyStore) QuarantineLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if value, available := store.lobbies[id]; available {
+		store.quarantined[id] = value
+	}
+	delete(store.lobbies, id)
+	delete(store.indexes, id)
+	delete(store.expiries, id)
+	delete(store.players, id)
+	delete(store.sessions, id)
+	delete(store.events, id)
+	delete(store.sequences, id)
+	delete(store.drawings, id)
+	delete(store.leases, id)
+	return nil
+}
+
+func (store *memoryLobbyStore) LoadLobbyList() ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ids := make([]string, 0, len(store.lobbies))
+	for id := range store.lobbies {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (store *memoryLobbyStore) TouchLobby(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, available := store.lobbies[id]; available {
+		store.expiries[id] = time.Now().Add(LobbyExpiry)
+	}
+	return nil
+}
+
+func (store *memoryLobbyStore) ExpiredLobbies() ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var expired []string
+	now := time.Now()
+	for id, expiry := range store.expiries {
+		if now.After(expiry) {
+			expired = append(expired, id)
+		}
+	}
+	return expired, nil
+}
+
+func (store *memoryLobbyStore) SavePlayer(lobbyID string, player *game.PlayerEntity) error {
+	data, err := json.Marshal(player)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.players[lobbyID] == nil {
+		store.players[lobbyID] = make(map[string][]byte)
+		store.sessions[lobbyID] = make(map[string]string)
+	}
+	store.players[lobbyID][player.ID] = data
+	store.sessions[lobbyID][player.UserSession] = player.ID
+	return nil
+}
+
+func (store *memoryLobbyStore) LoadPlayer(lobbyID, playerID string) (*game.PlayerEntity, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.loadPlayer(lobbyID, playerID)
+}
+
+func (store *memoryLobbyStore) LoadPlayerBySession(lobbyID, userSession string) (*game.PlayerEntity, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	playerID, available := store.sessions[lobbyID][userSession]
+	if !available {
+		return nil, ErrPlayerNotStored
+	}
+	return store.loadPlayer(lobbyID, playerID)
+}
+
+func (store *memoryLobbyStore) loadPlayer(lobbyID, playerID string) (*game.PlayerEntity, error) {
+	data, available := store.players[lobbyID][playerID]
+	if !available {
+		return nil, ErrPlayerNotStored
+	}
+
+	var player game.PlayerEntity
+	if err := json.Unmarshal(data, &player); err != nil {
+		return nil, err
+	}
+	return &player, nil
+}
+
+func (store *memoryLobbyStore) NextLobbySequence(id string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.sequences[id]++
+	return store.sequences[id], nil
+}
+
+func (store *memoryLobbyStore) AppendLobbyEvent(event *LobbyEvent) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.events[event.LobbyID] = append(store.events[event.LobbyID], event)
+	return len(store.events[event.LobbyID]), nil
+}
+
+func (store *memoryLobbyStore) LoadLobbyEvents(id string) ([]*LobbyEvent, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	events := make([]*LobbyEvent, len(store.events[id]))
+	copy(events, store.events[id])
+	return events, nil
+}
+
+func (store *memoryLobbyStore) SnapshotLobby(lobby *game.Lobby) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.compareAndSet(lobby, true); err != nil {
+		return err
+	}
+	delete(store.events, lobby.LobbyID)
+	return nil
+}
+
+func (store *memoryLobbyStore) AppendDrawing(lobbyID string, turn int, operation *game.DrawingOperation) error {
+	data, err := json.Marshal(operation)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.drawings[lobbyID] == nil {
+		store.drawings[lobbyID] = make(map[int][][]byte)
+	}
+	store.drawings[lobbyID][turn] = append(store.drawings[lobbyID][turn], data)
+	return nil
+}
+
+func (store *memoryLobbyStore) ClearDrawing(lobbyID string, turn int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.drawings[lobbyID], turn)
+	return nil
+}
+
+func (store *memoryLobbyStore) AcquireLease(lobbyID, replicaID string, duration time.Duration) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, held := store.leases[lobbyID]
+	if held && current.holder != replicaID && time.Now().Before(current.expiry) {
+		return current.holder, nil
+	}
+
+	store.leases[lobbyID] = &lease{holder: replicaID, expiry: time.Now().Add(duration)}
+	return replicaID, nil
+}
+
+func (store *memoryLobbyStore) LoadLeaseHolder(lobbyID string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, held := store.leases[lobbyID]
+	if !held || time.Now().After(current.expiry) {
+		return "", nil
+	}
+	return current.holder, nil
+}
+
+// memoryReplicaRegistry keeps the replica registry in the memory of the
+// current process, which only covers this replica.
+type memoryReplicaRegistry struct {
+	mutex    *sync.Mutex
+	replicas map[string]*registeredReplica
+	// generations holds the generation counters by replica ID.
+	generations  map[string]int64
+	sweeperLease *lease
+}
+
+// registeredReplica is the encoded entry of a replica in the replica
+// registry, which is valid until it expires.
+type registeredReplica struct {
+	data   []byte
+	expiry time.Time
+}
+
+// NewMemoryReplicaRegistry creates a ReplicaRegistry that isn't durable. It
+// is meant for single replica deployments without persistence and for tests.
+func NewMemoryReplicaRegistry() ReplicaRegistry {
+	return &memoryReplicaRegistry{
+		mutex:       &sync.Mutex{},
+		replicas:    make(map[string]*registeredReplica),
+		generations: make(map[string]int64),
+	}
+}
+
+func (registry *memoryReplicaRegistry) SaveReplica(replica *Replica, duration time.Duration) error {
+	data, err := json.Marshal(replica)
+	if err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.replicas[replica.ID] = &registeredReplica{data: data, expiry: time.Now().Add(duration)}
+	return nil
+}
+
+func (registry *memoryReplicaRegistry) LoadReplica(id string) (*Replica, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registered, available := registry.replicas[id]
+	if !available || time.Now().After(registered.expiry) {
+		return nil, ErrReplicaNotStored
+	}
+
+	var replica Replica
+	if err := json.Unmarshal(registered.data, &replica); err != nil {
+		return nil, err
+	}
+	return &replica, nil
+}
+
+func (registry *memoryReplicaRegistry) LoadReplicaList() ([]*Replica, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	replicas := make([]*Replica, 0, len(registry.replicas))
+	for id, registered := range registry.replicas {
+		if time.Now().After(registered.expiry) {
+			delete(registry.replicas, id)
+			continue
+		}
+
+		var replica Replica
+		if err := json.Unmarshal(registered.data, &replica); err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, &replica)
+	}
+	return replicas, nil
+}
+
+func (registry *memoryReplicaRegistry) NextReplicaGeneration(replicaID string) (int64, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.generations[replicaID]++
+	return registry.generations[replicaID], nil
+}
+
+func (registry *memoryReplicaRegistry) AcquireSweeperLease(replicaID string, duration time.Duration) (string, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	current := registry.sweeperLease
+	if current != nil && current.holder != replicaID && time.Now().Before(current.expiry) {
+		return current.holder, nil
+	}
+
+	registry.sweeperLease = &lease{holder: replicaID, expiry: time.Now().Add(duration)}
+	return replicaID, nil
+}
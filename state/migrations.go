@@ -0,0 +1,127 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ErrCorruptLobby is returned when loading a lobby whose document can't be
+// decoded.
+var ErrCorruptLobby = errors.New("lobby document is corrupt")
+
+// ErrNewerLobby is returned when loading a lobby whose document has been
+// written with a newer schema version, for example by replicas that have
+// already been upgraded during a rolling deployment.
+var ErrNewerLobby = errors.New("lobby document has been written by a newer version")
+
+// lobbyMigration upgrades a lobby document by one schema version. Documents
+// are migrated as plain JSON objects, since the LobbyEntity they have been
+// written with doesn't exist anymore.
+type lobbyMigration func(document map[string]interface{}) error
+
+// lobbyMigrations holds the migration from each schema version to the next
+// one. Documents written before the schema was versioned are version 1.
+var lobbyMigrations = map[int]lobbyMigration{
+	1: migrateLobbyFromVersion1,
+}
+
+// migrateLobbyFromVersion1 drops the turn timer and the lowercaser, as they
+// never held any state that could be restored.
+func migrateLobbyFromVersion1(document map[string]interface{}) error {
+	delete(document, "TimeLeftTicker")
+	delete(document, "Lowercaser")
+	return nil
+}
+
+// decodeLobbyEntity parses a stored lobby document and migrates it to the
+// current schema version. Documents that can't be decoded result in an
+// ErrCorruptLobby, documents of a newer schema version in an ErrNewerLobby.
+func decodeLobbyEntity(value string) (game.LobbyEntity, error) {
+	var entity game.LobbyEntity
+
+	var document map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	//Keeps large numbers, such as the round end time, exact.
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return entity, fmt.Errorf("%w: %s", ErrCorruptLobby, err)
+	}
+
+	if err := migrateLobbyDocument(document); errors.Is(err, ErrNewerLobby) {
+		return entity, err
+	} else if err != nil {
+		return entity, fmt.Errorf("%w: %s", ErrCorruptLobby, err)
+	}
+
+	migrated, err := json.Marshal(document)
+	if err != nil {
+		return entity, fmt.Errorf("%w: %s", ErrCorruptLobby, err)
+	}
+	if err := json.Unmarshal(migrated, &entity); err != nil {
+		return entity, fmt.Errorf("%w: %s", ErrCorruptLobby, err)
+	}
+	return entity, nil
+}
+
+// migrateLobbyDocument applies all migrations required for bringing the
+// document to game.LobbySchemaVersion.
+func migrateLobbyDocument(document map[string]interface{}) error {
+	version := 1
+	if rawVersion, available := document["SchemaVersion"]; available {
+		number, isNumber := rawVersion.(json.Number)
+		if !isNumber {
+			return fmt.Errorf("invalid schema version %v", rawVersion)
+		}
+		parsed, err := number.Int64()
+		if err != nil {
+			return fmt.Errorf("invalid schema version %v", rawVersion)
+		}
+		version = int(parsed)
+	}
+
+	if version > game.LobbySchemaVersion {
+		return fmt.Errorf("%w: schema version %d", ErrNewerLobby, version)
+	}
+
+	for ; version < game.LobbySchemaVersion; version++ {
+		migration, available := lobbyMigrations[version]
+		if !available {
+			return fmt.Errorf("no migration from schema version %d", version)
+		}
+		if err := migration(document); err != nil {
+			return fmt.Errorf("error migrating from schema version %d: %s", version, err)
+		}
+	}
+	document["SchemaVersion"] = version
+	return nil
+}
+
+// loadStoredLobby loads the lobby from the Store, logging any errors. Lobbies
+// that can't be decoded are quarantined. Lobbies written by a newer version
+// are left in place, as the replicas running that version still use them.
+func loadStoredLobby(id string) (*game.Lobby, error) {
+	lobby, err := Store.LoadLobby(id)
+	if errors.Is(err, ErrCorruptLobby) {
+		quarantineLobby(id, err)
+	} else if errors.Is(err, ErrNewerLobby) {
+		log.Printf("Skipping lobby %s : %s", id, err)
+	} else if err != nil {
+		log.Printf("Error while loading lobby %s : %s", id, err)
+	}
+	return lobby, err
+}
+
+// quarantineLobby moves a lobby that can't be loaded out of the way, so that
+// it isn't loaded over and over again, but can still be inspected.
+func quarantineLobby(id string, reason error) {
+	log.Printf("Quarantining lobby %s : %s", id, reason)
+	if err := Store.QuarantineLobby(id); err != nil {
+		log.Printf("Error while quarantining lobby %s : %s", id, err)
+	}
+	removeLobbyInput(id)
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// unversionedLobby is a document written before the schema was versioned.
+const unversionedLobby = `{"LobbyID":"old","EditableLobbySettings":{"maxPlayers":4,"public":true,"enableVotekick":true,"customWordsChance":0,"clientsPerIpLimit":1,"drawingTime":120,"rounds":4},"Players":[{"ID":"a","Name":"Alice","Score":5,"Connected":true}],"State":"ongoing","Owner":{"ID":"a"},"Creator":{"ID":"a"},"Round":2,"Wordpack":"english","RoundEndTime":1792282825417,"Turn":3,"TimeLeftTicker":{"C":{}},"CurrentDrawing":[],"Lowercaser":{},"Version":7}`
+
+// storeRawDocument replaces the document of the lobby, bypassing the store.
+func storeRawDocument(t *testing.T, store LobbyStore, id, document string) {
+	switch typedStore := store.(type) {
+	case *memoryLobbyStore:
+		typedStore.lobbies[id] = document
+	case *fileLobbyStore:
+		if err := writeFile(typedStore.lobbyPath(id), []byte(document)); err != nil {
+			t.Fatal(err)
+		}
+	case *redisLobbyStore:
+		conn := typedStore.client.Get()
+		defer conn.Close()
+		if _, err := conn.Do("SET", lobbyKey(id), document); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown store %T", store)
+	}
+}
+
+func Test_decodeLobbyEntity(t *testing.T) {
+	t.Run("unversioned document is migrated", func(t *testing.T) {
+		entity, err := decodeLobbyEntity(unversionedLobby)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.SchemaVersion != game.LobbySchemaVersion {
+			t.Errorf("expected schema version %d, but got %d", game.LobbySchemaVersion, entity.SchemaVersion)
+		}
+		if entity.LobbyID != "old" || entity.Turn != 3 || entity.Version != 7 || entity.RoundEndTime != 1792282825417 {
+			t.Errorf("unexpected entity %+v", entity)
+		}
+		if len(entity.Players) != 1 || entity.Players[0].Name != "Alice" {
+			t.Errorf("unexpected players %+v", entity.Players)
+		}
+	})
+
+	t.Run("current document round trips", func(t *testing.T) {
+		lobby := createTestLobby(t, "current")
+		entity, err := decodeLobbyEntity(LobbyToJson(lobby))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.LobbyID != "current" || entity.SchemaVersion != game.LobbySchemaVersion {
+			t.Errorf("unexpected entity %+v", entity)
+		}
+	})
+
+	t.Run("newer schema version", func(t *testing.T) {
+		_, err := decodeLobbyEntity(`{"SchemaVersion":999,"LobbyID":"new"}`)
+		if !errors.Is(err, ErrNewerLobby) || errors.Is(err, ErrCorruptLobby) {
+			t.Errorf("expected ErrNewerLobby, but got %v", err)
+		}
+	})
+
+	for name, document := range map[string]string{
+		"invalid schema version": `{"SchemaVersion":"two","LobbyID":"new"}`,
+		"invalid json":           `{"LobbyID":`,
+		"invalid field":          `{"SchemaVersion":2,"Turn":"three"}`,
+	} {
+		document := document
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeLobbyEntity(document); !errors.Is(err, ErrCorruptLobby) {
+				t.Errorf("expected ErrCorruptLobby, but got %v", err)
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreQuarantine(t *testing.T) {
+	useTestStore(t)
+
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			Store = store
+
+			storeRawDocument(t, store, "old", unversionedLobby)
+			if lobby := LoadLobby("old"); lobby == nil || lobby.Turn != 3 {
+				t.Fatalf("expected the unversioned lobby to be loaded, but got %v", lobby)
+			}
+
+			storeRawDocument(t, store, "corrupt", `{"SchemaVersion":"two"}`)
+			if lobby := LoadLobby("corrupt"); lobby != nil {
+				t.Fatal("expected the corrupt lobby not to be loaded")
+			}
+
+			//Replicas running a newer version still use the lobby, so
+			//nothing of it may be removed.
+			newer := `{"SchemaVersion":999,"LobbyID":"newer"}`
+			storeRawDocument(t, store, "newer", newer)
+			player := game.MarshallPlayer(createTestLobby(t, "newer").GetPlayers()[0])
+			if err := store.SavePlayer("newer", player); err != nil {
+				t.Fatal(err)
+			}
+			if lobby := LoadLobby("newer"); lobby != nil {
+				t.Fatal("expected the newer lobby not to be loaded")
+			}
+
+			ids, err := store.LoadLobbyList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(ids)
+			if len(ids) != 2 || ids[0] != "newer" || ids[1] != "old" {
+				t.Errorf("expected only the corrupt lobby to be quarantined, but got %v", ids)
+			}
+			if _, err := store.LoadLobby("newer"); !errors.Is(err, ErrNewerLobby) {
+				t.Errorf("expected the newer lobby to be left in place, but got %v", err)
+			}
+			if _, err := store.LoadPlayer("newer", player.ID); err != nil {
+				t.Errorf("expected the players of the newer lobby to be kept, but got %v", err)
+			}
+		})
+	}
+}
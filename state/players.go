@@ -0,0 +1,167 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ErrPlayerNotStored is returned when loading a player that isn't part of
+// the player registry of the lobby.
+var ErrPlayerNotStored = errors.New("player isn't stored")
+
+// RegisterPlayer adds the player to the player registry of the lobby, so
+// that the other replicas are able to resolve the player. Only the identity
+// of the player is registered, see playerIdentity, so the player has to be
+// registered again when changing names.
+func RegisterPlayer(lobby *game.Lobby, player *game.Player) {
+	indexPlayer(lobby, player)
+	if err := Store.SavePlayer(lobby.LobbyID, playerIdentity(game.MarshallPlayer(player))); err != nil {
+		log.Printf("Error while registering player %s of lobby %s : %s", player.ID, lobby.LobbyID, err)
+	}
+}
+
+// RegisterJoinedPlayerUnsynchronized registers a player who has just joined
+// the lobby, see RegisterPlayer, and makes sure that the player is part of
+// the persisted state of the lobby. The lobby has to be locked by the
+// caller.
+func RegisterJoinedPlayerUnsynchronized(lobby *game.Lobby, player *game.Player) {
+	RegisterPlayer(lobby, player)
+	snapshotJoinedPlayer(lobby)
+}
+
+// ResolvePlayerUnsynchronized returns the player of the lobby with the given
+// user session. Players that have joined through another replica aren't
+// part of the local copy of the lobby yet, so they are looked up in the
+// player registry and added to the lobby. If the player can't be found, nil
+// is returned. The lock of the lobby has to be held by the caller.
+func ResolvePlayerUnsynchronized(lobby *game.Lobby, userSession string) *game.Player {
+	if player := lobby.GetPlayer(userSession); player != nil {
+		return player
+	}
+	return admitRegisteredPlayer(lobby, func() (*game.PlayerEntity, error) {
+		return Store.LoadPlayerBySession(lobby.LobbyID, userSession)
+	})
+}
+
+// ResolvePlayerByIDUnsynchronized works like ResolvePlayerUnsynchronized, but
+// identifies the player by ID, as done by the events relayed between the
+// replicas.
+func ResolvePlayerByIDUnsynchronized(lobby *game.Lobby, playerID string) *game.Player {
+	if player := lobby.GetPlayerByID(playerID); player != nil {
+		return player
+	}
+	return admitRegisteredPlayer(lobby, func() (*game.PlayerEntity, error) {
+		return Store.LoadPlayer(lobby.LobbyID, playerID)
+	})
+}
+
+func admitRegisteredPlayer(lobby *game.Lobby, load func() (*game.PlayerEntity, error)) *game.Player {
+	entity, err := load()
+	if err == ErrPlayerNotStored {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error while resolving player of lobby %s : %s", lobby.LobbyID, err)
+		return nil
+	}
+
+	//Registry entries written before only the identity has been registered
+	//might still carry an outdated score and such.
+	player := game.UnmarshallPlayer(playerIdentity(entity))
+	admitted := lobby.AddPlayerUnsynchronized(player)
+	indexPlayer(lobby, admitted)
+	//The player has joined through another replica.
+	if admitted == player {
+		snapshotJoinedPlayer(lobby)
+	}
+	return admitted
+}
+
+// playerIdentity returns the part of the player that is kept in the player
+// registry. Score, rank and state change all the time and are only tracked
+// by the lobby itself. Players that are admitted from the registry aren't
+// part of the state of the lobby yet, so they start out like any player
+// who has just joined. The player only counts as connected once connected
+// to this instance.
+func playerIdentity(entity *game.PlayerEntity) *game.PlayerEntity {
+	return &game.PlayerEntity{
+		UserSession:      entity.UserSession,
+		LastKnownAddress: entity.LastKnownAddress,
+		ID:               entity.ID,
+		Name:             entity.Name,
+		Rank:             1,
+		State:            game.Guessing,
+	}
+}
+
+func playersKey(lobbyID string) string {
+	return "players-" + lobbyID
+}
+
+// The player registry of a lobby holds the players by ID and maps each user
+// session to the ID of its player.
+func playerField(playerID string) string {
+	return "id-" + playerID
+}
+
+func sessionField(userSession string) string {
+	return "session-" + userSession
+}
+
+func (store *redisLobbyStore) SavePlayer(lobbyID string, player *game.PlayerEntity) error {
+	data, err := json.Marshal(player)
+	if err != nil {
+		return err
+	}
+
+	conn := store.client.Get()
+	defer conn.Close()
+
+	key := playersKey(lobbyID)
+	conn.Send("MULTI")
+	conn.Send("HSET", key, playerField(player.ID), data, sessionField(player.UserSession), player.ID)
+	conn.Send("PEXPIRE", key, LobbyExpiry.Milliseconds())
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (store *redisLobbyStore) LoadPlayer(lobbyID, playerID string) (*game.PlayerEntity, error) {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	return loadRedisPlayer(conn, lobbyID, playerID)
+}
+
+func (store *redisLobbyStore) LoadPlayerBySession(lobbyID, userSession string) (*game.PlayerEntity, error) {
+	conn := store.client.Get()
+	defer conn.Close()
+
+	playerID, err := redis.String(conn.Do("HGET", playersKey(lobbyID), sessionField(userSession)))
+	if err == redis.ErrNil {
+		return nil, ErrPlayerNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadRedisPlayer(conn, lobbyID, playerID)
+}
+
+func loadRedisPlayer(conn redis.Conn, lobbyID, playerID string) (*game.PlayerEntity, error) {
+	data, err := redis.Bytes(conn.Do("HGET", playersKey(lobbyID), playerField(playerID)))
+	if err == redis.ErrNil {
+		return nil, ErrPlayerNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var player game.PlayerEntity
+	if err := json.Unmarshal(data, &player); err != nil {
+		return nil, err
+	}
+	return &player, nil
+}
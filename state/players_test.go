@@ -0,0 +1,140 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func Test_LobbyStorePlayers(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			lobby := createTestLobby(t, "players")
+			if err := store.SaveLobby(lobby); err != nil {
+				t.Fatal(err)
+			}
+			player := game.MarshallPlayer(lobby.JoinPlayer("guest"))
+			if err := store.SavePlayer(lobby.LobbyID, player); err != nil {
+				t.Fatal(err)
+			}
+
+			byID, err := store.LoadPlayer(lobby.LobbyID, player.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if byID.Name != "guest" || byID.UserSession != player.UserSession {
+				t.Errorf("expected the registered player, but got %v", byID)
+			}
+			bySession, err := store.LoadPlayerBySession(lobby.LobbyID, player.UserSession)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bySession.ID != player.ID {
+				t.Errorf("expected player %s, but got %s", player.ID, bySession.ID)
+			}
+
+			//Updates replace the registered player.
+			player.Name = "renamed"
+			if err := store.SavePlayer(lobby.LobbyID, player); err != nil {
+				t.Fatal(err)
+			}
+			if updated, err := store.LoadPlayer(lobby.LobbyID, player.ID); err != nil || updated.Name != "renamed" {
+				t.Errorf("expected the renamed player, but got %v (%v)", updated, err)
+			}
+
+			if _, err := store.LoadPlayer(lobby.LobbyID, "unknown"); err != ErrPlayerNotStored {
+				t.Errorf("expected ErrPlayerNotStored, but got %v", err)
+			}
+			if _, err := store.LoadPlayerBySession("other", player.UserSession); err != ErrPlayerNotStored {
+				t.Errorf("expected ErrPlayerNotStored for another lobby, but got %v", err)
+			}
+
+			//The registry is removed along with the lobby.
+			if err := store.DeleteLobby(lobby.LobbyID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.LoadPlayerBySession(lobby.LobbyID, player.UserSession); err != ErrPlayerNotStored {
+				t.Errorf("expected ErrPlayerNotStored after deletion, but got %v", err)
+			}
+		})
+	}
+}
+
+func Test_ResolvePlayer(t *testing.T) {
+	useTestStore(t)
+
+	lobby := createTestLobby(t, "resolve")
+	if err := Store.SaveLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	//The copy of another replica, which the guest joins through.
+	remote, err := Store.LoadLobby(lobby.LobbyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := remote.JoinPlayer("guest")
+	guest.Connected = true
+	RegisterPlayer(remote, guest)
+
+	resolved := ResolvePlayerUnsynchronized(lobby, guest.GetUserSession())
+	if resolved == nil {
+		t.Fatal("expected the guest to be resolved")
+	}
+	if resolved.ID != guest.ID || resolved.Name != "guest" {
+		t.Errorf("expected the guest, but got %s(%s)", resolved.Name, resolved.ID)
+	}
+	if resolved.Connected {
+		t.Error("expected the guest not to be connected to this instance")
+	}
+	if lobby.GetPlayer(guest.GetUserSession()) != resolved {
+		t.Error("expected the guest to be added to the lobby")
+	}
+
+	//Resolving again doesn't add the guest twice.
+	if ResolvePlayerByIDUnsynchronized(lobby, guest.ID) != resolved || len(lobby.GetPlayers()) != 2 {
+		t.Errorf("expected the known guest, but the lobby has %d players", len(lobby.GetPlayers()))
+	}
+
+	if ResolvePlayerUnsynchronized(lobby, "unknown") != nil {
+		t.Error("expected unknown sessions not to be resolved")
+	}
+	if ResolvePlayerByIDUnsynchronized(lobby, "unknown") != nil {
+		t.Error("expected unknown players not to be resolved")
+	}
+}
+
+func Test_ResolvePlayerOnlyTakesIdentity(t *testing.T) {
+	useTestStore(t)
+
+	lobby := createTestLobby(t, "identity")
+	if err := Store.SaveLobby(lobby); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := Store.LoadLobby(lobby.LobbyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := remote.JoinPlayer("guest")
+	RegisterPlayer(remote, guest)
+	//The score and state change without the guest being registered again.
+	guest.Score = 30
+	guest.State = game.Drawing
+	//Entries written before only the identity has been registered.
+	legacy := game.MarshallPlayer(remote.JoinPlayer("legacy"))
+	legacy.Score = 20
+	legacy.State = game.Standby
+	if err := Store.SavePlayer(remote.LobbyID, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{guest.ID, legacy.ID} {
+		resolved := ResolvePlayerByIDUnsynchronized(lobby, id)
+		if resolved == nil {
+			t.Fatalf("expected player %s to be resolved", id)
+		}
+		if resolved.Score != 0 || resolved.State != game.Guessing {
+			t.Errorf("expected %s to start out like a new player, but got score %d and state %s", resolved.Name, resolved.Score, resolved.State)
+		}
+	}
+}
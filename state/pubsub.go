@@ -0,0 +1,289 @@
+package state
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// MessageBus transports the lobby channels between the replicas. It is
+	// only available if PubSub is enabled.
+	MessageBus Bus
+	// InputBus optionally transports the lobby input channels instead of
+	// the MessageBus, for example in order to use a durable Bus for them.
+	InputBus Bus
+
+	// LobbyInputHandler handles the events published to the input channel
+	// of a lobby this replica is the reference replica for. Returning an
+	// error signals that the event hasn't been handled, so a durable
+	// InputBus can deliver it again later.
+	LobbyInputHandler MessageHandler = func(data []byte) error { return nil }
+	// LobbyOutputHandler handles the events published to the output channel
+	// of a lobby that has players connected to this replica. The events are
+	// passed in order and without duplicates.
+	LobbyOutputHandler = func(event *PersistedEvent) error { return nil }
+	// LobbyResyncHandler is called if events of the output channel of a
+	// lobby have been lost, so that the local players can be brought up to
+	// date again.
+	LobbyResyncHandler = func(lobbyID string) {}
+
+	outputReceiver = newSequenceReceiver(
+		func(event *PersistedEvent) {
+			if err := LobbyOutputHandler(event); err != nil {
+				log.Printf("Error handling output of lobby %s : %s", event.LobbyId, err)
+			}
+		},
+		func(lobbyID string) {
+			LobbyResyncHandler(lobbyID)
+		})
+
+	interestMutex = &sync.Mutex{}
+	// interests is the reference counted interest of this replica in the
+	// lobby channels. A channel is only subscribed to once per replica.
+	interests = make(map[string]*interest)
+)
+
+type interest struct {
+	references  int
+	unsubscribe func()
+}
+
+// LobbyInputChannel is the channel that the events sent by players are
+// published to. It is handled by the reference replica of the lobby.
+func LobbyInputChannel(lobbyID string) string {
+	return lobbyID + "-in"
+}
+
+// LobbyOutputChannel is the channel that the reference replica of a lobby
+// publishes the events for players to. It is handled by all replicas that
+// have players of the lobby connected.
+func LobbyOutputChannel(lobbyID string) string {
+	return lobbyID + "-out"
+}
+
+// inputBus returns the Bus transporting the lobby input channels.
+func inputBus() Bus {
+	if InputBus != nil {
+		return InputBus
+	}
+	return MessageBus
+}
+
+// removeLobbyInput drops the messages the input bus keeps for the input
+// channel of a lobby that has been removed from the Store, see
+// channelRemover. The reference replica has to unsubscribe beforehand.
+func removeLobbyInput(lobbyID string) {
+	remover, removable := inputBus().(channelRemover)
+	if !removable {
+		return
+	}
+	if err := remover.RemoveChannel(LobbyInputChannel(lobbyID)); err != nil {
+		log.Printf("Error while removing input channel of lobby %s : %s", lobbyID, err)
+	}
+}
+
+// PublishLobbyInput publishes an event sent by a player to the input channel
+// of the lobby, so that the reference replica of the lobby can handle it.
+func PublishLobbyInput(lobbyID string, data []byte) error {
+	return inputBus().Publish(LobbyInputChannel(lobbyID), data)
+}
+
+// PublishLobbyOutput publishes an event meant for a player to the output
+// channel of the lobby.
+func PublishLobbyOutput(lobbyID string, data []byte) error {
+	return MessageBus.Publish(LobbyOutputChannel(lobbyID), data)
+}
+
+// subscribeChannel registers interest in the channel. Each call has to be
+// paired with a call to unsubscribeChannel.
+func subscribeChannel(bus Bus, channel string, handler MessageHandler) {
+	if bus == nil {
+		return
+	}
+
+	interestMutex.Lock()
+	defer interestMutex.Unlock()
+
+	if existing, available := interests[channel]; available {
+		existing.references++
+		return
+	}
+
+	unsubscribe, err := bus.Subscribe(channel, handler)
+	if err != nil {
+		log.Printf("Error subscribing to channel %s : %s", channel, err)
+		return
+	}
+	interests[channel] = &interest{references: 1, unsubscribe: unsubscribe}
+}
+
+// unsubscribeChannel drops interest in the channel. Once nobody on this
+// replica is interested anymore, the subscription is ended and true is
+// returned.
+func unsubscribeChannel(channel string) bool {
+	interestMutex.Lock()
+	existing, available := interests[channel]
+	if !available {
+		interestMutex.Unlock()
+		return false
+	}
+
+	existing.references--
+	ended := existing.references <= 0
+	if ended {
+		delete(interests, channel)
+	}
+	interestMutex.Unlock()
+
+	//Unsubscribing waits for the handler, which mustn't block other
+	//subscriptions meanwhile.
+	if ended {
+		existing.unsubscribe()
+	}
+	return ended
+}
+
+// subscribeLobbyInput makes this replica handle the input channel of the
+// lobby, which is required as soon as it becomes its reference replica.
+func subscribeLobbyInput(lobby *game.Lobby) {
+	subscribeChannel(inputBus(), LobbyInputChannel(lobby.LobbyID), LobbyInputHandler)
+}
+
+// unsubscribeLobbyInput stops handling the input channel of the lobby, since
+// this replica isn't its reference replica anymore.
+func unsubscribeLobbyInput(lobbyID string) {
+	unsubscribeChannel(LobbyInputChannel(lobbyID))
+}
+
+// SubscribeLobbyOutput makes this replica forward the output channel of the
+// lobby to its local players. This is required as long as at least one
+// player of the lobby is connected to this replica, therefore each call has
+// to be paired with a call to UnsubscribeLobbyOutput.
+func SubscribeLobbyOutput(lobbyID string) {
+	subscribeChannel(MessageBus, LobbyOutputChannel(lobbyID), receiveLobbyOutput)
+}
+
+// UnsubscribeLobbyOutput drops the interest of a local player in the output
+// channel of the lobby.
+func UnsubscribeLobbyOutput(lobbyID string) {
+	if unsubscribeChannel(LobbyOutputChannel(lobbyID)) {
+		outputReceiver.forget(lobbyID)
+	}
+}
+
+func receiveLobbyOutput(data []byte) error {
+	var event PersistedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	outputReceiver.receive(&event)
+	return nil
+}
+
+// redisChannelPrefix namespaces the channels of the redis bus, so that a
+// single pattern subscription covers all of them.
+const redisChannelPrefix = "scribble:"
+
+// redisBus uses redis pub/sub. Each replica keeps a single pattern
+// subscription to all channels and routes the received messages to the
+// local subscribers of the respective channel. Messages of channels nobody
+// on this replica is interested in are dropped.
+type redisBus struct {
+	client      *redisClient
+	subscribers *subscribers
+
+	mutex *sync.Mutex
+	conn  *redis.PubSubConn
+}
+
+// NewRedisBus creates a Bus using the given redis configuration and starts
+// receiving messages.
+func NewRedisBus(config *RedisConfig) Bus {
+	bus := &redisBus{
+		client:      acquireRedisClient(config),
+		subscribers: newSubscribers(),
+		mutex:       &sync.Mutex{},
+	}
+	go bus.receive()
+	return bus
+}
+
+func (bus *redisBus) Publish(channel string, data []byte) error {
+	if bus.subscribers.isClosed() {
+		return ErrBusClosed
+	}
+
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", redisChannelPrefix+channel, data)
+	return err
+}
+
+func (bus *redisBus) Subscribe(channel string, handler MessageHandler) (func(), error) {
+	return bus.subscribers.add(channel, handler)
+}
+
+func (bus *redisBus) Close() error {
+	bus.subscribers.close()
+
+	bus.mutex.Lock()
+	if bus.conn != nil {
+		bus.conn.Close()
+	}
+	bus.mutex.Unlock()
+
+	return bus.client.release()
+}
+
+// receive keeps the pattern subscription alive, reconnecting whenever the
+// connection is lost.
+func (bus *redisBus) receive() {
+	for !bus.subscribers.isClosed() {
+		if err := bus.receiveUntilError(); err != nil && !bus.subscribers.isClosed() {
+			log.Printf("Error in message bus subscription, reconnecting: %s", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (bus *redisBus) receiveUntilError() error {
+	//The subscription uses a dedicated connection, as closing a pooled
+	//connection waits for the subscription to end, which would block Close.
+	plainConn, err := bus.client.Dial()
+	if err != nil {
+		return err
+	}
+	conn := &redis.PubSubConn{Conn: plainConn}
+	defer conn.Close()
+
+	bus.mutex.Lock()
+	bus.conn = conn
+	bus.mutex.Unlock()
+	//Close might have been called before the connection was known.
+	if bus.subscribers.isClosed() {
+		return nil
+	}
+
+	if err := conn.PSubscribe(redisChannelPrefix + "*"); err != nil {
+		return err
+	}
+
+	for {
+		//Subscriptions may be idle for any amount of time, so the read
+		//timeout of the connection doesn't apply.
+		switch message := conn.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			bus.subscribers.deliver(strings.TrimPrefix(message.Channel, redisChannelPrefix), message.Data)
+		case error:
+			return message
+		}
+	}
+}
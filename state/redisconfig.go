@@ -0,0 +1,316 @@
+package state
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// RedisURL configures the connection to redis, see ParseRedisConfig. If
+	// it isn't set, DatabaseHost is used instead.
+	RedisURL string
+	// RedisPassword overrides the password of RedisURL or DatabaseHost, so
+	// that it doesn't have to be part of the URL.
+	RedisPassword string
+)
+
+const (
+	defaultRedisPort    = "6379"
+	defaultSentinelPort = "26379"
+)
+
+// RedisConfig describes how to connect to redis.
+type RedisConfig struct {
+	// Address is the host and port of the redis server. It is ignored if
+	// SentinelMaster is set.
+	Address  string
+	Username string
+	Password string
+	Database int
+
+	TLS           bool
+	TLSSkipVerify bool
+	// TLSConfig is used as the base for TLS connections. If it is nil, the
+	// system defaults are used.
+	TLSConfig *tls.Config
+
+	// SentinelMaster is the name of the master to ask the sentinels at
+	// SentinelAddresses for. The master is looked up each time a connection
+	// is established, so that connections go to the new master after a
+	// failover.
+	SentinelMaster    string
+	SentinelAddresses []string
+	SentinelPassword  string
+}
+
+// ParseRedisConfig parses the redis configuration from a URL of one of the
+// following forms, where TLS is used with the "rediss" schemes:
+//
+//	redis://[[username]:password@]host[:port][/database]
+//	redis+sentinel://[[username]:password@]host[:port][,host[:port]...]/master[/database]
+//
+// The options "skip_verify=true" and "sentinel_password=..." can be passed
+// as query parameters. A plain host with an optional port is accepted as
+// well.
+func ParseRedisConfig(rawURL string) (*RedisConfig, error) {
+	if !strings.Contains(rawURL, "://") {
+		return &RedisConfig{Address: withDefaultPort(rawURL, defaultRedisPort)}, nil
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &RedisConfig{}
+	sentinel := false
+	switch parsed.Scheme {
+	case "redis":
+	case "rediss":
+		config.TLS = true
+	case "redis+sentinel":
+		sentinel = true
+	case "rediss+sentinel":
+		sentinel = true
+		config.TLS = true
+	default:
+		return nil, fmt.Errorf("unknown redis URL scheme '%s'", parsed.Scheme)
+	}
+
+	if parsed.User != nil {
+		config.Username = parsed.User.Username()
+		config.Password, _ = parsed.User.Password()
+	}
+
+	path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if sentinel {
+		if path[0] == "" {
+			return nil, errors.New("the sentinel URL doesn't name a master")
+		}
+		config.SentinelMaster = path[0]
+		path = path[1:]
+		for _, address := range strings.Split(parsed.Host, ",") {
+			config.SentinelAddresses = append(config.SentinelAddresses, withDefaultPort(address, defaultSentinelPort))
+		}
+	} else {
+		config.Address = withDefaultPort(parsed.Host, defaultRedisPort)
+	}
+
+	if len(path) > 1 {
+		return nil, fmt.Errorf("unexpected path '%s'", parsed.Path)
+	}
+	if len(path) == 1 && path[0] != "" {
+		config.Database, err = strconv.Atoi(path[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid database '%s'", path[0])
+		}
+	}
+
+	query := parsed.Query()
+	if skipVerify := query.Get("skip_verify"); skipVerify != "" {
+		config.TLSSkipVerify, err = strconv.ParseBool(skipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for skip_verify '%s'", skipVerify)
+		}
+	}
+	config.SentinelPassword = query.Get("sentinel_password")
+
+	return config, nil
+}
+
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, port)
+}
+
+// currentRedisConfig returns the configuration defined by RedisURL or
+// DatabaseHost and RedisPassword.
+func currentRedisConfig() (*RedisConfig, error) {
+	rawURL := RedisURL
+	if rawURL == "" {
+		rawURL = DatabaseHost
+	}
+	if rawURL == "" {
+		return nil, errors.New("neither a redis URL nor a database host has been configured")
+	}
+
+	config, err := ParseRedisConfig(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if RedisPassword != "" {
+		config.Password = RedisPassword
+	}
+	return config, nil
+}
+
+// key identifies the configuration, so that clients can be shared by
+// everything using the same configuration.
+func (config *RedisConfig) key() string {
+	return fmt.Sprintf("%+v", *config)
+}
+
+// dial connects to the redis server, asking the sentinels for its address
+// first, if configured to do so.
+func (config *RedisConfig) dial() (redis.Conn, error) {
+	if config.SentinelMaster == "" {
+		return redis.Dial("tcp", config.Address, config.serverDialOptions()...)
+	}
+
+	address, err := config.masterAddress()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := redis.Dial("tcp", address, config.serverDialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	//The sentinels might not have noticed a failover yet.
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		var name string
+		name, err = redis.String(role[0], nil)
+		if err == nil && name != "master" {
+			err = fmt.Errorf("%s is a %s, not the master %s", address, name, config.SentinelMaster)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &masterConn{Conn: conn}, nil
+}
+
+// serverDialOptions are the options for connecting to the redis server
+// itself, as opposed to the sentinels.
+func (config *RedisConfig) serverDialOptions() []redis.DialOption {
+	options := append(config.dialOptions(), redis.DialDatabase(config.Database))
+	if config.Username != "" {
+		options = append(options, redis.DialUsername(config.Username))
+	}
+	if config.Password != "" {
+		options = append(options, redis.DialPassword(config.Password))
+	}
+	return options
+}
+
+// dialOptions are the options shared by connections to the redis server and
+// the sentinels.
+func (config *RedisConfig) dialOptions() []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(RedisConnectTimeout),
+		redis.DialReadTimeout(RedisReadTimeout),
+		redis.DialWriteTimeout(RedisWriteTimeout),
+	}
+	if config.TLS {
+		options = append(options,
+			redis.DialUseTLS(true),
+			redis.DialTLSSkipVerify(config.TLSSkipVerify))
+		if config.TLSConfig != nil {
+			options = append(options, redis.DialTLSConfig(config.TLSConfig))
+		}
+	}
+	return options
+}
+
+// masterAddress asks the sentinels for the address of the master, one after
+// another, until one of them knows it.
+func (config *RedisConfig) masterAddress() (string, error) {
+	var lastError error
+	for _, sentinel := range config.SentinelAddresses {
+		address, err := config.askSentinel(sentinel)
+		if err == nil {
+			return address, nil
+		}
+		lastError = err
+	}
+	return "", fmt.Errorf("no sentinel knows the address of master %s : %w", config.SentinelMaster, lastError)
+}
+
+func (config *RedisConfig) askSentinel(sentinel string) (string, error) {
+	options := config.dialOptions()
+	if config.SentinelPassword != "" {
+		options = append(options, redis.DialPassword(config.SentinelPassword))
+	}
+	conn, err := redis.Dial("tcp", sentinel, options...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", config.SentinelMaster))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("sentinel %s doesn't know master %s", sentinel, config.SentinelMaster)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply of sentinel %s : %v", sentinel, reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// masterConn is a connection to a master found via the sentinels. Once the
+// server has been demoted to a replica, which happens on failover, the
+// connection reports an error, so that it is discarded instead of being
+// returned to the pool.
+type masterConn struct {
+	redis.Conn
+	err error
+}
+
+func (conn *masterConn) Do(command string, arguments ...interface{}) (interface{}, error) {
+	reply, err := conn.Conn.Do(command, arguments...)
+	conn.check(err)
+	return reply, err
+}
+
+func (conn *masterConn) Receive() (interface{}, error) {
+	reply, err := conn.Conn.Receive()
+	conn.check(err)
+	return reply, err
+}
+
+func (conn *masterConn) DoWithTimeout(timeout time.Duration, command string, arguments ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(conn.Conn, timeout, command, arguments...)
+	conn.check(err)
+	return reply, err
+}
+
+func (conn *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(conn.Conn, timeout)
+	conn.check(err)
+	return reply, err
+}
+
+func (conn *masterConn) Err() error {
+	if conn.err != nil {
+		return conn.err
+	}
+	return conn.Conn.Err()
+}
+
+func (conn *masterConn) check(err error) {
+	if isReadOnlyError(err) {
+		conn.err = err
+	}
+}
+
+// isReadOnlyError tells whether the error has been replied by a replica,
+// rather than by the master.
+func isReadOnlyError(err error) bool {
+	replyError, isReply := err.(redis.Error)
+	return isReply && strings.HasPrefix(string(replyError), "READONLY")
+}
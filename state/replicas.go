@@ -0,0 +1,227 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// AdvertisedAddress is the base URL this replica can be reached at by
+// clients, for example "http://scribblers1:8080". Replicas without an
+// address are never routed to.
+var AdvertisedAddress string
+
+// ErrReplicaNotStored is returned when loading a replica that isn't part of
+// the replica registry, for example because it has stopped.
+var ErrReplicaNotStored = errors.New("replica isn't stored")
+
+// ReplicaRegistry keeps track of the members of the cluster. Unlike the
+// LobbyStore, it isn't concerned with any particular lobby. Implementations
+// have to be safe for concurrent use.
+type ReplicaRegistry interface {
+	// SaveReplica adds the replica to the replica registry or renews its
+	// entry. The entry expires after the given duration.
+	SaveReplica(replica *Replica, duration time.Duration) error
+	// LoadReplica returns the registered replica with the given ID. Replicas
+	// that aren't registered, or whose entry has expired, result in an
+	// ErrReplicaNotStored.
+	LoadReplica(id string) (*Replica, error)
+	// LoadReplicaList returns all registered replicas whose entry hasn't
+	// expired yet.
+	LoadReplicaList() ([]*Replica, error)
+	// NextReplicaGeneration increments and returns the generation counter
+	// of the given replica. Unlike the entries of the replica registry, the
+	// counter never expires.
+	NextReplicaGeneration(replicaID string) (int64, error)
+	// AcquireSweeperLease acquires or renews the lease of the given replica
+	// on cleaning up expired lobbies, which works the same way as
+	// LobbyStore.AcquireLease.
+	AcquireSweeperLease(replicaID string, duration time.Duration) (string, error)
+}
+
+// Replicas is the registry of the replicas of the cluster. By default it is
+// only held in memory, which suffices for a single replica.
+var Replicas ReplicaRegistry = NewMemoryReplicaRegistry()
+
+// NewReplicaRegistry creates the ReplicaRegistry of the given kind, which
+// uses the same backend as the LobbyStore of that kind, see NewLobbyStore.
+func NewReplicaRegistry(kind string) (ReplicaRegistry, error) {
+	switch kind {
+	case MemoryStore:
+		return NewMemoryReplicaRegistry(), nil
+	case RedisStore:
+		config, err := currentRedisConfig()
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisReplicaRegistry(config), nil
+	case FileStore:
+		return NewFileReplicaRegistry(StorePath)
+	}
+
+	return nil, fmt.Errorf("unknown replica registry '%s'", kind)
+}
+
+// Replica is the entry of a replica in the replica registry.
+type Replica struct {
+	ID string `json:"id"`
+	// Generation is the ReplicaGeneration of the replica.
+	Generation int64 `json:"generation"`
+	// Address is the AdvertisedAddress of the replica.
+	Address   string    `json:"address"`
+	StartTime time.Time `json:"startTime"`
+	// Lobbies are the IDs of the lobbies the replica is the reference
+	// replica for, as of its last heartbeat.
+	Lobbies []string `json:"lobbies"`
+	// Stats only cover the lobbies the replica is the reference replica for
+	// and the players connected to the replica, so that the stats of all
+	// replicas add up to the stats of the cluster.
+	Stats *pageStats `json:"stats"`
+}
+
+// registerReplica records this replica, the lobbies it owns and its stats in
+// the replica registry. The entry expires after HeartbeatTimeout, unless it
+// is renewed.
+func registerReplica() {
+	replica := &Replica{
+		ID:         game.ReplicaID,
+		Generation: ReplicaGeneration,
+		Address:    AdvertisedAddress,
+		StartTime:  replicaStartTime,
+	}
+	replica.Lobbies, replica.Stats = replicaStats()
+	if err := Replicas.SaveReplica(replica, HeartbeatTimeout); err != nil {
+		log.Printf("Error while registering replica %s : %s", replica.ID, err)
+	}
+}
+
+// LobbyOwner returns the replica that is the reference replica of the lobby.
+// If the lobby isn't owned by any replica or the owner isn't registered, nil
+// is returned.
+func LobbyOwner(lobbyID string) *Replica {
+	holder, err := Store.LoadLeaseHolder(lobbyID)
+	if err != nil {
+		log.Printf("Error while loading owner of lobby %s : %s", lobbyID, err)
+		return nil
+	}
+	if holder == "" {
+		return nil
+	}
+
+	replica, err := Replicas.LoadReplica(holder)
+	if err != nil {
+		if err != ErrReplicaNotStored {
+			log.Printf("Error while loading replica %s : %s", holder, err)
+		}
+		return nil
+	}
+	return replica
+}
+
+func replicaKey(replicaID string) string {
+	return "replica-" + replicaID
+}
+
+func generationKey(replicaID string) string {
+	return "generation-" + replicaID
+}
+
+// replicasIndexKey is the set holding the IDs of all registered replicas.
+// Replicas whose entry has expired are removed from it once listed.
+const replicasIndexKey = "index-replicas"
+
+// redisReplicaRegistry keeps the replica registry in redis, next to the
+// lobbies of the redis LobbyStore.
+type redisReplicaRegistry struct {
+	client *redisClient
+}
+
+// NewRedisReplicaRegistry creates a ReplicaRegistry using the given redis
+// configuration. The connections are shared with the LobbyStore and the
+// buses using the same configuration.
+func NewRedisReplicaRegistry(config *RedisConfig) ReplicaRegistry {
+	return &redisReplicaRegistry{client: acquireRedisClient(config)}
+}
+
+func (registry *redisReplicaRegistry) SaveReplica(replica *Replica, duration time.Duration) error {
+	data, err := json.Marshal(replica)
+	if err != nil {
+		return err
+	}
+
+	conn := registry.client.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", replicaKey(replica.ID), data, "PX", duration.Milliseconds())
+	conn.Send("SADD", replicasIndexKey, replica.ID)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (registry *redisReplicaRegistry) LoadReplica(id string) (*Replica, error) {
+	conn := registry.client.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", replicaKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrReplicaNotStored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var replica Replica
+	if err := json.Unmarshal(data, &replica); err != nil {
+		return nil, err
+	}
+	return &replica, nil
+}
+
+func (registry *redisReplicaRegistry) LoadReplicaList() ([]*Replica, error) {
+	conn := registry.client.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", replicasIndexKey))
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make([]*Replica, 0, len(ids))
+	for _, id := range ids {
+		data, err := redis.Bytes(conn.Do("GET", replicaKey(id)))
+		if err == redis.ErrNil {
+			conn.Do("SREM", replicasIndexKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var replica Replica
+		if err := json.Unmarshal(data, &replica); err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, &replica)
+	}
+	return replicas, nil
+}
+
+func (registry *redisReplicaRegistry) NextReplicaGeneration(replicaID string) (int64, error) {
+	conn := registry.client.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("INCR", generationKey(replicaID)))
+}
+
+func (registry *redisReplicaRegistry) AcquireSweeperLease(replicaID string, duration time.Duration) (string, error) {
+	conn := registry.client.Get()
+	defer conn.Close()
+
+	return redis.String(acquireLeaseScript.Do(conn, leaseKey(sweeperLeaseID), replicaID, duration.Milliseconds()))
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// createTestRegistries creates a ReplicaRegistry of each kind and returns a
+// function that lets time pass for all of them, see createExpiringTestStores.
+func createTestRegistries(t *testing.T) (map[string]ReplicaRegistry, func(time.Duration)) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	fileRegistry, err := NewFileReplicaRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registries := map[string]ReplicaRegistry{
+		MemoryStore: NewMemoryReplicaRegistry(),
+		FileStore:   fileRegistry,
+		RedisStore:  NewRedisReplicaRegistry(&RedisConfig{Address: server.Addr()}),
+	}
+	elapse := func(duration time.Duration) {
+		time.Sleep(duration)
+		server.FastForward(duration)
+	}
+	return registries, elapse
+}
+
+func Test_ReplicaRegistry(t *testing.T) {
+	registries, elapse := createTestRegistries(t)
+	for name, registry := range registries {
+		registry := registry
+		t.Run(name, func(t *testing.T) {
+			replica := &Replica{ID: "replica-a", Address: "http://a:8080", Lobbies: []string{"lobby"}}
+			if err := registry.SaveReplica(replica, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := registry.LoadReplica("replica-a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Address != replica.Address || len(loaded.Lobbies) != 1 || loaded.Lobbies[0] != "lobby" {
+				t.Errorf("expected %v, but got %v", replica, loaded)
+			}
+
+			if _, err := registry.LoadReplica("unknown"); err != ErrReplicaNotStored {
+				t.Errorf("expected ErrReplicaNotStored, but got %v", err)
+			}
+
+			if err := registry.SaveReplica(&Replica{ID: "replica-b"}, 100*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			elapse(150 * time.Millisecond)
+			if _, err := registry.LoadReplica("replica-b"); err != ErrReplicaNotStored {
+				t.Errorf("expected the entry to have expired, but got %v", err)
+			}
+		})
+	}
+}
+
+func Test_ReplicaRegistrySweeperLease(t *testing.T) {
+	registries, elapse := createTestRegistries(t)
+	for name, registry := range registries {
+		registry := registry
+		t.Run(name, func(t *testing.T) {
+			if holder, err := registry.AcquireSweeperLease("replica-a", 100*time.Millisecond); err != nil || holder != "replica-a" {
+				t.Fatalf("expected replica-a to acquire the lease, but got '%s' (%v)", holder, err)
+			}
+			if holder, err := registry.AcquireSweeperLease("replica-b", time.Minute); err != nil || holder != "replica-a" {
+				t.Errorf("expected replica-a to keep the lease, but got '%s' (%v)", holder, err)
+			}
+
+			elapse(150 * time.Millisecond)
+			if holder, err := registry.AcquireSweeperLease("replica-b", time.Minute); err != nil || holder != "replica-b" {
+				t.Errorf("expected replica-b to take over the expired lease, but got '%s' (%v)", holder, err)
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreLeaseHolder(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			holder, err := store.LoadLeaseHolder("lobby")
+			if err != nil || holder != "" {
+				t.Errorf("expected no holder, but got '%s' (%v)", holder, err)
+			}
+
+			if _, err := store.AcquireLease("lobby", "replica-a", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			holder, err = store.LoadLeaseHolder("lobby")
+			if err != nil || holder != "replica-a" {
+				t.Errorf("expected replica-a, but got '%s' (%v)", holder, err)
+			}
+		})
+	}
+}
+
+func Test_LobbyOwner(t *testing.T) {
+	useTestStore(t)
+	previousReplicas, previousAddress := Replicas, AdvertisedAddress
+	defer func() { Replicas, AdvertisedAddress = previousReplicas, previousAddress }()
+	Replicas = NewMemoryReplicaRegistry()
+	game.ReplicaID = "owner"
+	AdvertisedAddress = "http://owner:8080"
+
+	if owner := LobbyOwner("lobby"); owner != nil {
+		t.Errorf("expected no owner, but got %v", owner)
+	}
+
+	if _, err := Store.AcquireLease("lobby", "owner", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	registerReplica()
+
+	owner := LobbyOwner("lobby")
+	if owner == nil {
+		t.Fatal("expected the lobby to be owned")
+	}
+	if owner.ID != "owner" || owner.Address != "http://owner:8080" {
+		t.Errorf("expected this replica, but got %v", owner)
+	}
+}
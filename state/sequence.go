@@ -0,0 +1,197 @@
+package state
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+var (
+	// GapTimeout defines how long a missing event is waited for before the
+	// events received after it are delivered anyway. In that case, a resync
+	// is requested, as the missing event is assumed to be lost.
+	GapTimeout = 500 * time.Millisecond
+	// MaxPendingEvents limits how many events are held back while waiting
+	// for a missing event.
+	MaxPendingEvents = 64
+
+	outputSequencesMutex = &sync.Mutex{}
+	// outputSequences holds the sequence of the output channel of each lobby
+	// this replica is the reference replica for.
+	outputSequences = make(map[string]*outputSequence)
+)
+
+// outputSequence numbers the events published to the output channel of a
+// lobby. The sequence is held in memory only, so it starts over once the
+// replica is restarted or starts publishing for the lobby again. The epoch
+// tells these sequences apart, as the ID of the replica might stay the same.
+type outputSequence struct {
+	epoch int64
+	last  int64
+}
+
+// StampLobbyEvent assigns the next sequence number of the lobbies output
+// channel to the event. This has to be done by the reference replica right
+// before publishing the event.
+func StampLobbyEvent(event *PersistedEvent) {
+	outputSequencesMutex.Lock()
+	defer outputSequencesMutex.Unlock()
+
+	sequence, known := outputSequences[event.LobbyId]
+	if !known {
+		sequence = &outputSequence{epoch: time.Now().UnixNano()}
+		outputSequences[event.LobbyId] = sequence
+	}
+	sequence.last++
+	event.ReplicaId = game.ReplicaID
+	event.Epoch = sequence.epoch
+	event.Sequence = sequence.last
+}
+
+func forgetOutputSequence(lobbyID string) {
+	outputSequencesMutex.Lock()
+	defer outputSequencesMutex.Unlock()
+
+	delete(outputSequences, lobbyID)
+}
+
+// sequenceReceiver restores the order of the events received via the output
+// channels and drops duplicates. Events are stamped per lobby by the
+// reference replica, so the order is tracked per lobby as well.
+type sequenceReceiver struct {
+	mutex   *sync.Mutex
+	windows map[string]*receiveWindow
+	deliver func(event *PersistedEvent)
+	resync  func(lobbyID string)
+}
+
+// receiveWindow is the state of the output channel of a single lobby.
+type receiveWindow struct {
+	// replicaID is the reference replica stamping the events and epoch the
+	// sequence it stamps them with. If either changes, the sequence starts
+	// over.
+	replicaID string
+	epoch     int64
+	last      int64
+	pending   map[int64]*PersistedEvent
+	gapTimer  *time.Timer
+}
+
+func newSequenceReceiver(deliver func(event *PersistedEvent), resync func(lobbyID string)) *sequenceReceiver {
+	return &sequenceReceiver{
+		mutex:   &sync.Mutex{},
+		windows: make(map[string]*receiveWindow),
+		deliver: deliver,
+		resync:  resync,
+	}
+}
+
+// receive delivers the event and all pending events following it, as long
+// as it is the next one in order. Duplicates are dropped and events following
+// a gap are held back until the gap has been closed or GapTimeout has passed.
+func (receiver *sequenceReceiver) receive(event *PersistedEvent) {
+	//Events that haven't been stamped can't be ordered.
+	if event.Sequence == 0 {
+		receiver.deliver(event)
+		return
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	window, known := receiver.windows[event.LobbyId]
+	if !known || window.replicaID != event.ReplicaId || window.epoch != event.Epoch {
+		if known {
+			window.stopGapTimer()
+		}
+		window = &receiveWindow{
+			replicaID: event.ReplicaId,
+			epoch:     event.Epoch,
+			last:      event.Sequence - 1,
+			pending:   make(map[int64]*PersistedEvent),
+		}
+		receiver.windows[event.LobbyId] = window
+	}
+
+	if event.Sequence <= window.last || window.pending[event.Sequence] != nil {
+		log.Printf("Dropping duplicate event %d of lobby %s", event.Sequence, event.LobbyId)
+		return
+	}
+
+	window.pending[event.Sequence] = event
+	receiver.flush(event.LobbyId, window)
+
+	if len(window.pending) == 0 {
+		window.stopGapTimer()
+	} else if len(window.pending) > MaxPendingEvents {
+		receiver.skipGap(event.LobbyId, window)
+	} else if window.gapTimer == nil {
+		lobbyID := event.LobbyId
+		window.gapTimer = time.AfterFunc(GapTimeout, func() {
+			receiver.mutex.Lock()
+			defer receiver.mutex.Unlock()
+
+			//The window might have been replaced in the meantime.
+			if receiver.windows[lobbyID] == window && len(window.pending) > 0 {
+				receiver.skipGap(lobbyID, window)
+			}
+		})
+	}
+}
+
+// flush delivers all pending events that directly follow the last delivered
+// event.
+func (receiver *sequenceReceiver) flush(lobbyID string, window *receiveWindow) {
+	for {
+		next, available := window.pending[window.last+1]
+		if !available {
+			return
+		}
+		delete(window.pending, window.last+1)
+		window.last++
+		receiver.deliver(next)
+	}
+}
+
+// skipGap gives up on the missing events, delivers everything pending and
+// requests a resync, since the state of the lobby is probably inconsistent.
+func (receiver *sequenceReceiver) skipGap(lobbyID string, window *receiveWindow) {
+	window.stopGapTimer()
+
+	sequences := make([]int64, 0, len(window.pending))
+	for sequence := range window.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(a, b int) bool { return sequences[a] < sequences[b] })
+
+	log.Printf("Missing events %d to %d of lobby %s, requesting resync", window.last+1, sequences[0]-1, lobbyID)
+	for _, sequence := range sequences {
+		receiver.deliver(window.pending[sequence])
+		delete(window.pending, sequence)
+		window.last = sequence
+	}
+
+	receiver.resync(lobbyID)
+}
+
+func (window *receiveWindow) stopGapTimer() {
+	if window.gapTimer != nil {
+		window.gapTimer.Stop()
+		window.gapTimer = nil
+	}
+}
+
+// forget drops the state of the lobby, which is required once nobody on this
+// replica is interested in the lobby anymore.
+func (receiver *sequenceReceiver) forget(lobbyID string) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	if window, known := receiver.windows[lobbyID]; known {
+		window.stopGapTimer()
+		delete(receiver.windows, lobbyID)
+	}
+}
@@ -0,0 +1,138 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type testReceiver struct {
+	mutex     *sync.Mutex
+	delivered []int64
+	resyncs   int
+}
+
+func createTestReceiver() (*sequenceReceiver, *testReceiver) {
+	result := &testReceiver{mutex: &sync.Mutex{}}
+	receiver := newSequenceReceiver(
+		func(event *PersistedEvent) {
+			result.mutex.Lock()
+			defer result.mutex.Unlock()
+			result.delivered = append(result.delivered, event.Sequence)
+		},
+		func(lobbyID string) {
+			result.mutex.Lock()
+			defer result.mutex.Unlock()
+			result.resyncs++
+		})
+	return receiver, result
+}
+
+func (result *testReceiver) check(t *testing.T, expected []int64, expectedResyncs int) {
+	t.Helper()
+
+	result.mutex.Lock()
+	defer result.mutex.Unlock()
+
+	if len(result.delivered) != len(expected) {
+		t.Fatalf("expected %v to be delivered, got %v", expected, result.delivered)
+	}
+	for index, sequence := range expected {
+		if result.delivered[index] != sequence {
+			t.Fatalf("expected %v to be delivered, got %v", expected, result.delivered)
+		}
+	}
+	if result.resyncs != expectedResyncs {
+		t.Errorf("expected %d resyncs, got %d", expectedResyncs, result.resyncs)
+	}
+}
+
+func sequencedEvent(replicaID string, sequence int64) *PersistedEvent {
+	return &PersistedEvent{LobbyId: "lobby", ReplicaId: replicaID, Sequence: sequence}
+}
+
+func Test_sequenceReceiverOrdering(t *testing.T) {
+	receiver, result := createTestReceiver()
+
+	//The first event received defines where the sequence starts.
+	receiver.receive(sequencedEvent("a", 5))
+	receiver.receive(sequencedEvent("a", 7))
+	receiver.receive(sequencedEvent("a", 8))
+	result.check(t, []int64{5}, 0)
+
+	receiver.receive(sequencedEvent("a", 6))
+	result.check(t, []int64{5, 6, 7, 8}, 0)
+
+	//Duplicates are dropped.
+	receiver.receive(sequencedEvent("a", 7))
+	receiver.receive(sequencedEvent("a", 9))
+	receiver.receive(sequencedEvent("a", 9))
+	result.check(t, []int64{5, 6, 7, 8, 9}, 0)
+
+	//A new reference replica starts its own sequence.
+	receiver.receive(sequencedEvent("b", 1))
+	result.check(t, []int64{5, 6, 7, 8, 9, 1}, 0)
+}
+
+func Test_sequenceReceiverGap(t *testing.T) {
+	previousTimeout := GapTimeout
+	GapTimeout = 20 * time.Millisecond
+	defer func() { GapTimeout = previousTimeout }()
+
+	receiver, result := createTestReceiver()
+	receiver.receive(sequencedEvent("a", 1))
+	receiver.receive(sequencedEvent("a", 3))
+	receiver.receive(sequencedEvent("a", 4))
+	result.check(t, []int64{1}, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	result.check(t, []int64{1, 3, 4}, 1)
+
+	//The lost event arriving late is treated as duplicate.
+	receiver.receive(sequencedEvent("a", 2))
+	receiver.receive(sequencedEvent("a", 5))
+	result.check(t, []int64{1, 3, 4, 5}, 1)
+}
+
+func Test_sequenceReceiverPendingLimit(t *testing.T) {
+	receiver, result := createTestReceiver()
+	receiver.receive(sequencedEvent("a", 1))
+
+	expected := []int64{1}
+	for sequence := int64(3); sequence <= int64(MaxPendingEvents)+3; sequence++ {
+		receiver.receive(sequencedEvent("a", sequence))
+		expected = append(expected, sequence)
+	}
+	result.check(t, expected, 1)
+}
+
+func Test_sequenceReceiverRestartedReplica(t *testing.T) {
+	receiver, result := createTestReceiver()
+	receiver.receive(sequencedEvent("a", 41))
+	receiver.receive(sequencedEvent("a", 42))
+
+	//The replica keeps its ID across restarts, but its sequence starts over.
+	restarted := sequencedEvent("a", 1)
+	restarted.Epoch = 1
+	receiver.receive(restarted)
+	result.check(t, []int64{41, 42, 1}, 0)
+}
+
+func Test_StampLobbyEvent(t *testing.T) {
+	defer forgetOutputSequence("stamped")
+
+	first, second := &PersistedEvent{LobbyId: "stamped"}, &PersistedEvent{LobbyId: "stamped"}
+	StampLobbyEvent(first)
+	StampLobbyEvent(second)
+	if first.Sequence != 1 || second.Sequence != 2 || first.Epoch == 0 || first.Epoch != second.Epoch {
+		t.Fatalf("expected consecutive events of the same epoch, but got %+v and %+v", first, second)
+	}
+
+	//Starting over, for example after a restart, starts a new epoch.
+	forgetOutputSequence("stamped")
+	restarted := &PersistedEvent{LobbyId: "stamped"}
+	StampLobbyEvent(restarted)
+	if restarted.Sequence != 1 || restarted.Epoch == first.Epoch {
+		t.Errorf("expected a new epoch, but got %+v", restarted)
+	}
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+// ErrVersionConflict is returned when saving a lobby that has been changed
+// by someone else since it has been loaded or saved.
+var ErrVersionConflict = errors.New("lobby has been modified concurrently")
+
+// LobbyStore is a storage backend for persisted lobbies. Implementations
+// have to be safe for concurrent use.
+type LobbyStore interface {
+	// SaveLobby stores the lobby, replacing any previous state. Saving is a
+	// compare-and-set operation: if the stored version of the lobby doesn't
+	// match Lobby.Version, ErrVersionConflict is returned. On success, the
+	// version of the lobby is incremented. Saving a lobby extends its
+	// lifetime the same way TouchLobby does.
+	SaveLobby(lobby *game.Lobby) error
+	// LoadLobby loads the lobby with the given ID. Documents that can't be
+	// decoded result in an ErrCorruptLobby, documents written with a newer
+	// schema version in an ErrNewerLobby.
+	LoadLobby(id string) (*game.Lobby, error)
+	// DeleteLobby removes the lobby and everything related to it.
+	DeleteLobby(id string) error
+	// LoadLobbyList returns the IDs of all stored lobbies.
+	LoadLobbyList() ([]string, error)
+	// ScanPublicLobbies returns a batch of the IDs of the public lobbies
+	// matching the filter, starting at the cursor. The iteration starts
+	// with an empty cursor and is complete once the returned cursor is
+	// empty. The count is only a hint for the size of the batch. As the
+	// lobbies might have changed since they have been saved, they still
+	// have to be checked against the filter once loaded.
+	ScanPublicLobbies(filter LobbyFilter, cursor string, count int) ([]string, string, error)
+	// IndexLobby updates the indexes ScanPublicLobbies relies on according
+	// to the current state of a stored lobby, without saving the lobby.
+	// Lobbies that aren't stored are left alone.
+	IndexLobby(lobby *game.Lobby) error
+	// QuarantineLobby moves the document of a lobby that can't be loaded
+	// aside, so that it isn't listed anymore, but kept for inspection.
+	// Everything else related to the lobby is removed.
+	QuarantineLobby(id string) error
+	// TouchLobby extends the lifetime of the lobby. A lobby that hasn't been
+	// saved or touched within LobbyExpiry expires.
+	TouchLobby(id string) error
+	// ExpiredLobbies returns the IDs of the lobbies that have expired, but
+	// whose related data hasn't been removed via DeleteLobby yet.
+	ExpiredLobbies() ([]string, error)
+
+	// SavePlayer adds the player to the player registry of the lobby or
+	// updates its entry. The registry allows replicas to resolve players
+	// that have joined the lobby through another replica. It is removed
+	// along with the lobby.
+	SavePlayer(lobbyID string, player *game.PlayerEntity) error
+	// LoadPlayer returns the registered player with the given ID. Players
+	// that aren't registered result in an ErrPlayerNotStored.
+	LoadPlayer(lobbyID, playerID string) (*game.PlayerEntity, error)
+	// LoadPlayerBySession returns the registered player with the given user
+	// session. Players that aren't registered result in an
+	// ErrPlayerNotStored.
+	LoadPlayerBySession(lobbyID, userSession string) (*game.PlayerEntity, error)
+
+	// NextLobbySequence returns the next sequence number for the event log
+	// of the given lobby.
+	NextLobbySequence(id string) (int64, error)
+	// AppendLobbyEvent adds an event to the event log of its lobby and
+	// returns the amount of events in the log afterwards.
+	AppendLobbyEvent(event *LobbyEvent) (int, error)
+	// LoadLobbyEvents returns all events logged after the last snapshot.
+	LoadLobbyEvents(id string) ([]*LobbyEvent, error)
+	// SnapshotLobby stores the complete lobby and drops its event log. It
+	// checks and increments the version the same way SaveLobby does.
+	SnapshotLobby(lobby *game.Lobby) error
+
+	// AppendDrawing adds a drawing operation to the drawing of the given
+	// turn. Drawings are kept separate from the rest of the lobby, which is
+	// why SaveLobby doesn't store the current drawing. LoadLobby reassembles
+	// the drawing of the turn the lobby is in.
+	AppendDrawing(lobbyID string, turn int, operation *game.DrawingOperation) error
+	// ClearDrawing drops the drawing of the given turn.
+	ClearDrawing(lobbyID string, turn int) error
+
+	// AcquireLease acquires or renews the lease of the given replica on the
+	// given lobby. The lease expires after the given duration, unless it is
+	// renewed before. The replica currently holding the lease is returned,
+	// meaning the lease has been acquired if that's the given replica.
+	AcquireLease(lobbyID, replicaID string, duration time.Duration) (string, error)
+	// LoadLeaseHolder returns the replica currently holding the lease on the
+	// given lobby, or an empty string if nobody holds it.
+	LoadLeaseHolder(lobbyID string) (string, error)
+}
+
+// Available LobbyStore implementations, see NewLobbyStore.
+const (
+	MemoryStore = "memory"
+	RedisStore  = "redis"
+	FileStore   = "file"
+)
+
+var (
+	// Store is the backend used for persisting lobbies. By default lobbies
+	// are only held in memory.
+	Store LobbyStore = NewMemoryLobbyStore()
+	// StorePath is the directory used by the file store.
+	StorePath = "data"
+)
+
+// NewLobbyStore creates the LobbyStore of the given kind. The redis store
+// connects to RedisURL or DatabaseHost, the file store writes to StorePath.
+func NewLobbyStore(kind string) (LobbyStore, error) {
+	switch kind {
+	case MemoryStore:
+		return NewMemoryLobbyStore(), nil
+	case RedisStore:
+		config, err := currentRedisConfig()
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisLobbyStore(config), nil
+	case FileStore:
+		return NewFileLobbyStore(StorePath)
+	}
+
+	return nil, fmt.Errorf("unknown lobby store '%s'", kind)
+}
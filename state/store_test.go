@@ -0,0 +1,314 @@
+package state
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/guillaumerosinosky/scribble.rs/game"
+)
+
+func createTestLobby(t *testing.T, id string) *game.Lobby {
+	_, lobby, err := game.CreateLobby("owner", "english", true, 120, 4, 12, 0, 1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobby.LobbyID = id
+	return lobby
+}
+
+// useTestStore makes the package use a fresh memory store for the duration
+// of the test. The replica ID is restored afterwards as well, so that the
+// test is free to change it.
+func useTestStore(t *testing.T) {
+	previousStore, previousReplica := Store, game.ReplicaID
+	t.Cleanup(func() { Store, game.ReplicaID = previousStore, previousReplica })
+	Store = NewMemoryLobbyStore()
+}
+
+func createTestStores(t *testing.T) map[string]LobbyStore {
+	fileStore, err := NewFileLobbyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	return map[string]LobbyStore{
+		MemoryStore: NewMemoryLobbyStore(),
+		FileStore:   fileStore,
+		RedisStore:  NewRedisLobbyStore(&RedisConfig{Address: server.Addr()}),
+	}
+}
+
+func Test_LobbyStore(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.LoadLobby("missing"); err != ErrLobbyNotStored {
+				t.Errorf("expected ErrLobbyNotStored, got %v", err)
+			}
+
+			first := createTestLobby(t, "first")
+			second := createTestLobby(t, "../second")
+			for _, lobby := range []*game.Lobby{first, second} {
+				if err := store.SaveLobby(lobby); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ids, err := store.LoadLobbyList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(ids)
+			if len(ids) != 2 || ids[0] != "../second" || ids[1] != "first" {
+				t.Errorf("unexpected lobby list %v", ids)
+			}
+
+			loaded, err := store.LoadLobby("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.LobbyID != "first" || len(loaded.GetPlayers()) != 1 || loaded.Wordpack != "english" {
+				t.Errorf("loaded lobby doesn't match saved lobby")
+			}
+
+			if err := store.DeleteLobby("first"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.LoadLobby("first"); err != ErrLobbyNotStored {
+				t.Errorf("expected ErrLobbyNotStored after deletion, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreEvents(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			lobby := createTestLobby(t, "events")
+			for i := 1; i <= 3; i++ {
+				sequence, err := store.NextLobbySequence(lobby.LobbyID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sequence != int64(i) {
+					t.Errorf("expected sequence %d, got %d", i, sequence)
+				}
+
+				length, err := store.AppendLobbyEvent(&LobbyEvent{
+					LobbyID:   lobby.LobbyID,
+					PlayerID:  "player",
+					Sequence:  sequence,
+					Timestamp: time.Now(),
+					Data:      []byte(`{"type":"message","data":"hello"}`),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if length != i {
+					t.Errorf("expected log length %d, got %d", i, length)
+				}
+			}
+
+			events, err := store.LoadLobbyEvents(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 3 || events[2].Sequence != 3 || string(events[0].Data) != `{"type":"message","data":"hello"}` {
+				t.Errorf("unexpected events %v", events)
+			}
+
+			if err := store.SnapshotLobby(lobby); err != nil {
+				t.Fatal(err)
+			}
+			events, err = store.LoadLobbyEvents(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 0 {
+				t.Errorf("expected empty event log after snapshot, got %d events", len(events))
+			}
+			if _, err := store.LoadLobby(lobby.LobbyID); err != nil {
+				t.Errorf("expected snapshot to be loadable, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreDrawing(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			lobby := createTestLobby(t, "drawing")
+			line := &game.LineEvent{Type: "line", Data: &game.Line{FromX: 1, FromY: 2, ToX: 3, ToY: 4, LineWidth: 8}}
+			fill := &game.FillEvent{Type: "fill", Data: &game.Fill{X: 5, Y: 6}}
+
+			//Drawing operations added to the lobby directly aren't part of the
+			//saved document, they have to be appended to the store.
+			lobby.AppendLine(line)
+			if err := store.SaveLobby(lobby); err != nil {
+				t.Fatal(err)
+			}
+			for _, operation := range []*game.DrawingOperation{game.NewLineOperation(line.Data), game.NewFillOperation(fill.Data)} {
+				if err := store.AppendDrawing(lobby.LobbyID, lobby.Turn, operation); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.AppendDrawing(lobby.LobbyID, lobby.Turn+1, game.NewLineOperation(line.Data)); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := store.LoadLobby(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			drawing := game.MarshallLobby(loaded).CurrentDrawing
+			if len(drawing) != 2 {
+				t.Fatalf("expected drawing of length 2, got %d", len(drawing))
+			}
+			if drawing[0].Type != game.DrawingOperationLine || *drawing[0].Line != *line.Data {
+				t.Errorf("expected the line to survive loading, got %+v", drawing[0])
+			}
+			if drawing[1].Type != game.DrawingOperationFill || *drawing[1].Fill != *fill.Data {
+				t.Errorf("expected the fill to survive loading, got %+v", drawing[1])
+			}
+
+			if err := store.ClearDrawing(lobby.LobbyID, lobby.Turn); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err = store.LoadLobby(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if drawing := game.MarshallLobby(loaded).CurrentDrawing; len(drawing) != 0 {
+				t.Errorf("expected empty drawing after clearing, got %d operations", len(drawing))
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreVersionConflict(t *testing.T) {
+	for name, store := range createTestStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			lobby := createTestLobby(t, "conflict")
+			if err := store.SaveLobby(lobby); err != nil {
+				t.Fatal(err)
+			}
+			if lobby.Version != 1 {
+				t.Errorf("expected version 1 after first save, got %d", lobby.Version)
+			}
+
+			//Another lobby with the same ID can't overwrite the stored one.
+			if err := store.SaveLobby(createTestLobby(t, "conflict")); err != ErrVersionConflict {
+				t.Errorf("expected ErrVersionConflict for new lobby, got %v", err)
+			}
+
+			first, err := store.LoadLobby(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := store.LoadLobby(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.SaveLobby(first); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SaveLobby(second); err != ErrVersionConflict {
+				t.Errorf("expected ErrVersionConflict for outdated lobby, got %v", err)
+			}
+			if err := store.SnapshotLobby(second); err != ErrVersionConflict {
+				t.Errorf("expected ErrVersionConflict for outdated snapshot, got %v", err)
+			}
+			if err := store.SnapshotLobby(first); err != nil {
+				t.Errorf("expected snapshot of current lobby to succeed, got %v", err)
+			}
+
+			loaded, err := store.LoadLobby(lobby.LobbyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Version != 3 {
+				t.Errorf("expected stored version 3, got %d", loaded.Version)
+			}
+		})
+	}
+}
+
+func Test_LobbyStoreLease(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	fileStore, err := NewFileLobbyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]LobbyStore{
+		MemoryStore: NewMemoryLobbyStore(),
+		FileStore:   fileStore,
+		RedisStore:  NewRedisLobbyStore(&RedisConfig{Address: server.Addr()}),
+	}
+	for name, store := range stores {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			acquire := func(replicaID string, expectedHolder string) {
+				holder, err := store.AcquireLease("lease", replicaID, 10*time.Millisecond)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if holder != expectedHolder {
+					t.Errorf("expected lease to be held by %s, but was held by %s", expectedHolder, holder)
+				}
+			}
+
+			acquire("first", "first")
+			acquire("second", "first")
+			//Renewing the lease keeps it.
+			acquire("first", "first")
+
+			//Redis doesn't expire keys by itself in tests.
+			time.Sleep(20 * time.Millisecond)
+			server.FastForward(20 * time.Millisecond)
+
+			acquire("second", "second")
+			acquire("first", "second")
+		})
+	}
+}
+
+// putTestLobbies makes this instance hold the given lobbies without storing
+// them. Tests doing so have to call clearTestLobbies once done.
+func putTestLobbies(held ...*game.Lobby) {
+	globalStateMutex.Lock()
+	defer globalStateMutex.Unlock()
+
+	for _, lobby := range held {
+		putLobby(lobby)
+	}
+}
+
+// clearTestLobbies forgets all lobbies held by this instance.
+func clearTestLobbies() {
+	globalStateMutex.Lock()
+	defer globalStateMutex.Unlock()
+
+	lobbies = make(map[string]*game.Lobby)
+	lobbyOrder = nil
+	lobbiesByPlayerID = make(map[string]string)
+	lobbiesBySession = make(map[string]string)
+	indexedPlayers = make(map[string][]indexedPlayer)
+}
@@ -0,0 +1,353 @@
+package state
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// StreamMaxLength is the approximate amount of messages kept per stream.
+	// Older messages are trimmed, whether they have been handled or not.
+	StreamMaxLength = 1000
+	// StreamMaxDeliveries defines how often a message is delivered before it
+	// is dropped, as it apparently can't be handled.
+	StreamMaxDeliveries int64 = 5
+	// StreamClaimInterval defines how often pending messages are retried.
+	// Messages of other consumers are claimed, once they have been pending
+	// for at least that long. This covers messages received by a replica
+	// that hadn't noticed yet that it isn't the reference replica anymore.
+	StreamClaimInterval = 5 * time.Second
+	// streamBlockTime is how long a read waits for new messages, before
+	// checking whether the subscription has ended.
+	streamBlockTime = time.Second
+)
+
+// streamGroup is the consumer group reading the streams. There's only a
+// single group, as each stream is only handled by one replica at a time.
+const streamGroup = "reference"
+
+// redisStreamBus carries messages over redis streams instead of pub/sub.
+// Messages stay in the stream until they have been handled successfully, so
+// they survive restarts and short disconnects of the subscriber. Unlike the
+// other implementations, each message is only delivered to one subscriber,
+// which makes this suitable for channels that are handled by a single
+// replica, such as the lobby input channel.
+//
+// Subscribing claims all messages that have been delivered to a different
+// consumer, but haven't been acknowledged, which is what happens when taking
+// over a lobby from a replica that has died.
+type redisStreamBus struct {
+	client   *redisClient
+	consumer string
+
+	mutex  *sync.Mutex
+	closed bool
+	stops  map[*streamSubscription]bool
+}
+
+type streamSubscription struct {
+	stream  string
+	handler MessageHandler
+	done    chan struct{}
+	once    *sync.Once
+	//finished is closed once the consumer has returned.
+	finished chan struct{}
+}
+
+// NewRedisStreamBus creates a Bus using the given redis configuration. The
+// consumer identifies this replica within the consumer group.
+func NewRedisStreamBus(config *RedisConfig, consumer string) Bus {
+	return &redisStreamBus{
+		client:   acquireRedisClient(config),
+		consumer: consumer,
+		mutex:    &sync.Mutex{},
+		stops:    make(map[*streamSubscription]bool),
+	}
+}
+
+func (bus *redisStreamBus) isClosed() bool {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	return bus.closed
+}
+
+func (bus *redisStreamBus) Publish(channel string, data []byte) error {
+	if bus.isClosed() {
+		return ErrBusClosed
+	}
+
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XADD", redisChannelPrefix+channel, "MAXLEN", "~", StreamMaxLength, "*", "data", data)
+	return err
+}
+
+func (bus *redisStreamBus) Subscribe(channel string, handler MessageHandler) (func(), error) {
+	if bus.isClosed() {
+		return nil, ErrBusClosed
+	}
+
+	stream := redisChannelPrefix + channel
+	if err := bus.createGroup(stream); err != nil {
+		return nil, err
+	}
+
+	subscription := &streamSubscription{
+		stream:   stream,
+		handler:  handler,
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+		finished: make(chan struct{}),
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if bus.closed {
+		return nil, ErrBusClosed
+	}
+	bus.stops[subscription] = true
+	go bus.consume(subscription)
+
+	return func() {
+		bus.mutex.Lock()
+		delete(bus.stops, subscription)
+		bus.mutex.Unlock()
+		subscription.stop()
+		//Once unsubscribed, the handler mustn't be called anymore.
+		<-subscription.finished
+	}, nil
+}
+
+func (bus *redisStreamBus) Close() error {
+	bus.mutex.Lock()
+	bus.closed = true
+	stopped := make([]*streamSubscription, 0, len(bus.stops))
+	for subscription := range bus.stops {
+		subscription.stop()
+		delete(bus.stops, subscription)
+		stopped = append(stopped, subscription)
+	}
+	bus.mutex.Unlock()
+
+	//The consumers still use the client until they have returned.
+	for _, subscription := range stopped {
+		<-subscription.finished
+	}
+	return bus.client.release()
+}
+
+// RemoveChannel deletes the stream of the channel. This drops the consumer
+// group of the stream and the messages that haven't been handled as well.
+func (bus *redisStreamBus) RemoveChannel(channel string) error {
+	if bus.isClosed() {
+		return ErrBusClosed
+	}
+
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", redisChannelPrefix+channel)
+	return err
+}
+
+func (subscription *streamSubscription) stop() {
+	subscription.once.Do(func() {
+		close(subscription.done)
+	})
+}
+
+func (subscription *streamSubscription) stopped() bool {
+	select {
+	case <-subscription.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// createGroup creates the consumer group, unless it exists already. New
+// groups start at the end of the stream.
+func (bus *redisStreamBus) createGroup(stream string) error {
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "CREATE", stream, streamGroup, "$", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// consume handles the messages of the stream until the subscription ends.
+// Pending messages are handled first, including those left behind by other
+// consumers, and are retried periodically afterwards.
+func (bus *redisStreamBus) consume(subscription *streamSubscription) {
+	defer close(subscription.finished)
+	bus.handlePending(subscription, 0)
+	lastClaim := time.Now()
+
+	for !subscription.stopped() {
+		if _, err := bus.read(subscription, ">"); err != nil {
+			log.Printf("Error reading messages of %s : %s", subscription.stream, err)
+			time.Sleep(time.Second)
+		}
+
+		if time.Since(lastClaim) >= StreamClaimInterval {
+			bus.handlePending(subscription, StreamClaimInterval)
+			lastClaim = time.Now()
+		}
+	}
+}
+
+// handlePending claims the messages of other consumers that have been
+// pending for at least minIdleTime and handles all messages pending for
+// this consumer.
+func (bus *redisStreamBus) handlePending(subscription *streamSubscription, minIdleTime time.Duration) {
+	if err := bus.claimPending(subscription.stream, minIdleTime); err != nil {
+		log.Printf("Error claiming pending messages of %s : %s", subscription.stream, err)
+	}
+
+	//Reading from an ID returns the pending messages of this consumer,
+	//whereas reading from ">" returns new messages.
+	for start := "0"; !subscription.stopped(); {
+		last, err := bus.read(subscription, start)
+		if err != nil {
+			log.Printf("Error reading pending messages of %s : %s", subscription.stream, err)
+			return
+		}
+		if last == "" {
+			return
+		}
+		start = last
+	}
+}
+
+// claimPending takes over the messages that have been delivered to other
+// consumers, but haven't been acknowledged for at least minIdleTime.
+// Messages that have been delivered too often are dropped.
+func (bus *redisStreamBus) claimPending(stream string, minIdleTime time.Duration) error {
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	pending, err := redis.Values(conn.Do("XPENDING", stream, streamGroup, "-", "+", StreamMaxLength))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range pending {
+		fields, err := redis.Values(entry, nil)
+		if err != nil || len(fields) < 4 {
+			continue
+		}
+		id, _ := redis.String(fields[0], nil)
+		consumer, _ := redis.String(fields[1], nil)
+		deliveries, _ := redis.Int64(fields[3], nil)
+
+		if deliveries >= StreamMaxDeliveries {
+			log.Printf("Dropping message %s of %s after %d deliveries", id, stream, deliveries)
+			if _, err := conn.Do("XACK", stream, streamGroup, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if consumer != bus.consumer {
+			if _, err := conn.Do("XCLAIM", stream, streamGroup, bus.consumer, minIdleTime.Milliseconds(), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read handles one batch of messages, starting after the given ID. Messages
+// are acknowledged as soon as they have been handled successfully. The ID
+// of the last message read is returned, which is empty if there was none.
+func (bus *redisStreamBus) read(subscription *streamSubscription, start string) (string, error) {
+	conn := bus.client.Get()
+	defer conn.Close()
+
+	arguments := []interface{}{"GROUP", streamGroup, bus.consumer, "COUNT", 100}
+	if start == ">" {
+		arguments = append(arguments, "BLOCK", streamBlockTime.Milliseconds())
+	}
+	arguments = append(arguments, "STREAMS", subscription.stream, start)
+
+	//The read timeout of the connection has to outlast the blocking time.
+	reply, err := redis.DoWithTimeout(conn, streamBlockTime+RedisReadTimeout, "XREADGROUP", arguments...)
+	if err != nil || reply == nil {
+		return "", err
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var last string
+	for _, stream := range streams {
+		streamFields, err := redis.Values(stream, nil)
+		if err != nil || len(streamFields) != 2 {
+			continue
+		}
+		messages, err := redis.Values(streamFields[1], nil)
+		if err != nil {
+			return last, err
+		}
+
+		for _, message := range messages {
+			if subscription.stopped() {
+				return last, nil
+			}
+
+			id, data, err := parseStreamMessage(message)
+			if err != nil {
+				return last, err
+			}
+			last = id
+
+			//Deleted messages are still listed as pending, but without data.
+			if data != nil {
+				if err := subscription.handler(data); err != nil {
+					log.Printf("Error handling message %s of %s : %s", id, subscription.stream, err)
+					continue
+				}
+			}
+			if _, err := conn.Do("XACK", subscription.stream, streamGroup, id); err != nil {
+				return last, err
+			}
+		}
+	}
+	return last, nil
+}
+
+// parseStreamMessage returns the ID and data field of a single entry of a
+// XREADGROUP reply.
+func parseStreamMessage(message interface{}) (string, []byte, error) {
+	fields, err := redis.Values(message, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := redis.String(fields[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	values, _ := redis.ByteSlices(fields[1], nil)
+	for index := 0; index+1 < len(values); index += 2 {
+		if string(values[index]) == "data" {
+			return id, values[index+1], nil
+		}
+	}
+	return id, nil, nil
+}
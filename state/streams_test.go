@@ -0,0 +1,237 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func createTestStreamServer(t *testing.T) *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func createTestStreamBus(t *testing.T, server *miniredis.Miniredis, consumer string) Bus {
+	bus := NewRedisStreamBus(&RedisConfig{Address: server.Addr()}, consumer)
+	t.Cleanup(func() { bus.Close() })
+	return bus
+}
+
+func expectMessage(t *testing.T, received chan string, expected string) {
+	select {
+	case message := <-received:
+		if message != expected {
+			t.Errorf("expected message %s, but got %s", expected, message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("message %s not received", expected)
+	}
+}
+
+func pendingMessages(t *testing.T, server *miniredis.Miniredis, channel string) int64 {
+	conn, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	summary, err := redis.Values(conn.Do("XPENDING", redisChannelPrefix+channel, streamGroup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := redis.Int64(summary[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func Test_RedisStreamBus(t *testing.T) {
+	server := createTestStreamServer(t)
+	bus := createTestStreamBus(t, server, "first")
+
+	received, unsubscribe := subscribeTestChannel(t, bus, "channel")
+	defer unsubscribe()
+
+	for _, message := range []string{"a", "b", "c"} {
+		if err := bus.Publish("channel", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range []string{"a", "b", "c"} {
+		expectMessage(t, received, message)
+	}
+
+	//Acknowledging happens right after handling.
+	time.Sleep(50 * time.Millisecond)
+	if pending := pendingMessages(t, server, "channel"); pending != 0 {
+		t.Errorf("expected no pending messages, but got %d", pending)
+	}
+}
+
+func Test_RedisStreamBusRedelivery(t *testing.T) {
+	previousClaimInterval := StreamClaimInterval
+	StreamClaimInterval = 100 * time.Millisecond
+	defer func() { StreamClaimInterval = previousClaimInterval }()
+
+	server := createTestStreamServer(t)
+	first := createTestStreamBus(t, server, "first")
+
+	attempted := make(chan string, 64)
+	unsubscribe, err := first.Subscribe("channel", func(data []byte) error {
+		attempted <- string(data)
+		return errors.New("not the reference replica")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Publish("channel", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, attempted, "a")
+	unsubscribe()
+
+	if pending := pendingMessages(t, server, "channel"); pending != 1 {
+		t.Fatalf("expected one pending message, but got %d", pending)
+	}
+
+	//The replica taking over claims the message left behind.
+	second := createTestStreamBus(t, server, "second")
+	received, unsubscribeSecond := subscribeTestChannel(t, second, "channel")
+	defer unsubscribeSecond()
+	expectMessage(t, received, "a")
+
+	if err := second.Publish("channel", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, received, "b")
+}
+
+func Test_RedisStreamBusClaimIdle(t *testing.T) {
+	previousClaimInterval := StreamClaimInterval
+	StreamClaimInterval = 100 * time.Millisecond
+	defer func() { StreamClaimInterval = previousClaimInterval }()
+
+	server := createTestStreamServer(t)
+	first := createTestStreamBus(t, server, "first")
+	second := createTestStreamBus(t, server, "second")
+
+	//Both replicas consider themselves the reference replica for a moment,
+	//but only the second one is able to handle the messages.
+	unsubscribe, err := first.Subscribe("channel", func(data []byte) error {
+		return errors.New("not the reference replica")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	received, unsubscribeSecond := subscribeTestChannel(t, second, "channel")
+	defer unsubscribeSecond()
+
+	messages := []string{"a", "b", "c", "d"}
+	for _, message := range messages {
+		if err := second.Publish("channel", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handled := make(map[string]bool)
+	for range messages {
+		select {
+		case message := <-received:
+			handled[message] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("only received %v", handled)
+		}
+	}
+	for _, message := range messages {
+		if !handled[message] {
+			t.Errorf("message %s not handled", message)
+		}
+	}
+}
+
+func Test_RedisStreamBusMaxDeliveries(t *testing.T) {
+	previousMaxDeliveries := StreamMaxDeliveries
+	StreamMaxDeliveries = 1
+	defer func() { StreamMaxDeliveries = previousMaxDeliveries }()
+	previousClaimInterval := StreamClaimInterval
+	StreamClaimInterval = 100 * time.Millisecond
+	defer func() { StreamClaimInterval = previousClaimInterval }()
+
+	server := createTestStreamServer(t)
+	first := createTestStreamBus(t, server, "first")
+
+	attempted := make(chan string, 64)
+	unsubscribe, err := first.Subscribe("channel", func(data []byte) error {
+		attempted <- string(data)
+		return errors.New("broken message")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Publish("channel", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, attempted, "a")
+	unsubscribe()
+	//Otherwise the ongoing read of the first subscription might receive the
+	//next message, which would count as its only delivery.
+	time.Sleep(streamBlockTime + 100*time.Millisecond)
+
+	//The message has been delivered too often and is dropped on takeover.
+	second := createTestStreamBus(t, server, "second")
+	received, unsubscribeSecond := subscribeTestChannel(t, second, "channel")
+	defer unsubscribeSecond()
+
+	if err := second.Publish("channel", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, received, "b")
+	time.Sleep(50 * time.Millisecond)
+	if pending := pendingMessages(t, server, "channel"); pending != 0 {
+		t.Errorf("expected no pending messages, but got %d", pending)
+	}
+}
+
+func Test_removedLobbiesDropInputStream(t *testing.T) {
+	useTestStore(t)
+	previousBus := MessageBus
+	defer func() { MessageBus = previousBus }()
+
+	for name, remove := range map[string]func(id string){
+		"deleted":     DeleteLobby,
+		"quarantined": func(id string) { quarantineLobby(id, ErrCorruptLobby) },
+	} {
+		remove := remove
+		t.Run(name, func(t *testing.T) {
+			server := createTestStreamServer(t)
+			MessageBus = createTestStreamBus(t, server, "first")
+
+			//The reference replica has handled the input and left.
+			received, unsubscribe := subscribeTestChannel(t, MessageBus, LobbyInputChannel("removed"))
+			if err := MessageBus.Publish(LobbyInputChannel("removed"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			expectMessage(t, received, "a")
+			unsubscribe()
+
+			stream := redisChannelPrefix + LobbyInputChannel("removed")
+			if !server.Exists(stream) {
+				t.Fatal("expected the stream to exist")
+			}
+			remove("removed")
+			if server.Exists(stream) {
+				t.Error("expected the stream and its consumer group to be removed")
+			}
+		})
+	}
+}
@@ -20,9 +20,13 @@ func main() {
 	interval := flag.Duration("interval", 5*time.Minute, "interval in which we'll send requests.")
 	page := flag.String("page", "https://scribblers-official.herokuapp.com", "page on which we'll call /v1/stats")
 	output := flag.String("output", "output.json", "output file for retrieved data")
+	aggregate := flag.Bool("aggregate", false, "whether to collect the stats of the whole cluster instead of a single replica.")
 	flag.Parse()
 
 	url := *page + "/v1/stats"
+	if *aggregate {
+		url += "?aggregate=true"
+	}
 	outputFile, openError := os.OpenFile(*output, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if openError != nil {
 		panic(openError)